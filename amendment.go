@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//AMENDMENT_KEY_TYPE Composite key object type of amendments, amendment~<ufanumber>~<sequence>
+const AMENDMENT_KEY_TYPE = "amendment"
+
+//Statuses of an amendment
+const (
+	AMENDMENT_PROPOSED = "Proposed"
+	AMENDMENT_ACCEPTED = "Accepted"
+	AMENDMENT_REJECTED = "Rejected"
+)
+
+//UFA statuses in which the agreed charges can be amended
+var amendableStatuses = []string{STATUS_AGREED, STATUS_SUSPENDED, STATUS_EXHAUSTED}
+
+//Amendment Change of the agreed charges proposed by one side of an UFA and
+//signed off by an approver of the other. An accepted amendment carries the
+//version of the UFA it created.
+type Amendment struct {
+	UFANumber      string      `json:"ufanumber"`
+	Sequence       int         `json:"sequence"`
+	NetCharge      *Money      `json:"netCharge,omitempty"`
+	ChargTolrence  *Percentage `json:"chargTolrence,omitempty"`
+	Reason         string      `json:"reason,omitempty"`
+	Status         string      `json:"status"`
+	ProposedBy     string      `json:"proposedBy"`
+	ProposerSide   string      `json:"proposerSide"`
+	ProposedAt     string      `json:"proposedAt"`
+	DecidedBy      string      `json:"decidedBy,omitempty"`
+	DecidedAt      string      `json:"decidedAt,omitempty"`
+	DecisionReason string      `json:"decisionReason,omitempty"`
+	Version        int         `json:"version,omitempty"`
+}
+
+//amendmentRequest Payload of proposeAmendment
+type amendmentRequest struct {
+	NetCharge     *Money      `json:"netCharge"`
+	ChargTolrence *Percentage `json:"chargTolrence"`
+	Reason        string      `json:"reason"`
+}
+
+//Returns the ledger key of an amendment, the sequence is padded to keep the key order
+func amendmentKey(stub shim.ChaincodeStubInterface, ufanumber string, sequence int) (string, error) {
+	return stub.CreateCompositeKey(AMENDMENT_KEY_TYPE, []string{ufanumber, fmt.Sprintf("%06d", sequence)})
+}
+
+//Reads the amendments of an UFA, oldest first
+func getAmendmentRecords(stub shim.ChaincodeStubInterface, ufanumber string) ([]Amendment, error) {
+	values, err := getStateByPartialKey(stub, AMENDMENT_KEY_TYPE, []string{ufanumber})
+	if err != nil {
+		return nil, err
+	}
+	amendments := make([]Amendment, 0, len(values))
+	for _, value := range values {
+		var amendment Amendment
+		if err := json.Unmarshal(value, &amendment); err != nil {
+			return nil, errors.New("Corrupt amendment of " + ufanumber + ": " + err.Error())
+		}
+		amendments = append(amendments, amendment)
+	}
+	return amendments, nil
+}
+
+//Reads an amendment from the ledger, nil if it does not exist
+func getAmendment(stub shim.ChaincodeStubInterface, ufanumber string, sequence int) (*Amendment, error) {
+	key, err := amendmentKey(stub, ufanumber, sequence)
+	if err != nil {
+		return nil, err
+	}
+	amendmentBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if amendmentBytes == nil {
+		return nil, nil
+	}
+	var amendment Amendment
+	if err := json.Unmarshal(amendmentBytes, &amendment); err != nil {
+		return nil, errors.New("Corrupt amendment " + key + ": " + err.Error())
+	}
+	return &amendment, nil
+}
+
+//Writes an amendment to the ledger
+func putAmendment(stub shim.ChaincodeStubInterface, amendment *Amendment) error {
+	key, err := amendmentKey(stub, amendment.UFANumber, amendment.Sequence)
+	if err != nil {
+		return err
+	}
+	amendmentBytes, err := json.Marshal(amendment)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, amendmentBytes)
+}
+
+//Returns the terms of an UFA with an amendment applied
+func (a *Amendment) applyTo(ufa *UFA) *UFA {
+	amended := ufa.clone()
+	if a.NetCharge != nil {
+		amended.NetCharge = *a.NetCharge
+	}
+	if a.ChargTolrence != nil {
+		amended.ChargTolrence = *a.ChargTolrence
+	}
+	return amended
+}
+
+//Checks the amended terms of an UFA still hold the invoices raised against it
+func validateAmendedUFA(ufa *UFA) error {
+	validationMessages := validateCharges(ufa)
+	if raisedTotal, err := ufa.effectiveRaisedTotal(); err != nil {
+		validationMessages = append(validationMessages, toChaincodeError(err))
+	} else if ufa.NetCharge.Units < raisedTotal.Units {
+		validationMessages = append(validationMessages, newChaincodeError(ERR_NET_CHARGE_BELOW_RAISED, "netCharge",
+			"Net charge "+ufa.NetCharge.String()+" is below the "+raisedTotal.String()+" already raised"))
+	}
+	return validationFailure("Amendment of UFA "+ufa.UFANumber+" is not valid", validationMessages)
+}
+
+//Checks if the caller approves for the side opposite the proposer of an amendment
+func (r UFARoles) isCounterpartyApprover(proposerSide string) bool {
+	if proposerSide == SIDE_SELLER {
+		return r.BuyerApprover
+	}
+	return r.SellerApprover
+}
+
+//Proposes a change of the charges of an agreed UFA. Arguments are the UFA
+//number and the amended terms, only one amendment can be open at a time.
+func proposeAmendment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("proposeAmendment called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber := args[0]
+	payload := lastArg(args)
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(amendableStatuses, ufa.Status) {
+		return nil, newChaincodeError(ERR_AMENDMENT_NOT_ALLOWED, "", "UFA "+ufanumber+" can not be amended in status "+ufa.Status)
+	}
+	if ufa.PendingAmendment != 0 {
+		return nil, newChaincodeError(ERR_AMENDMENT_PENDING, "", "Amendment "+strconv.Itoa(ufa.PendingAmendment)+" of UFA "+ufanumber+" is still open")
+	}
+	var request amendmentRequest
+	err = decodeStrict([]byte(payload), &request)
+	if err != nil {
+		return nil, newChaincodeError(ERR_INVALID_PAYLOAD, "", "Invalid amendment payload: "+err.Error())
+	}
+	if request.NetCharge == nil && request.ChargTolrence == nil {
+		return nil, newChaincodeError(ERR_INVALID_PAYLOAD, "", "An amendment changes the net charge or the tolerance")
+	}
+	if request.NetCharge != nil {
+		netCharge, err := request.NetCharge.withCurrency(ufa.Currency)
+		if err != nil {
+			return nil, newChaincodeError(ERR_CURRENCY_MISMATCH, "netCharge", "Invalid net charge: "+err.Error())
+		}
+		request.NetCharge = &netCharge
+	}
+	existing, err := getAmendmentRecords(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	proposedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	amendment := Amendment{
+		UFANumber:     ufanumber,
+		Sequence:      len(existing) + 1,
+		NetCharge:     request.NetCharge,
+		ChargTolrence: request.ChargTolrence,
+		Reason:        request.Reason,
+		Status:        AMENDMENT_PROPOSED,
+		ProposedBy:    caller.Email,
+		ProposerSide:  caller.rolesOn(ufa).side(),
+		ProposedAt:    proposedAt,
+	}
+	//Fail early, the terms are checked again on acceptance
+	err = validateAmendedUFA(amendment.applyTo(ufa))
+	if err != nil {
+		return nil, err
+	}
+	err = putAmendment(stub, &amendment)
+	if err != nil {
+		return nil, err
+	}
+	before := ufa.clone()
+	ufa.PendingAmendment = amendment.Sequence
+	err = putUFA(stub, ufa)
+	if err != nil {
+		return nil, err
+	}
+	err = recordUFAHistory(stub, caller, before, ufa)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Amendment " + strconv.Itoa(amendment.Sequence) + " proposed on " + ufanumber)
+	event := newUFAEvent(ufa, caller)
+	event.Amendment = amendment.Sequence
+	err = emitEvent(stub, EVENT_AMENDMENT_PROPOSED, event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(amendment)
+}
+
+//Reads the open amendment of an UFA for an approver of the counterparty
+func getPendingAmendment(stub shim.ChaincodeStubInterface, caller *Caller, function string, ufanumber string) (*UFA, *Amendment, error) {
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ufa == nil {
+		return nil, nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ufa.PendingAmendment == 0 {
+		return nil, nil, newChaincodeError(ERR_NO_PENDING_AMENDMENT, "", "UFA "+ufanumber+" has no open amendment")
+	}
+	amendment, err := getAmendment(stub, ufanumber, ufa.PendingAmendment)
+	if err != nil {
+		return nil, nil, err
+	}
+	if amendment == nil {
+		return nil, nil, errors.New("Amendment " + strconv.Itoa(ufa.PendingAmendment) + " of UFA " + ufanumber + " is missing")
+	}
+	if !caller.rolesOn(ufa).isCounterpartyApprover(amendment.ProposerSide) {
+		return nil, nil, newChaincodeError(ERR_NOT_AUTHORIZED, "", "User "+caller.Email+" is not allowed to "+function+" "+strconv.Itoa(amendment.Sequence)+" of UFA "+ufanumber+
+			", it needs an approver of the side which did not propose it")
+	}
+	return ufa, amendment, nil
+}
+
+//Closes the open amendment of an UFA, recording the decision on both
+func decideAmendment(stub shim.ChaincodeStubInterface, caller *Caller, ufa *UFA, before *UFA, amendment *Amendment, status string, reason string) error {
+	decidedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	amendment.Status = status
+	amendment.DecidedBy = caller.Email
+	amendment.DecidedAt = decidedAt
+	amendment.DecisionReason = reason
+	err = putAmendment(stub, amendment)
+	if err != nil {
+		return err
+	}
+	ufa.PendingAmendment = 0
+	err = putUFA(stub, ufa)
+	if err != nil {
+		return err
+	}
+	return recordUFAHistory(stub, caller, before, ufa)
+}
+
+//Applies the open amendment of an UFA once an approver of the counterparty
+//accepts it. The amended terms are validated against the invoices raised so far.
+func acceptAmendment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("acceptAmendment called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufa, amendment, err := getPendingAmendment(stub, caller, "acceptAmendment", args[0])
+	if err != nil {
+		return nil, err
+	}
+	before := ufa.clone()
+	ufa = amendment.applyTo(ufa)
+	err = validateAmendedUFA(ufa)
+	if err != nil {
+		return nil, err
+	}
+	ufa.Version++
+	amendment.Version = ufa.Version
+	reason := "Amendment " + strconv.Itoa(amendment.Sequence) + " accepted"
+	exhausted, err := isUFAExpired(ufa)
+	if err != nil {
+		return nil, err
+	}
+	if ufa.Status == STATUS_EXHAUSTED && !exhausted {
+		err = setUFAStatus(stub, ufa, STATUS_AGREED, caller, reason)
+	} else if ufa.Status == STATUS_AGREED && exhausted {
+		err = setUFAStatus(stub, ufa, STATUS_EXHAUSTED, caller, reason)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = decideAmendment(stub, caller, ufa, before, amendment, AMENDMENT_ACCEPTED, "")
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(reason + ", UFA " + ufa.UFANumber + " is at version " + strconv.Itoa(ufa.Version))
+	event := newUFAEvent(ufa, caller)
+	event.Amendment = amendment.Sequence
+	return nil, emitEvent(stub, EVENT_AMENDMENT_ACCEPTED, event)
+}
+
+//Rejects the open amendment of an UFA. Arguments are the UFA number and a reason
+func rejectAmendment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("rejectAmendment called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if args[1] == "" {
+		return nil, errors.New("rejectAmendment requires a reason")
+	}
+	ufa, amendment, err := getPendingAmendment(stub, caller, "rejectAmendment", args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = decideAmendment(stub, caller, ufa, ufa.clone(), amendment, AMENDMENT_REJECTED, args[1])
+	if err != nil {
+		return nil, err
+	}
+	event := newUFAEvent(ufa, caller)
+	event.Amendment = amendment.Sequence
+	return nil, emitEvent(stub, EVENT_AMENDMENT_REJECTED, event)
+}
+
+//Returns the amendments of an UFA, oldest first
+func getAmendments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("getAmendments called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber := lastArg(args)
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	amendments, err := getAmendmentRecords(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(amendments)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//Reads the amendments of an UFA through the getAmendments query
+func readAmendments(t *testing.T, stub *ledgerStub, ufanumber string) []Amendment {
+	t.Helper()
+	var amendments []Amendment
+	if err := json.Unmarshal(stub.mustInvoke("getAmendments", ufanumber), &amendments); err != nil {
+		t.Fatalf("Unable to parse the amendments of %s: %v", ufanumber, err)
+	}
+	return amendments
+}
+
+func TestAmendmentAccepted(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 1100)))
+	if ufa := readUFA(t, stub, "UFA1"); ufa.Status != STATUS_EXHAUSTED {
+		t.Fatalf("Expected UFA1 to be exhausted, got %s", ufa.Status)
+	}
+
+	stub.mustInvoke("proposeAmendment", "UFA1", `{"netCharge":"1500","chargTolrence":"5","reason":"Extended scope"}`)
+	if err := responseError(t, stub.invoke("proposeAmendment", "UFA1", `{"chargTolrence":"2"}`)); err.Code != ERR_AMENDMENT_PENDING {
+		t.Fatalf("Expected a second amendment to wait for the first, got %+v", err)
+	}
+	//The proposing side can not sign off its own amendment
+	if err := responseError(t, stub.invoke("acceptAmendment", "UFA1")); err.Code != ERR_NOT_AUTHORIZED {
+		t.Fatalf("Expected the seller to be refused, got %+v", err)
+	}
+	if ufa := readUFA(t, stub, "UFA1"); ufa.NetCharge != whole(1000) || ufa.PendingAmendment != 1 {
+		t.Fatalf("Expected the terms to wait for the buyer, got %v pending %d", ufa.NetCharge, ufa.PendingAmendment)
+	}
+
+	stub.setCaller(buyer)
+	stub.mustInvoke("acceptAmendment", "UFA1")
+	if stub.lastEvent == nil || stub.lastEvent.EventName != EVENT_AMENDMENT_ACCEPTED {
+		t.Fatalf("Expected an %s event, got %+v", EVENT_AMENDMENT_ACCEPTED, stub.lastEvent)
+	}
+	ufa := readUFA(t, stub, "UFA1")
+	if ufa.NetCharge != whole(1500) || ufa.ChargTolrence != 5*100 || ufa.Version != 1 || ufa.PendingAmendment != 0 {
+		t.Fatalf("Expected the amended terms at version 1, got %+v", ufa)
+	}
+	if ufa.Status != STATUS_AGREED {
+		t.Fatalf("Expected the raised charge to reopen UFA1, got %s", ufa.Status)
+	}
+	amendments := readAmendments(t, stub, "UFA1")
+	if len(amendments) != 1 || amendments[0].Status != AMENDMENT_ACCEPTED || amendments[0].ProposerSide != SIDE_SELLER ||
+		amendments[0].DecidedBy != buyerEmail || amendments[0].Version != 1 {
+		t.Fatalf("Expected the accepted amendment to be kept, got %+v", amendments)
+	}
+	entries := readHistory(t, stub, "UFA1")
+	if change := findChange(entries[len(entries)-1], "netCharge.amount"); change == nil || change.New != "1500.00" {
+		t.Fatalf("Expected the acceptance to be audited, got %+v", entries[len(entries)-1])
+	}
+}
+
+func TestAmendmentRevalidated(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 600)))
+
+	for payload, code := range map[string]string{
+		`{"netCharge":"500"}`:                             ERR_NET_CHARGE_BELOW_RAISED,
+		`{"chargTolrence":"11"}`:                          ERR_TOLERANCE_OUT_OF_RANGE,
+		`{"netCharge":"0"}`:                               ERR_INVALID_NET_CHARGE,
+		`{"reason":"Nothing"}`:                            ERR_INVALID_PAYLOAD,
+		`{"netCharg":"700"}`:                              ERR_INVALID_PAYLOAD,
+		`{"netCharge":{"amount":"700","currency":"EUR"}}`: ERR_CURRENCY_MISMATCH,
+	} {
+		err := responseError(t, stub.invoke("proposeAmendment", "UFA1", payload))
+		if err.Code != code && !hasDetail(err, code, "") {
+			t.Fatalf("Expected %s to fail with %s, got %+v", payload, code, err)
+		}
+	}
+
+	//Invoices raised while the amendment is open are checked on acceptance
+	stub.setCaller(buyer)
+	stub.mustInvoke("proposeAmendment", "UFA1", `{"netCharge":"700"}`)
+	stub.setCaller(seller)
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-11", 300)))
+	if err := responseError(t, stub.invoke("acceptAmendment", "UFA1")); !hasDetail(err, ERR_NET_CHARGE_BELOW_RAISED, "") {
+		t.Fatalf("Expected the acceptance to be revalidated, got %+v", err)
+	}
+	stub.mustInvoke("rejectAmendment", "UFA1", "Already invoiced beyond it")
+	ufa := readUFA(t, stub, "UFA1")
+	if ufa.NetCharge != whole(1000) || ufa.Version != 0 || ufa.PendingAmendment != 0 {
+		t.Fatalf("Expected the rejection to leave the terms, got %+v", ufa)
+	}
+	amendments := readAmendments(t, stub, "UFA1")
+	if len(amendments) != 1 || amendments[0].Status != AMENDMENT_REJECTED || amendments[0].DecisionReason != "Already invoiced beyond it" {
+		t.Fatalf("Expected the rejection to be kept, got %+v", amendments)
+	}
+	if err := responseError(t, stub.invoke("rejectAmendment", "UFA1", "Again")); err.Code != ERR_NO_PENDING_AMENDMENT {
+		t.Fatalf("Expected no open amendment, got %+v", err)
+	}
+	stub.setCaller(outsider)
+	if err := responseError(t, stub.invoke("getAmendments", "UFA1")); err.Code != ERR_NOT_A_PARTY {
+		t.Fatalf("Expected an outsider to be refused the amendments, got %+v", err)
+	}
+}
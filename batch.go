@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//DEFAULT_BATCHES_PER_PERIOD Invoice batches allowed per billing period when the UFA sets no limit
+const DEFAULT_BATCHES_PER_PERIOD = 1
+
+//periodBatches Invoice batches raised for a billing period of an UFA
+type periodBatches struct {
+	//Batches with at least one invoice which is not rejected or cancelled
+	standing int
+	//Highest batch number raised, withdrawn batches included
+	last int
+	//Whether an invoice of a batch which is not supplementary stands
+	originalStanding bool
+}
+
+//Returns the number of invoice batches the UFA allows per billing period,
+//the original batch included
+func (u *UFA) batchesPerPeriod() int {
+	if u.BatchesPerPeriod == 0 {
+		return DEFAULT_BATCHES_PER_PERIOD
+	}
+	return u.BatchesPerPeriod
+}
+
+//Returns the batch an invoice was raised in, invoices raised before batches
+//were numbered belong to the original batch
+func (i *Invoice) batch() int {
+	if i.Batch == 0 {
+		return 1
+	}
+	return i.Batch
+}
+
+//Checks if an invoice is the buyer copy of a seller invoice
+func (i *Invoice) isBuyerCopy() bool {
+	return i.Side == SIDE_BUYER
+}
+
+//Reads the batches raised for a billing period of an UFA. Credit notes are
+//not batches and buyer copies stand or fall with the seller invoice.
+func getPeriodBatches(stub shim.ChaincodeStubInterface, ufanumber string, period string) (periodBatches, error) {
+	var batches periodBatches
+	invoices, err := getInvoiceRecords(stub, ufanumber, period)
+	if err != nil {
+		return batches, err
+	}
+	standing := make(map[int]bool)
+	for i := range invoices {
+		invoice := &invoices[i]
+		if invoice.isCreditNote() || invoice.isBuyerCopy() {
+			continue
+		}
+		if invoice.batch() > batches.last {
+			batches.last = invoice.batch()
+		}
+		if !isWithdrawnInvoice(invoice.Status) {
+			standing[invoice.batch()] = true
+			batches.originalStanding = batches.originalStanding || !invoice.Supplementary
+		}
+	}
+	batches.standing = len(standing)
+	return batches, nil
+}
+
+//Checks a batch is the original batch of its billing period or a
+//supplementary batch on top of a standing original, within the limit of the UFA
+func validateBatchPlacement(stub shim.ChaincodeStubInterface, ufa *UFA, invoices []Invoice) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	period := invoices[0].BillingPeriod
+	supplementary := invoices[0].Supplementary
+	for _, invoice := range invoices {
+		if invoice.Supplementary != supplementary {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_BATCH_MISMATCH, "supplementary", "Invoice "+invoice.InvoiceNumber+" is not flagged supplementary like the rest of the batch"))
+		}
+	}
+	_, invoiced := ufa.InvoicePeriods[period]
+	if invoiced && !supplementary {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_PERIOD_ALREADY_INVOICED, "billingPeriod", "Invoice already raised for the month, further invoices must be supplementary"))
+	}
+	if !supplementary {
+		return errorMessages
+	}
+	batches, err := getPeriodBatches(stub, ufa.UFANumber, period)
+	if err != nil {
+		return append(errorMessages, toChaincodeError(err))
+	}
+	if !invoiced || !batches.originalStanding {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_NO_ORIGINAL_BATCH, "supplementary", "Supplementary invoices need a standing original batch for "+period))
+	} else if batches.standing >= ufa.batchesPerPeriod() {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_BATCH_LIMIT_REACHED, "supplementary",
+			"UFA "+ufa.UFANumber+" allows "+strconv.Itoa(ufa.batchesPerPeriod())+" invoice batches per billing period"))
+	}
+	return errorMessages
+}
+
+//Checks a batch holds one seller invoice and at most its buyer copy, and
+//that the copies agree on every charge
+func validateBatchPairing(invoices []Invoice) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	var sellerInvoice, buyerCopy *Invoice
+	for i := range invoices {
+		invoice := &invoices[i]
+		switch {
+		case invoice.Side == SIDE_SELLER && sellerInvoice == nil:
+			sellerInvoice = invoice
+		case invoice.Side == SIDE_BUYER && buyerCopy == nil:
+			buyerCopy = invoice
+		case invoice.Side != SIDE_SELLER && invoice.Side != SIDE_BUYER:
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_SIDE, "side", "Invoice "+invoice.InvoiceNumber+" must be the "+SIDE_SELLER+" or the "+SIDE_BUYER+" copy"))
+		default:
+			errorMessages = append(errorMessages, newChaincodeError(ERR_BATCH_PAIRING, "side", "A batch holds one seller invoice and at most its buyer copy, "+invoice.InvoiceNumber+" is a second "+invoice.Side+" copy"))
+		}
+	}
+	if sellerInvoice == nil {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_BATCH_PAIRING, "side", "A batch needs a seller invoice"))
+	}
+	if sellerInvoice != nil && buyerCopy != nil {
+		errorMessages = append(errorMessages, compareCopies(sellerInvoice, buyerCopy)...)
+	}
+	return errorMessages
+}
+
+//Reports every charge on which the buyer copy differs from the seller invoice
+func compareCopies(sellerInvoice *Invoice, buyerCopy *Invoice) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	diverges := func(field string, sellerValue string, buyerValue string) {
+		if sellerValue != buyerValue {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_COPIES_DIVERGE, field,
+				"Buyer copy "+buyerCopy.InvoiceNumber+" differs from seller invoice "+sellerInvoice.InvoiceNumber+" in "+field+": "+buyerValue+" instead of "+sellerValue))
+		}
+	}
+	diverges("invoiceAmt", sellerInvoice.InvoiceAmt.String(), buyerCopy.InvoiceAmt.String())
+	diverges("lines", strconv.Itoa(len(sellerInvoice.Lines))+" lines", strconv.Itoa(len(buyerCopy.Lines))+" lines")
+	for i := 0; i < len(sellerInvoice.Lines) && i < len(buyerCopy.Lines); i++ {
+		sellerLine, buyerLine := sellerInvoice.Lines[i], buyerCopy.Lines[i]
+		diverges(lineField(i, "description"), sellerLine.Description, buyerLine.Description)
+		diverges(lineField(i, "quantity"), sellerLine.Quantity.String(), buyerLine.Quantity.String())
+		diverges(lineField(i, "unitPrice"), sellerLine.UnitPrice.String(), buyerLine.UnitPrice.String())
+		diverges(lineField(i, "taxCode"), sellerLine.TaxCode, buyerLine.TaxCode)
+		diverges(lineField(i, "taxAmt"), sellerLine.TaxAmt.String(), buyerLine.TaxAmt.String())
+	}
+	return errorMessages
+}
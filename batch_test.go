@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+//Returns a single supplementary invoice for a billing period
+func supplementaryInvoice(number string, period string, amount int64) []Invoice {
+	return []Invoice{{InvoiceNumber: number, UFANumber: "UFA1", BillingPeriod: period, InvoiceAmt: whole(amount), Side: SIDE_SELLER, Supplementary: true}}
+}
+
+func TestSupplementaryInvoices(t *testing.T) {
+	stub := newLedgerStub(t)
+	ufa := newTestUFA("UFA1")
+	ufa.BatchesPerPeriod = 2
+	mustCreateUFA(t, stub, ufa)
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+
+	stub.mustInvoke("createInvoices", toJSON(t, supplementaryInvoice("S2-2017-10", "2017-10", 50)))
+	if invoice := readInvoice(t, stub, "UFA1", "S2-2017-10"); invoice.Batch != 2 || !invoice.Supplementary {
+		t.Fatalf("Expected the late charge in batch 2, got %+v", invoice)
+	}
+	if original := readInvoice(t, stub, "UFA1", "S-2017-10"); original.Batch != 1 {
+		t.Fatalf("Expected the original invoices in batch 1, got %+v", original)
+	}
+	if ufa := readUFA(t, stub, "UFA1"); ufa.InvoicePeriods["2017-10"] != "S-2017-10,B-2017-10,S2-2017-10," || ufa.RaisedInvTotal != whole(250) {
+		t.Fatalf("Expected the supplementary invoice to add to the period, got %v %+v", ufa.RaisedInvTotal, ufa.InvoicePeriods)
+	}
+
+	mixed := append(supplementaryInvoice("S3-2017-10", "2017-10", 10), supplementaryInvoice("B3-2017-10", "2017-10", 10)...)
+	mixed[1].Supplementary = false
+	tests := []struct {
+		name     string
+		invoices []Invoice
+		code     string
+	}{
+		{"over the batch limit", supplementaryInvoice("S3-2017-10", "2017-10", 10), ERR_BATCH_LIMIT_REACHED},
+		{"period not invoiced", supplementaryInvoice("S-2017-11", "2017-11", 10), ERR_NO_ORIGINAL_BATCH},
+		{"mixed flags", mixed, ERR_BATCH_MISMATCH},
+		{"unflagged second batch", invoicePair("UFA1", "2017-10", 10)[:1], ERR_PERIOD_ALREADY_INVOICED},
+	}
+	for _, test := range tests {
+		err := responseError(t, stub.invoke("createInvoices", toJSON(t, test.invoices)))
+		if !hasDetail(err, test.code, "") {
+			t.Fatalf("%s: expected %s, got %+v", test.name, test.code, err)
+		}
+	}
+
+	//A withdrawn supplementary batch frees its place
+	stub.mustInvoke("cancelInvoice", "S2-2017-10")
+	stub.mustInvoke("createInvoices", toJSON(t, supplementaryInvoice("S3-2017-10", "2017-10", 10)))
+	if invoice := readInvoice(t, stub, "UFA1", "S3-2017-10"); invoice.Batch != 3 {
+		t.Fatalf("Expected the new batch to be numbered 3, got %+v", invoice)
+	}
+}
+
+func TestSingleBatchByDefault(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)[:1]))
+	err := responseError(t, stub.invoke("createInvoices", toJSON(t, supplementaryInvoice("S2-2017-10", "2017-10", 50))))
+	if !hasDetail(err, ERR_BATCH_LIMIT_REACHED, "allows 1 invoice batches") {
+		t.Fatalf("Expected a single batch per period, got %+v", err)
+	}
+}
+
+func TestBatchPairing(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+
+	diverging := invoicePair("UFA1", "2017-10", 200)
+	diverging[1].InvoiceAmt = whole(190)
+	twoSellers := invoicePair("UFA1", "2017-10", 200)
+	twoSellers[1].Side = SIDE_SELLER
+	noSide := invoicePair("UFA1", "2017-10", 200)
+	noSide[0].Side = ""
+	tests := []struct {
+		name     string
+		invoices []Invoice
+		code     string
+		message  string
+	}{
+		{"diverging copies", diverging, ERR_COPIES_DIVERGE, "Buyer copy B-2017-10 differs from seller invoice S-2017-10 in invoiceAmt: 190.00 USD instead of 200.00 USD"},
+		{"two seller invoices", twoSellers, ERR_BATCH_PAIRING, "B-2017-10 is a second seller copy"},
+		{"missing side", noSide, ERR_INVALID_SIDE, "Invoice S-2017-10 must be the seller or the buyer copy"},
+		{"buyer copy alone", invoicePair("UFA1", "2017-10", 200)[1:], ERR_BATCH_PAIRING, "A batch needs a seller invoice"},
+	}
+	for _, test := range tests {
+		err := responseError(t, stub.invoke("createInvoices", toJSON(t, test.invoices)))
+		if !hasDetail(err, test.code, test.message) {
+			t.Fatalf("%s: expected %s %q, got %+v", test.name, test.code, test.message, err)
+		}
+	}
+
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+	sellerInvoice, buyerCopy := readInvoice(t, stub, "UFA1", "S-2017-10"), readInvoice(t, stub, "UFA1", "B-2017-10")
+	if sellerInvoice.PairedWith != "B-2017-10" || buyerCopy.PairedWith != "S-2017-10" {
+		t.Fatalf("Expected the copies to be linked, got %q and %q", sellerInvoice.PairedWith, buyerCopy.PairedWith)
+	}
+	if sellerInvoice.BookedAmt != whole(200) || buyerCopy.BookedAmt != whole(0) {
+		t.Fatalf("Expected the seller invoice to carry the charge, got %v and %v", sellerInvoice.BookedAmt, buyerCopy.BookedAmt)
+	}
+	if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != whole(200) {
+		t.Fatalf("Expected the batch to consume its real amount, got %v", ufa.RaisedInvTotal)
+	}
+}
@@ -1,4 +1,4 @@
-//UFA TOOL V2 HLF V0.6
+//UFA TOOL V2 HLF 1.x/2.x
 package main
 
 import (
@@ -6,80 +6,63 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
-	"strings"
-	"time"
 
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"github.com/hyperledger/fabric/core/crypto/primitives"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 )
 
-var logger = shim.NewLogger("UFAChainCode")
-
-//ALL_ELEMENENTS Key to refer the master list of UFA
-const ALL_ELEMENENTS = "ALL_RECS"
-
-//ALL_INVOICES key to refer the invoice master data
-const ALL_INVOICES = "ALL_INVOICES"
-
-//UFA_TRXN_PREFIX Key prefix for UFA transaction history
-const UFA_TRXN_PREFIX = "UFA_TRXN_HISTORY_"
+var logger = newChaincodeLogger("UFAChainCode")
 
 //UFA_INVOICE_PREFIX Key prefix for identifying Invoices assciated with a ufa
 const UFA_INVOICE_PREFIX = "UFA_INVOICE_PREFIX_"
 
+//CHAIN_CODE_VERSION Ledger key of the deployment recorded by Init
 const CHAIN_CODE_VERSION = "CHAIN_CODE_VERSION"
 
+//MAX_CHARGE_TOLERANCE Largest tolerance an UFA may allow over its net charge, 10%
+const MAX_CHARGE_TOLERANCE Percentage = 10 * 100
+
 //UFAChainCode Chaincode default interface
 type UFAChainCode struct {
 }
 
-//Update invoices
+//Update invoices. Retired as no field of a raised invoice is patchable: the
+//amount and the fields keying the record are booked, the status moves through
+//the invoice lifecycle functions and amounts are corrected with credit notes.
 func updateInvoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var inputData []map[string]interface{}
-	var existingRecMap map[string]interface{}
-
 	logger.Info("updateInvoices called ")
-
-	//TODO: Update the validation here
-	//who := args[0]
-	payload := args[1]
-	logger.Info("updateInvoices payload passed " + payload)
-
-	//who :=args[2]
-	json.Unmarshal([]byte(payload), &inputData)
-	for _, invoiceDataFields := range inputData {
-		debugBytes, _ := json.Marshal(invoiceDataFields)
-		logger.Info("updateInvoices payload passed " + string(debugBytes))
-		invoiceNumber := getSafeString(invoiceDataFields["invoiceNumber"])
-		logger.Info("updateInvoices going to get details of invoice " + invoiceNumber)
-
-		recBytes, _ := stub.GetState(invoiceNumber)
-		json.Unmarshal(recBytes, &existingRecMap)
-		updatedReord, _ := updateFields(existingRecMap, invoiceDataFields)
-		updatedRecJSON, _ := json.Marshal(updatedReord)
-		stub.PutState(invoiceNumber, updatedRecJSON)
-	}
-
-	return nil, nil
+	return nil, newChaincodeError(ERR_FUNCTION_RETIRED, "", "updateInvoices is retired, invoices change through the invoice lifecycle functions and credit notes")
 }
+
 func getAllInvoicesForUsr(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("getAllInvoicesForUsr called")
-	who := args[0]
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	who := caller.Email
 
-	recordsList, err := getAllInvloiceFromMasterList(stub)
+	recordsList, err := getInvoiceRecords(stub)
 	if err != nil {
-		return nil, errors.New("Unable to get all the inventory records ")
+		return nil, errors.New("Unable to get all the inventory records: " + err.Error())
 	}
-	var outputRecords []map[string]interface{}
-	outputRecords = make([]map[string]interface{}, 0)
-	for _, invoiceNumber := range recordsList {
-		logger.Info("getAllInvoicesForUsr: Processing inventory record " + invoiceNumber)
-		recBytes, _ := stub.GetState(invoiceNumber)
-		var record map[string]interface{}
-		json.Unmarshal(recBytes, &record)
-		if record["approvedBy"] == who || record["raisedBy"] == who {
-			outputRecords = append(outputRecords, record)
+	var outputRecords []Invoice
+	outputRecords = make([]Invoice, 0)
+	//Emails are only unique within an organisation, the caller must also be on the UFA
+	onAgreement := make(map[string]bool)
+	for _, invoice := range recordsList {
+		logger.Info("getAllInvoicesForUsr: Processing inventory record " + invoice.InvoiceNumber)
+		allowed, checked := onAgreement[invoice.UFANumber]
+		if !checked {
+			ufa, err := getUFA(stub, invoice.UFANumber)
+			if err != nil {
+				return nil, err
+			}
+			allowed = ufa != nil && caller.rolesOn(ufa).onAgreement()
+			onAgreement[invoice.UFANumber] = allowed
+		}
+		if allowed && (invoice.ApprovedBy == who || invoice.RaisedBy == who || invoice.StatusChangedBy == who) {
+			outputRecords = append(outputRecords, invoice)
 		}
 	}
 	outputBytes, _ := json.Marshal(outputRecords)
@@ -90,21 +73,32 @@ func getAllInvoicesForUsr(stub shim.ChaincodeStubInterface, args []string) ([]by
 //Returns all the Invoice created so far for the interest parties
 func getAllNonExpiredUFA(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("getAllNonExiredUFA called")
-	who := args[0]
-
-	recordsList, err := getAllRecordsList(stub)
+	caller, err := getCaller(stub)
 	if err != nil {
-		return nil, errors.New("Unable to get all the UFA records records ")
+		return nil, err
 	}
-	var outputRecords []map[string]interface{}
-	outputRecords = make([]map[string]interface{}, 0)
-	for _, ufanumber := range recordsList {
-		logger.Info("getAllNonExpiredUFA: Processing UFA for " + ufanumber)
-		recBytes, _ := stub.GetState(ufanumber)
-		var ufaRecord map[string]interface{}
-		json.Unmarshal(recBytes, &ufaRecord)
 
-		if (ufaRecord["sellerApprover"].(map[string]interface{})["emailid"] == who || ufaRecord["buyerApprover"].(map[string]interface{})["emailid"] == who) && ufaRecord["status"].(string) == "Agreed" && !isUFAExpired(ufaRecord) {
+	//Validity is judged on the day of the transaction so every endorser agrees
+	today, err := getTxDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	recordsList, err := getAllUFARecords(stub)
+	if err != nil {
+		return nil, errors.New("Unable to get all the UFA records records: " + err.Error())
+	}
+	var outputRecords []UFA
+	outputRecords = make([]UFA, 0)
+	for _, ufaRecord := range recordsList {
+		logger.Info("getAllNonExpiredUFA: Processing UFA for " + ufaRecord.UFANumber)
+		if !caller.rolesOn(&ufaRecord).onAgreement() || ufaRecord.Status != STATUS_AGREED || ufaRecord.validityEnded(today) {
+			continue
+		}
+		expired, err := isUFAExpired(&ufaRecord)
+		if err != nil {
+			return nil, err
+		}
+		if !expired {
 			outputRecords = append(outputRecords, ufaRecord)
 		}
 	}
@@ -114,206 +108,270 @@ func getAllNonExpiredUFA(stub shim.ChaincodeStubInterface, args []string) ([]byt
 }
 
 //Checks if UFA amounts are exhausted or not
-func isUFAExpired(ufaDetails map[string]interface{}) bool {
-	if ufaDetails != nil {
-		raisedTotal := getSafeNumber(ufaDetails["raisedInvTotal"])
-		totalCharge := getSafeNumber(ufaDetails["netCharge"])
-		tolerance := getSafeNumber(ufaDetails["chargTolrence"])
-		maxCharge := totalCharge + (totalCharge * tolerance / 100)
-		return !(raisedTotal < maxCharge)
-	}
-	return true
-}
-
-//Retrieve all the invoice list
-func getAllInvloiceFromMasterList(stub shim.ChaincodeStubInterface) ([]string, error) {
-	var recordList []string
-	recBytes, _ := stub.GetState(ALL_INVOICES)
-
-	err := json.Unmarshal(recBytes, &recordList)
+func isUFAExpired(ufaDetails *UFA) (bool, error) {
+	if ufaDetails == nil {
+		return true, nil
+	}
+	raisedTotal, err := ufaDetails.effectiveRaisedTotal()
 	if err != nil {
-		return nil, errors.New("Failed to unmarshal getAllInvloiceFromMasterList ")
+		return false, err
 	}
-
-	return recordList, nil
+	return !(raisedTotal.Units < ufaDetails.maxCharge().Units), nil
 }
 
 //Create new invoices and update UFA details
 func createInvoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	//Validate the invoice entry
-	var invoices []map[string]interface{}
-	var ufaDetails map[string]interface{}
 	var invoiceNumberList bytes.Buffer
-	var invoiceNumbers []string
 	logger.Info("Inside createInvoices")
 
-	errorMessages := validateInvoiceDetails(stub, args)
-	if errorMessages == "" {
-		payload := args[1]
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	payload := lastArg(args)
+	err = validateInvoiceDetails(stub, caller, payload)
+	if err == nil {
 		logger.Info("Inside createInvoices: Payload received " + payload)
-		json.Unmarshal([]byte(payload), &invoices)
 		//Since this is validated so no more validation
-		firstInvoice := invoices[0]
-		ufanumber := getSafeString(firstInvoice["ufanumber"])
-		ufaBytes, _ := stub.GetState(ufanumber)
-		json.Unmarshal(ufaBytes, &ufaDetails)
-		//Collect period
-		billingPeriod := getSafeString(firstInvoice["billingPeriod"])
-		totalAmt := 0.0
-		invoiceNumbers = make([]string, len(invoices))
-		//Collect invoice numbers and sum of values
+		invoices, _ := parseInvoices([]byte(payload))
+		ufanumber := invoices[0].UFANumber
+		ufaDetails, err := getUFA(stub, ufanumber)
+		if err != nil {
+			return nil, err
+		}
+		before := ufaDetails.clone()
+		//Collect period, spelt the one way of the billing frequency
+		normalizeInvoicePeriods(ufaDetails, invoices)
+		billingPeriod := invoices[0].BillingPeriod
+		taxDate, err := getTxDate(stub)
+		if err != nil {
+			return nil, err
+		}
+		for i := range invoices {
+			priceInvoiceLines(stub, &invoices[i], ufaDetails.Currency, taxDate)
+			convertInvoice(stub, ufaDetails, &invoices[i])
+		}
+		totalAmt, err := bookInvoices(invoices)
+		if err != nil {
+			return nil, err
+		}
+		batches, err := getPeriodBatches(stub, ufanumber, billingPeriod)
+		if err != nil {
+			return nil, err
+		}
+		//Link the copies of the batch to each other
+		var sellerNumber, buyerNumber string
 		for _, invoice := range invoices {
-			totalAmt = totalAmt + getSafeNumber(invoice["invoiceAmt"])
-			invNumber := getSafeString(invoice["invoiceNumber"])
+			if invoice.isBuyerCopy() {
+				buyerNumber = invoice.InvoiceNumber
+			} else {
+				sellerNumber = invoice.InvoiceNumber
+			}
+		}
+		//Collect invoice numbers and sum of values
+		for i := range invoices {
+			invoice := &invoices[i]
+			invoice.RaisedBy = caller.Email
+			invoice.Status = INVOICE_RAISED
+			invoice.Batch = batches.last + 1
+			invoice.PairedWith = buyerNumber
+			if invoice.isBuyerCopy() {
+				invoice.PairedWith = sellerNumber
+			}
+			invNumber := invoice.InvoiceNumber
 			invoiceNumberList.WriteString(invNumber)
 			invoiceNumberList.WriteString(",")
-			invoiceNumbers = append(invoiceNumbers, invNumber)
 			//Perist the invoices while collecting the details
-			invoiceJSON, _ := json.Marshal(invoice)
-			logger.Info("Persisting invoice :" + string(invoiceJSON))
-			stub.PutState(invNumber, invoiceJSON)
+			logger.Info("Persisting invoice :" + invNumber)
+			err = putInvoice(stub, invoice)
+			if err != nil {
+				return nil, err
+			}
 
 		}
 
-		attrName := "invperiod_" + billingPeriod
-		ufaDetails[attrName] = invoiceNumberList.String()
-		chargesSoFar := getSafeNumber(ufaDetails["raisedInvTotal"])
-		ufaDetails["raisedInvTotal"] = strconv.FormatFloat(chargesSoFar+totalAmt/2.0, 'f', -1, 64)
+		if ufaDetails.InvoicePeriods == nil {
+			ufaDetails.InvoicePeriods = make(map[string]string)
+		}
+		//Supplementary batches add to the invoices of the period
+		ufaDetails.InvoicePeriods[billingPeriod] = ufaDetails.InvoicePeriods[billingPeriod] + invoiceNumberList.String()
+		ufaDetails.RaisedInvTotal, err = ufaDetails.RaisedInvTotal.plus(totalAmt)
+		if err != nil {
+			return nil, err
+		}
 
-		//Update the gloval invoice list
-		updateInvoiceMasterRecords(stub, invoiceNumbers)
-		//Update the running total
-		//Update the invoice numbers list
-		existingInvoiceList := getSafeString(ufaDetails["allInvoiceList"])
-		newListOfInvoices := existingInvoiceList + invoiceNumberList.String()
-		ufaDetails["allInvoiceList"] = newListOfInvoices
+		exhausted, err := isUFAExpired(ufaDetails)
+		if err != nil {
+			return nil, err
+		}
+		if exhausted {
+			err = setUFAStatus(stub, ufaDetails, STATUS_EXHAUSTED, caller, "All charges invoiced")
+			if err != nil {
+				return nil, err
+			}
+		}
 		updatedUfaBytes, _ := json.Marshal(ufaDetails)
 		logger.Info("UFA record after invoice related updation " + string(updatedUfaBytes))
 		//Update the UFA
-		stub.PutState(ufanumber, updatedUfaBytes)
+		err = putUFA(stub, ufaDetails)
+		if err != nil {
+			return nil, err
+		}
 		//Update the trxn history of UFA
-		appendUFATransactionHistory(stub, ufanumber, string(updatedUfaBytes))
+		err = recordUFAHistory(stub, caller, before, ufaDetails)
+		if err != nil {
+			return nil, err
+		}
 		logger.Info("UFA update completed")
-		return nil, nil
+		event := newUFAEvent(ufaDetails, caller)
+		event.BillingPeriod = billingPeriod
+		event.Amount = &totalAmt
+		for _, invoice := range invoices {
+			event.Invoices = append(event.Invoices, invoice.InvoiceNumber)
+		}
+		eventName := EVENT_INVOICES_RAISED
+		if ufaDetails.Status == STATUS_EXHAUSTED {
+			eventName = EVENT_UFA_EXHAUSTED
+		}
+		return nil, emitEvent(stub, eventName, event)
 	}
-	//Validation issue
-	output := "{\"validation\":\"Failure\",\"msg\" : \"" + errorMessages + "\" }"
-	return []byte(output), nil
+	//Validation issue, fail the transaction
+	return nil, err
 
 }
 
-//Update master invoice list
-func updateInvoiceMasterRecords(stub shim.ChaincodeStubInterface, invoiceList []string) error {
-	var recordList []string
-	recBytes, _ := stub.GetState(ALL_INVOICES)
-
-	err := json.Unmarshal(recBytes, &recordList)
-	if err != nil {
-		return errors.New("Failed to unmarshal updateInvoiceMasterRecords ")
-	}
-	recordList = append(recordList, invoiceList...)
-	bytesToStore, _ := json.Marshal(recordList)
-	logger.Info("After addition" + string(bytesToStore))
-	stub.PutState(ALL_INVOICES, bytesToStore)
-	return nil
-}
-
 //Returns all the invoices raised for an UFA
-func getInvoicesForUFA(stub shim.ChaincodeStubInterface, args []string) []byte {
+func getInvoicesForUFA(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("getInvoicesForUFA called")
-	var ufadetails map[string]interface{}
-	var outputRecords []map[string]interface{}
-	outputRecords = make([]map[string]interface{}, 0)
-	ufanumber := args[1]
-	ufaBytes, _ := stub.GetState(ufanumber)
-	json.Unmarshal(ufaBytes, &ufadetails)
-	if ufadetails["allInvoiceList"] != nil {
-		recordsList := strings.Split(getSafeString(ufadetails["allInvoiceList"]), ",")
-		for _, invoiceNumber := range recordsList {
-			logger.Info("getInvoicesForUFA: Processing record " + invoiceNumber)
-			if len(invoiceNumber) > 0 {
-				recBytes, _ := stub.GetState(invoiceNumber)
-				var record map[string]interface{}
-				json.Unmarshal(recBytes, &record)
-				outputRecords = append(outputRecords, record)
-			}
-		}
-
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber := lastArg(args)
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	outputRecords, err := getInvoiceRecords(stub, ufanumber)
+	if err != nil {
+		return nil, errors.New("Unable to get the invoices of UFA " + ufanumber + ": " + err.Error())
 	}
 
 	outputJSON, _ := json.Marshal(outputRecords)
 	logger.Info("Returning records from getInvoicesForUFA ")
-	return outputJSON
+	return outputJSON, nil
 }
 
 //Validate the new Invoice created
 func validateNewInvoideData(stub shim.ChaincodeStubInterface, args []string) []byte {
-	var output string
-	msg := validateInvoiceDetails(stub, args)
-
-	if msg == "" {
-		output = "{\"validation\":\"Success\",\"msg\" : \"\" }"
-	} else {
-		output = "{\"validation\":\"Failure\",\"msg\" : \"" + msg + "\" }"
+	caller, err := getCaller(stub)
+	if err == nil {
+		err = validateInvoiceDetails(stub, caller, lastArg(args))
 	}
-	return []byte(output)
+	return toValidationResult(err)
 }
 
-//Validate the new invoice payload
-func validateInvoiceDetails(stub shim.ChaincodeStubInterface, args []string) string {
-	var output string
-	var errorMessages []string
-	var invoices []map[string]interface{}
-	var ufaDetails map[string]interface{}
-	//I am assuming the invoices would sent as an array and must be multiple
-	payload := args[1]
-	json.Unmarshal([]byte(payload), &invoices)
-	if len(invoices) < 2 {
-		errorMessages = append(errorMessages, "Invalid number of invoices")
+//Validate the new invoice payload, the error lists every rule broken
+func validateInvoiceDetails(stub shim.ChaincodeStubInterface, caller *Caller, payload string) error {
+	var errorMessages []*ChaincodeError
+	//The invoices are sent as an array, a batch may hold a single invoice
+	invoices, err := parseInvoices([]byte(payload))
+	if err != nil {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_PAYLOAD, "", "Invalid invoice payload: "+err.Error()))
+	} else if len(invoices) == 0 {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVOICE_COUNT, "", "Invalid number of invoices"))
 	} else {
 		//Now checking the ufa number
 		firstInvoice := invoices[0]
-		ufanumber := getSafeString(firstInvoice["ufanumber"])
+		ufanumber := firstInvoice.UFANumber
 		if ufanumber == "" {
-			errorMessages = append(errorMessages, "UFA number not provided")
+			errorMessages = append(errorMessages, newChaincodeError(ERR_UFA_NUMBER_MISSING, "ufanumber", "UFA number not provided"))
 		} else {
-			recBytes, err := stub.GetState(ufanumber)
-			if err != nil || recBytes == nil {
-				errorMessages = append(errorMessages, "Invalid UFA number provided")
+			ufaDetails, err := getUFA(stub, ufanumber)
+			if err != nil || ufaDetails == nil {
+				errorMessages = append(errorMessages, newChaincodeError(ERR_UFA_NOT_FOUND, "ufanumber", "Invalid UFA number provided"))
+			} else if err := authorizeOnUFA(caller, ufaDetails); err != nil {
+				errorMessages = append(errorMessages, toChaincodeError(err))
+			} else if ufaDetails.Status != STATUS_AGREED {
+				errorMessages = append(errorMessages, newChaincodeError(ERR_UFA_NOT_AGREED, "ufanumber", "Invoices can only be raised against an Agreed UFA, "+ufanumber+" is "+ufaDetails.Status))
 			} else {
-				json.Unmarshal(recBytes, &ufaDetails)
 				//Rasied invoice shoul not be exhausted
-				raisedTotal := getSafeNumber(ufaDetails["raisedInvTotal"])
-				totalCharge := getSafeNumber(ufaDetails["netCharge"])
-				tolerance := getSafeNumber(ufaDetails["chargTolrence"])
-				maxCharge := totalCharge + (totalCharge * tolerance / 100)
-				if raisedTotal == maxCharge {
-					errorMessages = append(errorMessages, "All charges exhausted. Invoices can not raised")
+				raisedTotal, totalErr := ufaDetails.effectiveRaisedTotal()
+				maxCharge := ufaDetails.maxCharge()
+				if totalErr != nil {
+					errorMessages = append(errorMessages, toChaincodeError(totalErr))
+				} else if raisedTotal.Units >= maxCharge.Units {
+					errorMessages = append(errorMessages, newChaincodeError(ERR_CHARGES_EXHAUSTED, "ufanumber", "All charges exhausted. Invoices can not raised"))
+				}
+				//Periods are judged and taxes computed on the day the invoices are raised
+				today, err := getTxDate(stub)
+				if err != nil {
+					errorMessages = append(errorMessages, toChaincodeError(err))
 				}
 				//Now check if invoice is already raised for the period or not
-				billingPerid := getSafeString(firstInvoice["billingPeriod"])
+				periodErrors := normalizeInvoicePeriods(ufaDetails, invoices)
+				errorMessages = append(errorMessages, periodErrors...)
+				billingPerid := invoices[0].BillingPeriod
 				if billingPerid == "" {
-					errorMessages = append(errorMessages, "Invalid billing period")
-				}
-				if ufaDetails["invperiod_"+billingPerid] != nil {
-					errorMessages = append(errorMessages, "Invoice already raised for the month")
+					errorMessages = append(errorMessages, newChaincodeError(ERR_BILLING_PERIOD_MISSING, "billingPeriod", "Invalid billing period"))
+				} else if len(periodErrors) == 0 {
+					errorMessages = append(errorMessages, validateBillingPeriod(ufaDetails, billingPerid, today)...)
 				}
+				errorMessages = append(errorMessages, validateBatchPlacement(stub, ufaDetails, invoices)...)
 				//Now check the sum of invoice amount
-				runningTotal := 0.0
-				var buffer bytes.Buffer
-				for _, invoice := range invoices {
-					invoiceNumber := getSafeString(invoice["invoiceNumber"])
-					amount := getSafeNumber(invoice["invoiceAmt"])
-					if amount < 0 {
-						errorMessages = append(errorMessages, "Invalid invoice amount in "+invoiceNumber)
+				batchNumbers := make(map[string]bool)
+				//Amounts not converted into the currency of the UFA are never added to its total
+				converted := true
+				for i := range invoices {
+					invoice := &invoices[i]
+					invoiceNumber := invoice.InvoiceNumber
+					errorMessages = append(errorMessages, checkNewInvoiceFields(invoice)...)
+					//The amount of an invoice with line items is computed from them
+					errorMessages = append(errorMessages, priceInvoiceLines(stub, invoice, ufaDetails.Currency, today)...)
+					amount := invoice.InvoiceAmt
+					//Invoices are keyed by UFA, period and number so these must be consistent and unique
+					if invoice.UFANumber != ufanumber || invoice.BillingPeriod != billingPerid {
+						errorMessages = append(errorMessages, newChaincodeError(ERR_BATCH_MISMATCH, "billingPeriod", "Invoice "+invoiceNumber+" is not for the UFA and billing period of the batch"))
+					}
+					if existing, _ := getInvoice(stub, invoiceNumber); invoiceNumber == "" || batchNumbers[invoiceNumber] || existing != nil {
+						errorMessages = append(errorMessages, newChaincodeError(ERR_DUPLICATE_INVOICE_NUMBER, "invoiceNumber", "Invalid or duplicate invoice number "+invoiceNumber))
+					}
+					batchNumbers[invoiceNumber] = true
+					if invoice.RaisedBy != "" && invoice.RaisedBy != caller.Email {
+						errorMessages = append(errorMessages, newChaincodeError(ERR_RAISED_BY_MISMATCH, "raisedBy", "Invoice "+invoiceNumber+" can only be raised by "+caller.Email))
+					}
+					if invoice.Status != "" && invoice.Status != INVOICE_RAISED {
+						errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_INVOICE_STATUS, "status", "Invoice "+invoiceNumber+" can not be raised in status "+invoice.Status))
+					}
+					if err := convertInvoice(stub, ufaDetails, invoice); err != nil {
+						errorMessages = append(errorMessages, err)
+						converted = false
+					}
+					if amount.Units < 0 {
+						errorMessages = append(errorMessages, newChaincodeError(ERR_NEGATIVE_INVOICE_AMOUNT, "invoiceAmt", "Invalid invoice amount in "+invoiceNumber))
+						converted = false
 						break
 					}
-					buffer.WriteString(invoiceNumber)
-					buffer.WriteString(",")
-					runningTotal = runningTotal + amount
 				}
-				if (raisedTotal + runningTotal/2) >= maxCharge {
-					errorMessages = append(errorMessages, "Invoice value is exceeding total allowed charge")
+				errorMessages = append(errorMessages, validateBatchPairing(invoices)...)
+				if converted && totalErr == nil {
+					booked, err := bookInvoices(invoices)
+					if err == nil {
+						booked, err = raisedTotal.plus(booked)
+					}
+					if err != nil {
+						errorMessages = append(errorMessages, toChaincodeError(err))
+					} else if booked.Units > maxCharge.Units {
+						errorMessages = append(errorMessages, newChaincodeError(ERR_CHARGE_EXCEEDED, "invoiceAmt", "Invoice value is exceeding total allowed charge"))
+					}
 				}
 
 			}
@@ -321,66 +379,107 @@ func validateInvoiceDetails(stub shim.ChaincodeStubInterface, args []string) str
 		}
 
 	}
-	if len(errorMessages) == 0 {
-		output = ""
-	} else {
-		outputBytes, _ := json.Marshal(errorMessages)
-		output = string(outputBytes)
-	}
-	return output
+	return validationFailure("Invoice validation failed", errorMessages)
 }
 
 // Update and existing UFA record
 func updateUFA(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var existingRecMap map[string]interface{}
 	var updatedFields map[string]interface{}
 
 	logger.Info("updateUFA called ")
 
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
 	ufanumber := args[0]
-	//TODO: Update the validation here
-	//who := args[1]
-	payload := args[2]
+	payload := lastArg(args)
 	logger.Info("updateUFA payload passed " + payload)
 
-	//who :=args[2]
-	recBytes, _ := stub.GetState(ufanumber)
-
-	json.Unmarshal(recBytes, &existingRecMap)
-	json.Unmarshal([]byte(payload), &updatedFields)
-	updatedReord, _ := updateFields(existingRecMap, updatedFields)
+	existingRec, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if existingRec == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, existingRec)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeStrict([]byte(payload), &updatedFields)
+	if err != nil {
+		return nil, errors.New("Invalid UFA update payload: " + err.Error())
+	}
+	err = checkStatusUntouched(updatedFields)
+	if err != nil {
+		return nil, err
+	}
+	err = checkUFAPatch(caller, existingRec, updatedFields)
+	if err != nil {
+		return nil, err
+	}
+	var updatedReord UFA
+	changes, err := applyPatch(existingRec, updatedFields, &updatedReord)
+	if err != nil {
+		return nil, errors.New("Invalid UFA update: " + err.Error())
+	}
+	if updatedReord.UFANumber != ufanumber {
+		return nil, errors.New("UFA number can not be changed")
+	}
+	//A patch changing nothing leaves no trace on the ledger
+	if len(changes) == 0 {
+		logger.Info("updateUFA: nothing to change on " + ufanumber)
+		return nil, nil
+	}
+	//The terms of a draft are checked again as on creation, afterwards the
+	//policy only lets contact details change
+	if existingRec.Status == STATUS_DRAFT {
+		err = validationFailure("UFA validation failed", validateUFATerms(&updatedReord))
+		if err != nil {
+			return nil, err
+		}
+	}
 	outputMapBytes, _ := json.Marshal(updatedReord)
 	logger.Info("updateUFA: Final json after update " + string(outputMapBytes))
 	//Store the records
-	stub.PutState(ufanumber, outputMapBytes)
-	appendUFATransactionHistory(stub, ufanumber, payload)
-	return nil, nil
+	err = putUFA(stub, &updatedReord)
+	if err != nil {
+		return nil, err
+	}
+	err = recordUFAChanges(stub, caller, ufanumber, changes)
+	if err != nil {
+		return nil, err
+	}
+	return nil, emitEvent(stub, EVENT_UFA_UPDATED, newUFAEvent(&updatedReord, caller))
 }
 
-//Updating the fileds in a generic way
+//Updating the fileds in a generic way. Objects are merged field by field,
+//any other value including an array replaces the existing one and an
+//explicit null deletes the field
 func updateFields(existingRecordMap map[string]interface{}, modifiedRecordMap map[string]interface{}) (map[string]interface{}, error) {
 	logger.Info("UpdateFields called ")
 	for k, v := range modifiedRecordMap {
 		logger.Info(" Parsing the key from modifiedRecordMap" + k)
-		switch v.(type) {
-		case string:
-			existingRecordMap[k] = v
-		case int:
-			existingRecordMap[k] = v
-		case []interface{}:
-			//Just replcaing the old one with the new one
-			existingRecordMap[k] = modifiedRecordMap[k]
-		case interface{}:
-			if existingRecordMap[k] == nil {
-				//The entry in the modified filed does not exist
-				existingRecordMap[k] = modifiedRecordMap[k]
-			} else {
-				record := existingRecordMap[k].(map[string]interface{})
-				modFields := modifiedRecordMap[k].(map[string]interface{})
-				existingRecordMap[k], _ = updateFields(record, modFields)
+		switch value := v.(type) {
+		case nil:
+			delete(existingRecordMap, k)
+		case string, float64, bool, []interface{}:
+			existingRecordMap[k] = value
+		case map[string]interface{}:
+			record, isObject := existingRecordMap[k].(map[string]interface{})
+			if !isObject {
+				//The entry does not exist or was not an object
+				existingRecordMap[k] = value
+				continue
+			}
+			merged, err := updateFields(record, value)
+			if err != nil {
+				return nil, err
 			}
+			existingRecordMap[k] = merged
 		default:
-			logger.Info(" Field not recognized " + k)
+			return nil, fmt.Errorf("Field %s has an unsupported value", k)
 		}
 	}
 	return existingRecordMap, nil
@@ -390,116 +489,168 @@ func updateFields(existingRecordMap map[string]interface{}, modifiedRecordMap ma
 func getUFADetails(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("getUFADetails called with UFA number: " + args[0])
 
-	var outputRecord map[string]interface{}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
 	ufanumber := args[0] //UFA ufanum
-	//who :=args[1] //Role
-	recBytes, _ := stub.GetState(ufanumber)
-	json.Unmarshal(recBytes, &outputRecord)
+	outputRecord, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if outputRecord != nil {
+		err = authorizeOnUFA(caller, outputRecord)
+		if err != nil {
+			return nil, err
+		}
+	}
 	outputBytes, _ := json.Marshal(outputRecord)
 	logger.Info("Returning records from getUFADetails " + string(outputBytes))
 	return outputBytes, nil
 }
 
 //Returns all the UFAs created so far
-func getAllUFA(stub shim.ChaincodeStubInterface, who string) ([]byte, error) {
+func getAllUFA(stub shim.ChaincodeStubInterface) ([]byte, error) {
 	logger.Info("getAllUFA called")
 
-	recordsList, err := getAllRecordsList(stub)
+	caller, err := getCaller(stub)
 	if err != nil {
-		return nil, errors.New("Unable to get all the records ")
+		return nil, err
 	}
-	var outputRecords []map[string]interface{}
-	outputRecords = make([]map[string]interface{}, 0)
-	for _, ufanumber := range recordsList {
-		logger.Info("getAllUFA: Processing record " + ufanumber)
-		recBytes, _ := stub.GetState(ufanumber)
-		var record map[string]interface{}
-		json.Unmarshal(recBytes, &record)
-		outputRecords = append(outputRecords, record)
+	recordsList, err := getAllUFARecords(stub)
+	if err != nil {
+		return nil, errors.New("Unable to get all the records: " + err.Error())
+	}
+	outputRecords := make([]UFA, 0)
+	for _, record := range recordsList {
+		if caller.rolesOn(&record).onAgreement() {
+			outputRecords = append(outputRecords, record)
+		}
 	}
 	outputBytes, _ := json.Marshal(outputRecords)
 	logger.Info("Returning records from getAllUFA " + string(outputBytes))
 	return outputBytes, nil
 }
 
-//Returns all the UFA Numbers stored
-func getAllRecordsList(stub shim.ChaincodeStubInterface) ([]string, error) {
-	var recordList []string
-	recBytes, _ := stub.GetState(ALL_ELEMENENTS)
-
-	err := json.Unmarshal(recBytes, &recordList)
-	if err != nil {
-		return nil, errors.New("Failed to unmarshal getAllRecordsList ")
-	}
-
-	return recordList, nil
-}
-
 //Validate the new UFA
-func validateNewUFAData(args []string) []byte {
-	var output string
-	msg := validateNewUFA(args[0], args[1])
-
-	if msg == "" {
-		output = "{\"validation\":\"Success\",\"msg\" : \"\" }"
-	} else {
-		output = "{\"validation\":\"Failure\",\"msg\" : \"" + msg + "\" }"
+func validateNewUFAData(stub shim.ChaincodeStubInterface, args []string) []byte {
+	caller, err := getCaller(stub)
+	if err == nil {
+		err = validateNewUFA(caller, lastArg(args))
 	}
-	return []byte(output)
+	return toValidationResult(err)
 }
 
 // Creating a new Upfront agreement
 func createUFA(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("createUFA called")
 
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
 	ufanumber := args[0]
-	who := args[1]
-	payload := args[2]
+	payload := lastArg(args)
 	//If there is no error messages then create the UFA
-	valMsg := validateNewUFA(who, payload)
-	if valMsg == "" {
-		stub.PutState(ufanumber, []byte(payload))
-
-		updateMasterRecords(stub, ufanumber)
-		appendUFATransactionHistory(stub, ufanumber, payload)
-		logger.Info("Created the UFA after successful validation : " + payload)
-	} else {
-		return nil, errors.New("Validation failure: " + valMsg)
+	err = validateNewUFA(caller, payload)
+	if err == nil {
+		ufa, _ := parseUFA([]byte(payload))
+		err = setUFAStatus(stub, &ufa, STATUS_DRAFT, caller, "")
+		if err != nil {
+			return nil, err
+		}
+		if ufa.UFANumber == "" {
+			ufa.UFANumber = ufanumber
+		} else if ufa.UFANumber != ufanumber {
+			return nil, newChaincodeError(ERR_UFA_NUMBER_MISMATCH, "ufanumber", "Validation failure: UFA number in the payload does not match "+ufanumber)
+		}
+		existing, err := getUFA(stub, ufanumber)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, newChaincodeError(ERR_UFA_EXISTS, "ufanumber", "Validation failure: UFA "+ufanumber+" already exists")
+		}
+		err = putUFA(stub, &ufa)
+		if err != nil {
+			return nil, err
+		}
+		err = recordUFAHistory(stub, caller, nil, &ufa)
+		if err != nil {
+			return nil, err
+		}
+		ufaBytes, _ := json.Marshal(ufa)
+		logger.Info("Created the UFA after successful validation : " + string(ufaBytes))
+		return nil, emitEvent(stub, EVENT_UFA_CREATED, newUFAEvent(&ufa, caller))
 	}
-	return nil, nil
+	return nil, err
 }
 
-//Validate a new UFA
-func validateNewUFA(who string, payload string) string {
+//Validate a new UFA, the error lists every rule broken
+func validateNewUFA(caller *Caller, payload string) error {
 
-	//As of now I am checking if who is of proper role
-	var validationMessage bytes.Buffer
-	var ufaDetails interface{}
+	//Only sellers and buyers can propose an agreement
+	var validationMessages []*ChaincodeError
 
 	logger.Info("validateNewUFA")
-	if who == "SELLER" || who == "BUYER" {
-		logger.Info("validateNewUFA WHO")
+	if caller.Role == ROLE_SELLER || caller.Role == ROLE_BUYER {
+		logger.Info("validateNewUFA " + caller.Role)
 
-		json.Unmarshal([]byte(payload), &ufaDetails)
-		//Now check individual fields
-		ufaRecordMap := ufaDetails.(map[string]interface{})
-		netChargeStr := getSafeString(ufaRecordMap["netCharge"])
-		tolerenceStr := getSafeString(ufaRecordMap["chargTolrence"])
-		netCharge := validateNumber(netChargeStr)
-		if netCharge <= 0.0 {
-			validationMessage.WriteString("\nInvalid net charge")
-		}
-		tolerence := validateNumber(tolerenceStr)
-		if tolerence < 0.0 || tolerence > 10.0 {
-			validationMessage.WriteString("\nTolerence is out of range. Should be between 0 and 10")
+		ufaDetails, err := parseUFA([]byte(payload))
+		if err != nil {
+			validationMessages = append(validationMessages, newChaincodeError(ERR_INVALID_PAYLOAD, "", "Invalid UFA payload: "+err.Error()))
+		} else {
+			//Now check individual fields
+			validationMessages = append(validationMessages, validateUFATerms(&ufaDetails)...)
+			validationMessages = append(validationMessages, checkNewUFAFields(&ufaDetails)...)
+			if ufaDetails.Status != "" && ufaDetails.Status != STATUS_DRAFT {
+				validationMessages = append(validationMessages, newChaincodeError(ERR_INITIAL_STATUS, "status", "A new UFA starts as a Draft, status can not be set"))
+			}
+			roles := caller.rolesOn(&ufaDetails)
+			if !roles.Seller && !roles.Buyer {
+				validationMessages = append(validationMessages, newChaincodeError(ERR_CALLER_NOT_ON_AGREEMENT, "", "User is not a party to the UFA"))
+			}
 		}
 
 	} else {
-		validationMessage.WriteString("\nUser is not authorized to create a UFA")
+		validationMessages = append(validationMessages, newChaincodeError(ERR_NOT_AUTHORIZED, "", "User is not authorized to create a UFA"))
 	}
-	logger.Info("Validation messagge " + validationMessage.String())
-	return validationMessage.String()
+	return validationFailure("UFA validation failed", validationMessages)
 }
+
+//Validate the terms of an UFA, checked when it is created and whenever a draft changes
+func validateUFATerms(ufaDetails *UFA) []*ChaincodeError {
+	var validationMessages []*ChaincodeError
+	if ufaDetails.Currency == "" {
+		validationMessages = append(validationMessages, newChaincodeError(ERR_CURRENCY_MISSING, "currency", "Currency of the UFA is required"))
+	}
+	validationMessages = append(validationMessages, validateCharges(ufaDetails)...)
+	validationMessages = append(validationMessages, validateValidity(ufaDetails)...)
+	validationMessages = append(validationMessages, validateCalendar(ufaDetails)...)
+	if ufaDetails.BatchesPerPeriod < 0 {
+		validationMessages = append(validationMessages, newChaincodeError(ERR_INVALID_BATCH_LIMIT, "batchesPerPeriod", "Invoice batches per billing period can not be negative"))
+	}
+	if ufaDetails.Seller.MSPID == "" {
+		validationMessages = append(validationMessages, newChaincodeError(ERR_PARTY_MSP_MISSING, "seller.mspid", "Seller and buyer MSP ids are required"))
+	}
+	if ufaDetails.Buyer.MSPID == "" {
+		validationMessages = append(validationMessages, newChaincodeError(ERR_PARTY_MSP_MISSING, "buyer.mspid", "Seller and buyer MSP ids are required"))
+	}
+	return validationMessages
+}
+
+//Validate the net charge and its tolerance, checked on the terms of an UFA and on every amendment of them
+func validateCharges(ufaDetails *UFA) []*ChaincodeError {
+	var validationMessages []*ChaincodeError
+	if ufaDetails.NetCharge.Units <= 0 {
+		validationMessages = append(validationMessages, newChaincodeError(ERR_INVALID_NET_CHARGE, "netCharge", "Invalid net charge"))
+	}
+	if ufaDetails.ChargTolrence < 0 || ufaDetails.ChargTolrence > MAX_CHARGE_TOLERANCE {
+		validationMessages = append(validationMessages, newChaincodeError(ERR_TOLERANCE_OUT_OF_RANGE, "chargTolrence", "Tolerence is out of range. Should be between 0 and "+MAX_CHARGE_TOLERANCE.String()))
+	}
+	return validationMessages
+}
+
 func getSafeString(input interface{}) string {
 	var safeValue string
 	var isOk bool
@@ -515,118 +666,171 @@ func getSafeString(input interface{}) string {
 	return safeValue
 }
 
-//Validate a input string as number or not
-func validateNumber(str string) float64 {
-	if netCharge, err := strconv.ParseFloat(str, 64); err == nil {
-		return netCharge
+//Returns the payload argument. Legacy clients pass the caller ahead of it,
+//which is ignored as the caller now comes from the certificate
+func lastArg(args []string) string {
+	if len(args) == 0 {
+		return ""
 	}
-	return float64(-1.0)
-}
-func getSafeNumber(input interface{}) float64 {
-	return validateNumber(getSafeString(input))
+	return args[len(args)-1]
 }
 
-//Append to UFA transaction history
-func appendUFATransactionHistory(stub shim.ChaincodeStubInterface, ufanumber string, payload string) error {
-	var recordList []string
-
-	logger.Info("Appending to transaction history " + ufanumber)
-	recBytes, _ := stub.GetState(UFA_TRXN_PREFIX + ufanumber)
-
-	if recBytes == nil {
-		logger.Info("Updating the transaction history for the first time")
-		recordList = make([]string, 0)
-	} else {
-		err := json.Unmarshal(recBytes, &recordList)
-		if err != nil {
-			return errors.New("Failed to unmarshal appendUFATransactionHistory ")
-		}
+// Init initializes the smart contracts
+func (t *UFAChainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("Init called")
+	//Init runs again on upgrades and keeps the records. It migrates them to
+	//the schema of this build and records a new build, otherwise it writes nothing.
+	_, err := runMigrations(stub, false)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	recordList = append(recordList, payload)
-	bytesToStore, _ := json.Marshal(recordList)
-	logger.Info("After updating the transaction history" + string(bytesToStore))
-	stub.PutState(UFA_TRXN_PREFIX+ufanumber, bytesToStore)
-	logger.Info("Appending to transaction history " + ufanumber + " Done!!")
-	return nil
-}
-
-//Append a new UFA numbetr to the master list
-func updateMasterRecords(stub shim.ChaincodeStubInterface, ufaNumber string) error {
-	var recordList []string
-	recBytes, _ := stub.GetState(ALL_ELEMENENTS)
-
-	err := json.Unmarshal(recBytes, &recordList)
+	deployment, err := getDeployment(stub)
 	if err != nil {
-		return errors.New("Failed to unmarshal updateMasterReords ")
+		return shim.Error(err.Error())
 	}
-	recordList = append(recordList, ufaNumber)
-	bytesToStore, _ := json.Marshal(recordList)
-	logger.Info("After addition" + string(bytesToStore))
-	stub.PutState(ALL_ELEMENENTS, bytesToStore)
-	return nil
-}
-
-//Probe method to check the installation of the chain code in HLF
-func probe(stub shim.ChaincodeStubInterface) []byte {
-	ts := time.Now().Format(time.UnixDate)
-	version, _ := stub.GetState(CHAIN_CODE_VERSION)
-	output := "{\"status\":\"Success\",\"ts\" : \"" + ts + "\" ,\"version\" : \"" + string(version) + "\" }"
-	return []byte(output)
+	if deployment != nil && deployment.Version == buildVersion && deployment.Commit == buildCommit {
+		return shim.Success(nil)
+	}
+	//Stamped with the transaction time so every endorser writes the same value
+	ts, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putDeployment(stub, currentDeployment(ts))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
 }
 
-// Init initializes the smart contracts
-func (t *UFAChainCode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	logger.Info("Init called")
-	//Place an empty arry
-	stub.PutState(ALL_ELEMENENTS, []byte("[]"))
-	stub.PutState(ALL_INVOICES, []byte("[]"))
-	ts := time.Now().Format(time.UnixDate)
-	stub.PutState(CHAIN_CODE_VERSION, []byte(ts))
-	return nil, nil
+//Minimum number of arguments expected by each chaincode function
+var functionArgCount = map[string]int{
+	"createUFA":              2,
+	"updateUFA":              2,
+	"createInvoices":         1,
+	"updateInvoices":         1,
+	"probe":                  0,
+	"validateNewUFA":         1,
+	"getAllUFA":              0,
+	"getUFADetails":          1,
+	"validateNewInvoideData": 1,
+	"getInvoicesForUFA":      1,
+	"getAllInvoicesForUsr":   0,
+	"getAllNonExiredUFA":     0,
+	"submitUFA":              1,
+	"approveUFA":             1,
+	"rejectUFA":              1,
+	"suspendUFA":             1,
+	"terminateUFA":           1,
+	"closeUFA":               1,
+	"expireUFA":              1,
+	"reviewInvoice":          1,
+	"approveInvoice":         1,
+	"rejectInvoice":          1,
+	"cancelInvoice":          1,
+	"markInvoicePaid":        1,
+	"setFXRate":              3,
+	"getFXRates":             0,
+	"getUFAHistory":          1,
+	"proposeAmendment":       2,
+	"acceptAmendment":        1,
+	"rejectAmendment":        2,
+	"getAmendments":          1,
+	"createCreditNote":       1,
+	"getInvoiceLines":        1,
+	"setTaxRule":             3,
+	"getTaxRules":            0,
+	"getTaxSummary":          2,
+	"getBillingCalendar":     1,
+	"migrateLedger":          0,
+	"planMigrations":         0,
 }
 
-// Invoke entry point
-func (t *UFAChainCode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	logger.Info("Invoke called")
-	if function == "createUFA" {
-		return createUFA(stub, args)
-	} else if function == "updateUFA" {
-		return updateUFA(stub, args)
-	} else if function == "createInvoices" {
-		return createInvoices(stub, args)
-	} else if function == "updateInvoices" {
-		return updateInvoices(stub, args)
-	}
-	return nil, nil
+// Invoke entry point for both the ledger updates and the queries
+func (t *UFAChainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	logger.Info("Invoke called for " + function)
+	argCount, isKnown := functionArgCount[function]
+	if !isKnown {
+		return toResponse(nil, newChaincodeError(ERR_UNKNOWN_FUNCTION, "", "Unknown function "+function))
+	}
+	if len(args) < argCount {
+		return toResponse(nil, newChaincodeError(ERR_ARGUMENT_COUNT, "", fmt.Sprintf("Function %s expects %d arguments, received %d", function, argCount, len(args))))
+	}
+	switch function {
+	case "createUFA":
+		return toResponse(createUFA(stub, args))
+	case "updateUFA":
+		return toResponse(updateUFA(stub, args))
+	case "createInvoices":
+		return toResponse(createInvoices(stub, args))
+	case "updateInvoices":
+		return toResponse(updateInvoices(stub, args))
+	case "probe":
+		return toResponse(probe(stub))
+	case "validateNewUFA":
+		logger.Info("validateNewUFA Going to call")
+		return shim.Success(validateNewUFAData(stub, args))
+	case "getAllUFA":
+		return toResponse(getAllUFA(stub))
+	case "getUFADetails":
+		return toResponse(getUFADetails(stub, args))
+	case "validateNewInvoideData":
+		return shim.Success(validateNewInvoideData(stub, args))
+	case "getInvoicesForUFA":
+		return toResponse(getInvoicesForUFA(stub, args))
+	case "getAllInvoicesForUsr":
+		return toResponse(getAllInvoicesForUsr(stub, args))
+	case "getAllNonExiredUFA":
+		return toResponse(getAllNonExpiredUFA(stub, args))
+	case "submitUFA", "approveUFA", "rejectUFA", "suspendUFA", "terminateUFA", "closeUFA", "expireUFA":
+		return toResponse(changeUFAStatus(stub, function, args))
+	case "reviewInvoice", "approveInvoice", "rejectInvoice", "cancelInvoice", "markInvoicePaid":
+		return toResponse(changeInvoiceStatus(stub, function, args))
+	case "setFXRate":
+		return toResponse(setFXRate(stub, args))
+	case "getFXRates":
+		return toResponse(getFXRates(stub))
+	case "getUFAHistory":
+		return toResponse(getUFAHistory(stub, args))
+	case "proposeAmendment":
+		return toResponse(proposeAmendment(stub, args))
+	case "acceptAmendment":
+		return toResponse(acceptAmendment(stub, args))
+	case "rejectAmendment":
+		return toResponse(rejectAmendment(stub, args))
+	case "getAmendments":
+		return toResponse(getAmendments(stub, args))
+	case "createCreditNote":
+		return toResponse(createCreditNote(stub, args))
+	case "getInvoiceLines":
+		return toResponse(getInvoiceLines(stub, args))
+	case "setTaxRule":
+		return toResponse(setTaxRule(stub, args))
+	case "getTaxRules":
+		return toResponse(getAllTaxRules(stub))
+	case "getTaxSummary":
+		return toResponse(getTaxSummary(stub, args))
+	case "getBillingCalendar":
+		return toResponse(getBillingCalendar(stub, args))
+	case "migrateLedger":
+		return toResponse(migrateLedger(stub))
+	case "planMigrations":
+		return toResponse(planMigrations(stub))
+	}
+	return toResponse(nil, newChaincodeError(ERR_UNKNOWN_FUNCTION, "", "Unknown function "+function))
 }
 
-// Query the records form the  smart contracts
-func (t *UFAChainCode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	logger.Info("Query called")
-	if function == "probe" {
-		return probe(stub), nil
-	} else if function == "validateNewUFA" {
-		logger.Info("validateNewUFA Going to call")
-		return validateNewUFAData(args), nil
-	} else if function == "getAllUFA" {
-		return getAllUFA(stub, args[0])
-	} else if function == "getUFADetails" {
-		return getUFADetails(stub, args)
-	} else if function == "validateNewInvoideData" {
-		return validateNewInvoideData(stub, args), nil
-	} else if function == "getInvoicesForUFA" {
-		return getInvoicesForUFA(stub, args), nil
-	} else if function == "getAllInvoicesForUsr" {
-		return getAllInvoicesForUsr(stub, args)
-	} else if function == "getAllNonExiredUFA" {
-		return getAllNonExpiredUFA(stub, args)
-	}
-	return nil, nil
+//Converts the result of a handler into a chaincode response
+func toResponse(payload []byte, err error) pb.Response {
+	if err != nil {
+		logger.Info("Returning error: " + err.Error())
+		return shim.Error(string(toChaincodeError(err).toJSON()))
+	}
+	return shim.Success(payload)
 }
 
 func main() {
-	logger.SetLevel(shim.LogInfo)
-	primitives.SetSecurityLevel("SHA3", 256)
 	err := shim.Start(new(UFAChainCode))
 	if err != nil {
 		fmt.Printf("Error starting UFAChainCode: %s", err)
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const sellerEmail = "seller@shell.com"
+const buyerEmail = "buyer@customer.com"
+
+var seller = testIdentity{mspID: "SellerMSP", email: sellerEmail, role: ROLE_SELLER}
+var buyer = testIdentity{mspID: "BuyerMSP", email: buyerEmail, role: ROLE_BUYER}
+var outsider = testIdentity{mspID: "OtherMSP", email: "someone@other.com", role: ROLE_SELLER}
+
+//Returns a valid agreed UFA payload
+func newTestUFA(ufanumber string) UFA {
+	return UFA{
+		UFANumber:      ufanumber,
+		Seller:         Party{Name: "Shell", MSPID: seller.mspID},
+		Buyer:          Party{Name: "Customer", MSPID: buyer.mspID},
+		SellerApprover: Approver{Name: "Seller", EmailID: sellerEmail},
+		BuyerApprover:  Approver{Name: "Buyer", EmailID: buyerEmail},
+		Currency:       "USD",
+		NetCharge:      whole(1000),
+		ChargTolrence:  10 * 100,
+		StartDate:      "2017-01-01",
+		EndDate:        "2018-12-31",
+	}
+}
+
+//Marshals a test payload
+func toJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Unable to marshal payload: %v", err)
+	}
+	return string(payload)
+}
+
+//Returns an amount of whole currency units
+func whole(amount int64) Money {
+	return Money{Units: amount * 100, Currency: "USD"}
+}
+
+//Returns a seller invoice and its buyer copy for a billing period
+func invoicePair(ufanumber string, period string, amount int64) []Invoice {
+	return []Invoice{
+		{InvoiceNumber: "S-" + period, UFANumber: ufanumber, BillingPeriod: period, InvoiceAmt: whole(amount), Side: SIDE_SELLER},
+		{InvoiceNumber: "B-" + period, UFANumber: ufanumber, BillingPeriod: period, InvoiceAmt: whole(amount), Side: SIDE_BUYER},
+	}
+}
+
+//Creates an UFA as the seller and has the buyer agree to it
+func mustCreateUFA(t *testing.T, stub *ledgerStub, ufa UFA) {
+	t.Helper()
+	stub.setCaller(seller)
+	stub.mustInvoke("createUFA", ufa.UFANumber, toJSON(t, ufa))
+	stub.mustInvoke("submitUFA", ufa.UFANumber)
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveUFA", ufa.UFANumber)
+	stub.setCaller(seller)
+}
+
+//Parses the error envelope of a failed response
+func responseError(t *testing.T, res pb.Response) *ChaincodeError {
+	t.Helper()
+	if res.Status == shim.OK {
+		t.Fatalf("Expected the invoke to fail, got %s", res.Payload)
+	}
+	var chaincodeErr ChaincodeError
+	if err := json.Unmarshal([]byte(res.Message), &chaincodeErr); err != nil {
+		t.Fatalf("Error message is not an envelope: %s", res.Message)
+	}
+	return &chaincodeErr
+}
+
+//Checks if an error lists a broken rule with the given code and message
+func hasDetail(err *ChaincodeError, code string, message string) bool {
+	if err == nil {
+		return false
+	}
+	for _, detail := range err.Details {
+		if detail.Code == code && strings.Contains(detail.Message, message) {
+			return true
+		}
+	}
+	return false
+}
+
+//Reads an UFA back through the getUFADetails query
+func readUFA(t *testing.T, stub *ledgerStub, ufanumber string) UFA {
+	t.Helper()
+	ufa, err := parseUFA(stub.mustInvoke("getUFADetails", ufanumber))
+	if err != nil {
+		t.Fatalf("Unable to parse UFA %s: %v", ufanumber, err)
+	}
+	return ufa
+}
+
+func TestUFALifecycle(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+
+	var active []UFA
+	json.Unmarshal(stub.mustInvoke("getAllNonExiredUFA"), &active)
+	if len(active) != 1 || active[0].UFANumber != "UFA1" {
+		t.Fatalf("Expected UFA1 to be active, got %+v", active)
+	}
+
+	payload := stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+	if payload != nil {
+		t.Fatalf("createInvoices rejected valid invoices: %s", payload)
+	}
+	ufa := readUFA(t, stub, "UFA1")
+	if ufa.RaisedInvTotal != whole(200) {
+		t.Errorf("Expected raised total 200, got %v", ufa.RaisedInvTotal)
+	}
+	if ufa.InvoicePeriods["2017-10"] != "S-2017-10,B-2017-10," {
+		t.Errorf("Billing period not marked as invoiced: %+v", ufa.InvoicePeriods)
+	}
+
+	var invoices []Invoice
+	json.Unmarshal(stub.mustInvoke("getInvoicesForUFA", "UFA1"), &invoices)
+	if len(invoices) != 2 || invoices[0].RaisedBy != sellerEmail {
+		t.Fatalf("Expected 2 invoices raised by the seller for UFA1, got %+v", invoices)
+	}
+
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveInvoice", "S-2017-10")
+	var buyerInvoices []Invoice
+	json.Unmarshal(stub.mustInvoke("getAllInvoicesForUsr"), &buyerInvoices)
+	if len(buyerInvoices) != 1 || buyerInvoices[0].InvoiceNumber != "S-2017-10" {
+		t.Fatalf("Expected the approved invoice for the buyer, got %+v", buyerInvoices)
+	}
+
+	stub.setCaller(seller)
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-11", 900)))
+	if ufa := readUFA(t, stub, "UFA1"); ufa.Status != STATUS_EXHAUSTED || ufa.RaisedInvTotal != whole(1100) {
+		t.Fatalf("Expected UFA to be exhausted at 1100, got %s at %v", ufa.Status, ufa.RaisedInvTotal)
+	}
+	json.Unmarshal(stub.mustInvoke("getAllNonExiredUFA"), &active)
+	if len(active) != 0 {
+		t.Fatalf("Expected exhausted UFA to be filtered, got %+v", active)
+	}
+}
+
+func TestChargesExhaustedPastTheCap(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	//Totals can land past the cap, e.g. through converted amounts
+	ufa := readUFA(t, stub, "UFA1")
+	ufa.RaisedInvTotal = whole(1150)
+	stub.MockTransactionStart("overrun")
+	key, _ := ufaKey(stub, "UFA1")
+	ufaBytes, _ := json.Marshal(ufa)
+	stub.MockStub.PutState(key, ufaBytes)
+	stub.MockTransactionEnd("overrun")
+
+	err := responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 1))))
+	if !hasDetail(err, ERR_CHARGES_EXHAUSTED, "All charges exhausted") {
+		t.Fatalf("Expected the UFA past its cap to be exhausted, got %+v", err)
+	}
+}
+
+func TestValidateNewUFA(t *testing.T) {
+	valid := newTestUFA("UFA1")
+	zeroCharge := valid
+	zeroCharge.NetCharge = whole(0)
+	highTolerance := valid
+	highTolerance.ChargTolrence = 11 * 100
+	noMSP := valid
+	noMSP.Buyer.MSPID = ""
+	noCurrency := valid
+	noCurrency.Currency = ""
+	negativeBatches := valid
+	negativeBatches.BatchesPerPeriod = -1
+	presetTotal := valid
+	presetTotal.RaisedInvTotal = whole(-1000000)
+	presetAmendment := valid
+	presetAmendment.PendingAmendment = 7
+	tests := []struct {
+		name    string
+		caller  testIdentity
+		payload string
+		code    string
+		message string
+	}{
+		{"valid seller", seller, toJSON(t, valid), "", ""},
+		{"valid buyer", buyer, toJSON(t, valid), "", ""},
+		{"unauthorized role", testIdentity{seller.mspID, sellerEmail, "AUDITOR"}, toJSON(t, valid), ERR_NOT_AUTHORIZED, "User is not authorized to create a UFA"},
+		{"role of the other party", testIdentity{seller.mspID, sellerEmail, ROLE_BUYER}, toJSON(t, valid), ERR_CALLER_NOT_ON_AGREEMENT, "User is not a party to the UFA"},
+		{"not on the agreement", outsider, toJSON(t, valid), ERR_CALLER_NOT_ON_AGREEMENT, "User is not a party to the UFA"},
+		{"missing MSP id", seller, toJSON(t, noMSP), ERR_PARTY_MSP_MISSING, "Seller and buyer MSP ids are required"},
+		{"preset status", seller, `{"netCharge":"100","chargTolrence":"5","status":"Agreed"}`, ERR_INITIAL_STATUS, "A new UFA starts as a Draft"},
+		{"zero net charge", seller, toJSON(t, zeroCharge), ERR_INVALID_NET_CHARGE, "Invalid net charge"},
+		{"missing currency", seller, toJSON(t, noCurrency), ERR_CURRENCY_MISSING, "Currency of the UFA is required"},
+		{"charge finer than the currency", seller, `{"currency":"JPY","netCharge":"1000.5","chargTolrence":"5"}`, ERR_INVALID_PAYLOAD, "more than 0 decimal places"},
+		{"tolerance out of range", seller, toJSON(t, highTolerance), ERR_TOLERANCE_OUT_OF_RANGE, "Tolerence is out of range"},
+		{"negative batch limit", seller, toJSON(t, negativeBatches), ERR_INVALID_BATCH_LIMIT, "can not be negative"},
+		{"misspelt field", seller, `{"netCharge":"100","chargTolrance":"5"}`, ERR_INVALID_PAYLOAD, `unknown field "chargTolrance"`},
+		{"numeric field", seller, `{"netCharge":100}`, ERR_INVALID_PAYLOAD, "Invalid UFA payload"},
+		{"preset raised total", seller, toJSON(t, presetTotal), ERR_INVALID_PAYLOAD, "Field raisedInvTotal is computed by the chaincode"},
+		{"preset amendment", buyer, toJSON(t, presetAmendment), ERR_INVALID_PAYLOAD, "Field pendingAmendment is computed by the chaincode"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newLedgerStub(t)
+			stub.setCaller(test.caller)
+			var result validationResult
+			if err := json.Unmarshal(stub.mustInvoke("validateNewUFA", test.payload), &result); err != nil {
+				t.Fatalf("Unable to parse the validation result: %v", err)
+			}
+			if test.code == "" && result.Validation != "Success" {
+				t.Fatalf("Expected success, got %+v", result)
+			}
+			if test.code != "" && (result.Validation != "Failure" || !hasDetail(result.Error, test.code, test.message)) {
+				t.Fatalf("Expected failure %s %q, got %+v", test.code, test.message, result)
+			}
+			res := stub.invoke("createUFA", "UFA1", test.payload)
+			if test.code == "" && res.Status != shim.OK {
+				t.Fatalf("createUFA failed: %s", res.Message)
+			}
+			if test.code != "" && !hasDetail(responseError(t, res), test.code, test.message) {
+				t.Fatalf("Expected createUFA to fail with %s, got %d: %s", test.code, res.Status, res.Message)
+			}
+		})
+	}
+}
+
+func TestValidateInvoiceDetails(t *testing.T) {
+	negative := invoicePair("UFA1", "2017-11", 100)
+	negative[1].InvoiceAmt = whole(-1)
+	foreign := invoicePair("UFA1", "2017-11", 100)
+	foreign[1].RaisedBy = buyerEmail
+	preapproved := invoicePair("UFA1", "2017-11", 100)
+	preapproved[0].ApprovedBy, preapproved[0].PaymentReference = buyerEmail, "PAY-1"
+	disguised := invoicePair("UFA1", "2017-11", 100)
+	disguised[0].DocumentType = "CreditNote"
+	tests := []struct {
+		name     string
+		invoices string
+		code     string
+		message  string
+	}{
+		{"valid pair", toJSON(t, invoicePair("UFA1", "2017-11", 100)), "", ""},
+		{"single invoice", toJSON(t, invoicePair("UFA1", "2017-11", 100)[:1]), "", ""},
+		{"no invoices", `[]`, ERR_INVOICE_COUNT, "Invalid number of invoices"},
+		{"missing UFA number", toJSON(t, invoicePair("", "2017-11", 100)), ERR_UFA_NUMBER_MISSING, "UFA number not provided"},
+		{"unknown UFA", toJSON(t, invoicePair("UFA9", "2017-11", 100)), ERR_UFA_NOT_FOUND, "Invalid UFA number provided"},
+		{"missing period", toJSON(t, invoicePair("UFA1", "", 100)), ERR_BILLING_PERIOD_MISSING, "Invalid billing period"},
+		{"period already invoiced", toJSON(t, invoicePair("UFA1", "2017-10", 100)), ERR_PERIOD_ALREADY_INVOICED, "Invoice already raised for the month"},
+		{"negative amount", toJSON(t, negative), ERR_NEGATIVE_INVOICE_AMOUNT, "Invalid invoice amount in B-2017-11"},
+		{"up to the tolerance", toJSON(t, invoicePair("UFA1", "2017-11", 900)), "", ""},
+		{"exceeding charge", toJSON(t, invoicePair("UFA1", "2017-11", 901)), ERR_CHARGE_EXCEEDED, "Invoice value is exceeding total allowed charge"},
+		{"raised for someone else", toJSON(t, foreign), ERR_RAISED_BY_MISMATCH, "Invoice B-2017-11 can only be raised by " + sellerEmail},
+		{"mistyped amount", `[{"invoiceNumber":"S1","ufanumber":"UFA1","billingPeriod":"2017-11","invoiceAmt":100}]`, ERR_INVALID_PAYLOAD, "Invalid invoice payload"},
+		{"preset approval", toJSON(t, preapproved), ERR_INVALID_PAYLOAD, "Field approvedBy is computed by the chaincode and can not be set on invoice S-2017-11"},
+		{"preset document type", toJSON(t, disguised), ERR_INVALID_PAYLOAD, "Field documentType is computed by the chaincode"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newLedgerStub(t)
+			mustCreateUFA(t, stub, newTestUFA("UFA1"))
+			stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+
+			var result validationResult
+			if err := json.Unmarshal(stub.mustInvoke("validateNewInvoideData", test.invoices), &result); err != nil {
+				t.Fatalf("Unable to parse the validation result: %v", err)
+			}
+			if test.code == "" && result.Validation != "Success" {
+				t.Fatalf("Expected success, got %+v", result)
+			}
+			if test.code != "" && !hasDetail(result.Error, test.code, test.message) {
+				t.Fatalf("Expected failure %s %q, got %+v", test.code, test.message, result)
+			}
+			res := stub.invoke("createInvoices", test.invoices)
+			if test.code == "" && res.Status != shim.OK {
+				t.Fatalf("createInvoices failed: %s", res.Message)
+			}
+			if test.code != "" && !hasDetail(responseError(t, res), test.code, test.message) {
+				t.Fatalf("Expected createInvoices to fail with %s, got %d: %s", test.code, res.Status, res.Message)
+			}
+			expectedTotal := whole(200)
+			if test.code == "" {
+				var invoices []Invoice
+				json.Unmarshal([]byte(test.invoices), &invoices)
+				booked, _ := bookInvoices(invoices)
+				expectedTotal, _ = expectedTotal.plus(booked)
+			}
+			if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != expectedTotal {
+				t.Fatalf("Expected raised total %v, got %v", expectedTotal, ufa.RaisedInvTotal)
+			}
+		})
+	}
+}
+
+func TestFailedInvokeRollsBack(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+
+	//The invoice is written before the transaction fails
+	res := stub.transact([]string{"approveInvoice", "S-2017-10"}, func() pb.Response {
+		invoice, _ := getInvoice(stub, "S-2017-10")
+		invoice.ApprovedBy = buyerEmail
+		if err := putInvoice(stub, invoice); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Error("Invalid invoice number X-1")
+	})
+	if res.Status == shim.OK {
+		t.Fatal("Expected the transaction to fail")
+	}
+	invoice, _ := getInvoice(stub, "S-2017-10")
+	if invoice.ApprovedBy != "" {
+		t.Fatalf("Write of the failed transaction was committed: %+v", invoice)
+	}
+}
+
+func TestInvokeUnknownFunction(t *testing.T) {
+	stub := newLedgerStub(t)
+	if err := responseError(t, stub.invoke("deleteEverything")); err.Code != ERR_UNKNOWN_FUNCTION {
+		t.Fatalf("Expected unknown function to fail, got %+v", err)
+	}
+	if err := responseError(t, stub.invoke("createUFA")); err.Code != ERR_ARGUMENT_COUNT {
+		t.Fatalf("Expected missing arguments to fail, got %+v", err)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	err := responseError(t, stub.invoke("getInvoicesForUFA", `UFA "9"`))
+	if err.Code != ERR_REQUEST_FAILED || err.Message != `Invalid UFA number UFA "9"` {
+		t.Fatalf("Expected a plain error to be wrapped, got %+v", err)
+	}
+	stub.setCaller(outsider)
+	err = responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 100))))
+	if err.Code != ERR_VALIDATION_FAILED || len(err.Details) != 1 || err.Details[0].Code != ERR_NOT_A_PARTY {
+		t.Fatalf("Expected the authorization failure as a detail, got %+v", err)
+	}
+}
+
+func TestRecordsListedByCompositeKey(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA2"))
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	if res := stub.invoke("createUFA", "UFA1", toJSON(t, newTestUFA("UFA1"))); res.Status == shim.OK {
+		t.Fatal("Expected a duplicate UFA to be rejected")
+	}
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 100)))
+	second := invoicePair("UFA2", "2017-10", 100)
+	second[0].InvoiceNumber, second[1].InvoiceNumber = "S-UFA2", "B-UFA2"
+	stub.mustInvoke("createInvoices", toJSON(t, second))
+
+	var ufas []UFA
+	json.Unmarshal(stub.mustInvoke("getAllUFA"), &ufas)
+	if len(ufas) != 2 || ufas[0].UFANumber != "UFA1" || ufas[1].UFANumber != "UFA2" {
+		t.Fatalf("Expected UFA1 and UFA2 in key order, got %+v", ufas)
+	}
+	var invoices []Invoice
+	json.Unmarshal(stub.mustInvoke("getInvoicesForUFA", "UFA2"), &invoices)
+	if len(invoices) != 2 || invoices[0].UFANumber != "UFA2" || invoices[1].UFANumber != "UFA2" {
+		t.Fatalf("Expected only the invoices of UFA2, got %+v", invoices)
+	}
+	json.Unmarshal(stub.mustInvoke("getAllInvoicesForUsr"), &invoices)
+	if len(invoices) != 4 {
+		t.Fatalf("Expected the four seller invoices, got %+v", invoices)
+	}
+	//The same email in another organisation is someone else
+	stub.setCaller(testIdentity{mspID: outsider.mspID, email: sellerEmail, role: ROLE_SELLER})
+	json.Unmarshal(stub.mustInvoke("getAllInvoicesForUsr"), &invoices)
+	if len(invoices) != 0 {
+		t.Fatalf("Expected no invoices for a namesake of the seller, got %+v", invoices)
+	}
+	stub.setCaller(seller)
+
+	duplicate := invoicePair("UFA2", "2017-11", 100)
+	duplicate[0].InvoiceNumber = "S-2017-10"
+	output := string(stub.mustInvoke("validateNewInvoideData", toJSON(t, duplicate)))
+	if !strings.Contains(output, "Invalid or duplicate invoice number S-2017-10") {
+		t.Fatalf("Expected reuse of an invoice number to be rejected, got %s", output)
+	}
+}
+
+func TestCallerMustBeOnAgreement(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	//Legacy clients still pass who ahead of the payload
+	stub.mustInvoke("createInvoices", sellerEmail, toJSON(t, invoicePair("UFA1", "2017-10", 100)))
+
+	stub.setCaller(outsider)
+	denied := [][]string{
+		{"getUFADetails", "UFA1"},
+		{"getInvoicesForUFA", "UFA1"},
+		{"updateUFA", "UFA1", `{"chargTolrence":"5"}`},
+		{"suspendUFA", "UFA1"},
+	}
+	for _, call := range denied {
+		res := stub.invoke(call[0], call[1:]...)
+		if res.Status == shim.OK || !strings.Contains(res.Message, "is not a party to UFA UFA1") {
+			t.Errorf("Expected %s by an outsider to be rejected, got %d: %s", call[0], res.Status, res.Message)
+		}
+	}
+	output := string(stub.mustInvoke("validateNewInvoideData", toJSON(t, invoicePair("UFA1", "2017-11", 100))))
+	if !strings.Contains(output, "is not a party to UFA UFA1") {
+		t.Errorf("Expected invoices by an outsider to be rejected, got %s", output)
+	}
+	var ufas []UFA
+	json.Unmarshal(stub.mustInvoke("getAllUFA"), &ufas)
+	if len(ufas) != 0 {
+		t.Errorf("Expected no UFAs to be visible to an outsider, got %+v", ufas)
+	}
+
+	stub.setCaller(testIdentity{mspID: buyer.mspID, email: "colleague@customer.com", role: ROLE_BUYER})
+	json.Unmarshal(stub.mustInvoke("getAllUFA"), &ufas)
+	if len(ufas) != 1 {
+		t.Errorf("Expected a buyer side user to see the UFA, got %+v", ufas)
+	}
+	stub.setCaller(testIdentity{mspID: buyer.mspID, email: "colleague@customer.com"})
+	if res := stub.invoke("getUFADetails", "UFA1"); res.Status == shim.OK {
+		t.Error("Expected a user without a role or approval on the UFA to be rejected")
+	}
+}
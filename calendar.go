@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//Billing frequencies of an UFA. Monthly and quarterly periods follow the
+//calendar, milestone periods are the milestones the UFA lists in order.
+const (
+	BILLING_MONTHLY   = "Monthly"
+	BILLING_QUARTERLY = "Quarterly"
+	BILLING_MILESTONE = "Milestone"
+)
+
+//Billing frequencies an UFA can declare
+var billingFrequencies = []string{BILLING_MONTHLY, BILLING_QUARTERLY, BILLING_MILESTONE}
+
+//Statuses of a billing period listed by getBillingCalendar
+const (
+	PERIOD_BILLED      = "Billed"
+	PERIOD_OUTSTANDING = "Outstanding"
+	PERIOD_SKIPPED     = "Skipped"
+)
+
+//BILLING_PERIOD_LAYOUT Layout of the monthly billing periods invoices are raised for
+const BILLING_PERIOD_LAYOUT = "2006-01"
+
+//Month layouts accepted in payloads, normalised to BILLING_PERIOD_LAYOUT
+var monthLayouts = []string{BILLING_PERIOD_LAYOUT, "2006-1", "2006/01", "01/2006", "1/2006", "01-2006", "Jan-2006", "Jan 2006", "January-2006", "January 2006"}
+
+//Quarters accepted in payloads as 2017-Q4, 2017Q4, Q4-2017 or Q4 2017, normalised to 2017-Q4
+var quarterPattern = regexp.MustCompile(`^(?i)(?:(\d{4})[- ]?Q([1-4])|Q([1-4])[- /]?(\d{4}))$`)
+
+//CalendarPeriod Billing period of an UFA as listed by getBillingCalendar
+type CalendarPeriod struct {
+	Period string `json:"period"`
+	Status string `json:"status"`
+	//First and last day of calendar periods, milestones are not dated
+	From     string   `json:"from,omitempty"`
+	To       string   `json:"to,omitempty"`
+	Invoices []string `json:"invoices,omitempty"`
+}
+
+//BillingCalendar Billing periods of an UFA up to the current one
+type BillingCalendar struct {
+	UFANumber        string           `json:"ufanumber"`
+	BillingFrequency string           `json:"billingFrequency"`
+	Periods          []CalendarPeriod `json:"periods"`
+}
+
+//Returns the billing frequency of an UFA, UFAs agreed before frequencies
+//were declared are billed monthly
+func (u *UFA) billingFrequency() string {
+	if u.BillingFrequency == "" {
+		return BILLING_MONTHLY
+	}
+	return u.BillingFrequency
+}
+
+//Validates the billing frequency and milestones of a new UFA
+func validateCalendar(ufa *UFA) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	if !containsString(billingFrequencies, ufa.billingFrequency()) {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_FREQUENCY, "billingFrequency",
+			"Billing frequency must be one of "+strings.Join(billingFrequencies, ", ")+", got "+ufa.BillingFrequency))
+	}
+	if ufa.billingFrequency() != BILLING_MILESTONE {
+		if len(ufa.Milestones) > 0 {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_FREQUENCY, "milestones", "Milestones are only listed by UFAs billed by "+BILLING_MILESTONE))
+		}
+		return errorMessages
+	}
+	if len(ufa.Milestones) == 0 {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_FREQUENCY, "milestones", "An UFA billed by "+BILLING_MILESTONE+" lists its milestones"))
+	}
+	seen := make(map[string]bool)
+	for _, milestone := range ufa.Milestones {
+		//Milestones are matched ignoring case
+		name := strings.ToLower(milestone)
+		if name == "" || strings.TrimSpace(milestone) != milestone || seen[name] {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_FREQUENCY, "milestones", "Invalid or duplicate milestone "+strconv.Quote(milestone)))
+		}
+		seen[name] = true
+	}
+	return errorMessages
+}
+
+//Brings a billing period into the one spelling of the frequency of the UFA,
+//so the same period can not be invoiced twice under different spellings
+func normalizeBillingPeriod(ufa *UFA, period string) (string, error) {
+	period = strings.TrimSpace(period)
+	switch ufa.billingFrequency() {
+	case BILLING_QUARTERLY:
+		match := quarterPattern.FindStringSubmatch(period)
+		if match == nil {
+			return "", errors.New("quarters are written as 2006-Q1")
+		}
+		if match[1] != "" {
+			return match[1] + "-Q" + match[2], nil
+		}
+		return match[4] + "-Q" + match[3], nil
+	case BILLING_MILESTONE:
+		for _, milestone := range ufa.Milestones {
+			if strings.EqualFold(milestone, period) {
+				return milestone, nil
+			}
+		}
+		return "", errors.New("milestones of the UFA are " + strings.Join(ufa.Milestones, ", "))
+	}
+	for _, layout := range monthLayouts {
+		if month, err := time.Parse(layout, period); err == nil {
+			return month.Format(BILLING_PERIOD_LAYOUT), nil
+		}
+	}
+	return "", errors.New("months are written as " + BILLING_PERIOD_LAYOUT)
+}
+
+//Returns the first and last day of a normalised calendar period, milestones are not dated
+func periodDates(ufa *UFA, period string) (string, string, bool) {
+	var first time.Time
+	months := 1
+	switch ufa.billingFrequency() {
+	case BILLING_MILESTONE:
+		return "", "", false
+	case BILLING_QUARTERLY:
+		year, _ := strconv.Atoi(period[:4])
+		quarter, _ := strconv.Atoi(period[6:])
+		first = time.Date(year, time.Month(quarter*3-2), 1, 0, 0, 0, 0, time.UTC)
+		months = 3
+	default:
+		first, _ = time.Parse(BILLING_PERIOD_LAYOUT, period)
+	}
+	return first.Format(DATE_LAYOUT), first.AddDate(0, months, -1).Format(DATE_LAYOUT), true
+}
+
+//Returns the calendar period a day falls in
+func periodOf(ufa *UFA, date string) string {
+	day, _ := time.Parse(DATE_LAYOUT, date)
+	if ufa.billingFrequency() == BILLING_QUARTERLY {
+		return day.Format("2006") + "-Q" + strconv.Itoa((int(day.Month())+2)/3)
+	}
+	return day.Format(BILLING_PERIOD_LAYOUT)
+}
+
+//Returns the calendar period following a normalised one
+func nextPeriod(ufa *UFA, period string) string {
+	_, last, _ := periodDates(ufa, period)
+	day, _ := time.Parse(DATE_LAYOUT, last)
+	return periodOf(ufa, day.AddDate(0, 0, 1).Format(DATE_LAYOUT))
+}
+
+//Checks if a period recorded on an UFA is spelt the one way of its frequency.
+//Periods recorded before they were normalised are not.
+func isNormalizedPeriod(ufa *UFA, period string) bool {
+	normalized, err := normalizeBillingPeriod(ufa, period)
+	return err == nil && normalized == period
+}
+
+//Returns the place of a normalised period in the calendar of the UFA, only
+//meaningful for comparing periods
+func periodPosition(ufa *UFA, period string) int {
+	if ufa.billingFrequency() == BILLING_MILESTONE {
+		for i, milestone := range ufa.Milestones {
+			if milestone == period {
+				return i
+			}
+		}
+		return -1
+	}
+	first, _, _ := periodDates(ufa, period)
+	day, _ := time.Parse(DATE_LAYOUT, first)
+	return day.Year()*12 + int(day.Month())
+}
+
+//Returns the latest period invoiced on an UFA, empty if none is
+func lastBilledPeriod(ufa *UFA) string {
+	last := ""
+	for period := range ufa.InvoicePeriods {
+		if !isNormalizedPeriod(ufa, period) {
+			continue
+		}
+		if last == "" || periodPosition(ufa, period) > periodPosition(ufa, last) {
+			last = period
+		}
+	}
+	return last
+}
+
+//Normalises the billing periods of a batch of invoices in place
+func normalizeInvoicePeriods(ufa *UFA, invoices []Invoice) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	for i := range invoices {
+		invoice := &invoices[i]
+		if invoice.BillingPeriod == "" {
+			continue
+		}
+		period, err := normalizeBillingPeriod(ufa, invoice.BillingPeriod)
+		if err != nil {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_BILLING_PERIOD, "billingPeriod",
+				"Invalid "+strings.ToLower(ufa.billingFrequency())+" billing period "+invoice.BillingPeriod+" of invoice "+invoice.InvoiceNumber+", "+err.Error()))
+			continue
+		}
+		invoice.BillingPeriod = period
+	}
+	return errorMessages
+}
+
+//Checks a normalised billing period can be invoiced on an UFA today: it has
+//started, it is within the validity of the UFA and no later period is invoiced
+//unless it was invoiced itself, which supplementary batches are
+func validateBillingPeriod(ufa *UFA, period string, today string) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	if first, last, dated := periodDates(ufa, period); dated {
+		if first > today {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_PERIOD_IN_FUTURE, "billingPeriod", "Billing period "+period+" only starts on "+first))
+		}
+		if ufa.StartDate != "" && last < ufa.StartDate || ufa.EndDate != "" && first > ufa.EndDate {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_PERIOD_OUTSIDE_VALIDITY, "billingPeriod",
+				"Billing period "+period+" is outside the validity of UFA "+ufa.UFANumber+" from "+ufa.StartDate+" to "+ufa.EndDate))
+		}
+	}
+	_, invoiced := ufa.InvoicePeriods[period]
+	if last := lastBilledPeriod(ufa); !invoiced && last != "" && periodPosition(ufa, period) < periodPosition(ufa, last) {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_PERIOD_OUT_OF_SEQUENCE, "billingPeriod",
+			"Billing period "+period+" comes before "+last+" which is already invoiced"))
+	}
+	return errorMessages
+}
+
+//Returns the billing periods of an UFA with whether each is billed,
+//outstanding or skipped. Calendar periods run from the start of the validity
+//up to the current period, or the end of the validity when it is over.
+func getBillingCalendar(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("getBillingCalendar called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber := lastArg(args)
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	today, err := getTxDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	last := lastBilledPeriod(ufa)
+	var periods []string
+	if ufa.billingFrequency() == BILLING_MILESTONE {
+		periods = ufa.Milestones
+	} else {
+		//UFAs without validity dates are listed from their first invoiced period
+		start := ufa.StartDate
+		for period := range ufa.InvoicePeriods {
+			if ufa.StartDate != "" || !isNormalizedPeriod(ufa, period) {
+				continue
+			}
+			if from, _, _ := periodDates(ufa, period); start == "" || from < start {
+				start = from
+			}
+		}
+		for period := periodOf(ufa, start); start != ""; period = nextPeriod(ufa, period) {
+			from, _, _ := periodDates(ufa, period)
+			if from > today || ufa.EndDate != "" && from > ufa.EndDate {
+				break
+			}
+			periods = append(periods, period)
+		}
+	}
+	calendar := BillingCalendar{UFANumber: ufanumber, BillingFrequency: ufa.billingFrequency(), Periods: []CalendarPeriod{}}
+	for _, period := range periods {
+		entry := CalendarPeriod{Period: period, Status: PERIOD_OUTSTANDING}
+		entry.From, entry.To, _ = periodDates(ufa, period)
+		if invoiceList, invoiced := ufa.InvoicePeriods[period]; invoiced {
+			entry.Status = PERIOD_BILLED
+			entry.Invoices = strings.Split(strings.TrimSuffix(invoiceList, ","), ",")
+		} else if last != "" && periodPosition(ufa, period) < periodPosition(ufa, last) {
+			entry.Status = PERIOD_SKIPPED
+		}
+		calendar.Periods = append(calendar.Periods, entry)
+	}
+	return json.Marshal(calendar)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//Reads the billing calendar of an UFA through the getBillingCalendar query
+func readCalendar(t *testing.T, stub *ledgerStub, ufanumber string) BillingCalendar {
+	t.Helper()
+	var calendar BillingCalendar
+	if err := json.Unmarshal(stub.mustInvoke("getBillingCalendar", ufanumber), &calendar); err != nil {
+		t.Fatalf("Unable to parse the billing calendar of %s: %v", ufanumber, err)
+	}
+	return calendar
+}
+
+//Returns the statuses of the periods of a calendar by period
+func periodStatuses(calendar BillingCalendar) map[string]string {
+	statuses := make(map[string]string)
+	for _, period := range calendar.Periods {
+		statuses[period.Period] = period.Status
+	}
+	return statuses
+}
+
+func TestValidateCalendar(t *testing.T) {
+	weekly := newTestUFA("UFA1")
+	weekly.BillingFrequency = "Weekly"
+	noMilestones := newTestUFA("UFA1")
+	noMilestones.BillingFrequency = BILLING_MILESTONE
+	monthlyMilestones := newTestUFA("UFA1")
+	monthlyMilestones.Milestones = []string{"Design"}
+	duplicates := noMilestones
+	duplicates.Milestones = []string{"Design", "design"}
+	padded := noMilestones
+	padded.Milestones = []string{" Design"}
+	for name, ufa := range map[string]UFA{"unknown frequency": weekly, "no milestones": noMilestones,
+		"milestones of a monthly UFA": monthlyMilestones, "duplicate milestones": duplicates, "padded milestone": padded} {
+		if errs := validateCalendar(&ufa); len(errs) == 0 || errs[0].Code != ERR_INVALID_FREQUENCY {
+			t.Errorf("%s: expected %s, got %+v", name, ERR_INVALID_FREQUENCY, errs)
+		}
+	}
+	quarterly := newTestUFA("UFA1")
+	quarterly.BillingFrequency = BILLING_QUARTERLY
+	if errs := validateCalendar(&quarterly); len(errs) != 0 {
+		t.Errorf("Expected a quarterly UFA to be valid, got %+v", errs)
+	}
+}
+
+func TestMonthlyBillingPeriods(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "Oct-2017", 100)))
+	if invoice := readInvoice(t, stub, "UFA1", "S-Oct-2017"); invoice.BillingPeriod != "2017-10" {
+		t.Fatalf("Expected the period to be normalised, got %s", invoice.BillingPeriod)
+	}
+	//The ledger stub transacts on 2017-12-01
+	for period, code := range map[string]string{
+		"10/2017": ERR_PERIOD_ALREADY_INVOICED,
+		"2018-01": ERR_PERIOD_IN_FUTURE,
+		"2017-09": ERR_PERIOD_OUT_OF_SEQUENCE,
+		"2017-9":  ERR_PERIOD_OUT_OF_SEQUENCE,
+		"Q4 2017": ERR_INVALID_BILLING_PERIOD,
+	} {
+		if err := responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA1", period, 10)))); !hasDetail(err, code, "") {
+			t.Errorf("Expected %s to fail with %s, got %+v", period, code, err)
+		}
+	}
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "November 2017", 100)))
+
+	calendar := readCalendar(t, stub, "UFA1")
+	if calendar.BillingFrequency != BILLING_MONTHLY || len(calendar.Periods) != 12 {
+		t.Fatalf("Expected the months from January to December 2017, got %+v", calendar)
+	}
+	statuses := periodStatuses(calendar)
+	if statuses["2017-01"] != PERIOD_SKIPPED || statuses["2017-10"] != PERIOD_BILLED || statuses["2017-11"] != PERIOD_BILLED || statuses["2017-12"] != PERIOD_OUTSTANDING {
+		t.Fatalf("Expected skipped, billed and outstanding months, got %+v", statuses)
+	}
+	if october := calendar.Periods[9]; october.From != "2017-10-01" || october.To != "2017-10-31" || len(october.Invoices) != 2 {
+		t.Fatalf("Expected October with its invoices, got %+v", october)
+	}
+}
+
+func TestQuarterlyAndMilestonePeriods(t *testing.T) {
+	stub := newLedgerStub(t)
+	quarterly := newTestUFA("UFA1")
+	quarterly.BillingFrequency = BILLING_QUARTERLY
+	mustCreateUFA(t, stub, quarterly)
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "Q3 2017", 100)))
+	if err := responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA1", "2018q1", 100)))); !hasDetail(err, ERR_PERIOD_IN_FUTURE, "") {
+		t.Fatalf("Expected the first quarter of 2018 to be in the future, got %+v", err)
+	}
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017Q4", 100)))
+	statuses := periodStatuses(readCalendar(t, stub, "UFA1"))
+	if len(statuses) != 4 || statuses["2017-Q1"] != PERIOD_SKIPPED || statuses["2017-Q3"] != PERIOD_BILLED || statuses["2017-Q4"] != PERIOD_BILLED {
+		t.Fatalf("Expected the quarters of 2017, got %+v", statuses)
+	}
+
+	milestones := newTestUFA("UFA2")
+	milestones.BillingFrequency = BILLING_MILESTONE
+	milestones.Milestones = []string{"Design", "Build", "Handover"}
+	mustCreateUFA(t, stub, milestones)
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA2", "build", 100)))
+	for period, code := range map[string]string{"Design": ERR_PERIOD_OUT_OF_SEQUENCE, "Testing": ERR_INVALID_BILLING_PERIOD} {
+		if err := responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA2", period, 10)))); !hasDetail(err, code, "") {
+			t.Errorf("Expected %s to fail with %s, got %+v", period, code, err)
+		}
+	}
+	calendar := readCalendar(t, stub, "UFA2")
+	if len(calendar.Periods) != 3 || calendar.Periods[0].Status != PERIOD_SKIPPED || calendar.Periods[1].Status != PERIOD_BILLED ||
+		calendar.Periods[1].Period != "Build" || calendar.Periods[2].Status != PERIOD_OUTSTANDING {
+		t.Fatalf("Expected the milestones in order, got %+v", calendar)
+	}
+}
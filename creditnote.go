@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//DOCUMENT_CREDIT_NOTE Document type of a credit note, invoices leave it empty
+const DOCUMENT_CREDIT_NOTE = "CreditNote"
+
+//CREDIT_NOTE_ISSUED Status of a credit note, it is final once issued
+const CREDIT_NOTE_ISSUED = "Issued"
+
+//Invoice statuses in which money can be given back on an invoice. Invoices
+//still under way are cancelled or rejected instead.
+var creditableInvoiceStatuses = []string{INVOICE_APPROVED, INVOICE_PAID}
+
+//UFA statuses in which credit notes can be issued
+var creditableUFAStatuses = []string{STATUS_AGREED, STATUS_SUSPENDED, STATUS_EXHAUSTED}
+
+//creditNoteRequest Payload of createCreditNote
+type creditNoteRequest struct {
+	CreditNoteNumber string `json:"creditNoteNumber"`
+	InvoiceNumber    string `json:"invoiceNumber"`
+	Amount           Money  `json:"amount"`
+	Reason           string `json:"reason"`
+}
+
+//Checks if a record of the invoice keys is a credit note
+func (i *Invoice) isCreditNote() bool {
+	return i.DocumentType == DOCUMENT_CREDIT_NOTE
+}
+
+//Returns the amount an invoice can still be credited with, in its own currency
+func (i *Invoice) creditableAmount() (Money, error) {
+	if i.CreditedAmt == nil {
+		return i.InvoiceAmt, nil
+	}
+	return i.InvoiceAmt.minus(*i.CreditedAmt)
+}
+
+//Validates a credit note request and builds the credit note, the error lists every rule broken
+func validateCreditNote(stub shim.ChaincodeStubInterface, caller *Caller, payload string) (*Invoice, *Invoice, *UFA, error) {
+	var request creditNoteRequest
+	if err := decodeStrict([]byte(payload), &request); err != nil {
+		return nil, nil, nil, newChaincodeError(ERR_INVALID_PAYLOAD, "", "Invalid credit note payload: "+err.Error())
+	}
+	original, err := getInvoice(stub, request.InvoiceNumber)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if original == nil {
+		return nil, nil, nil, newChaincodeError(ERR_INVOICE_NOT_FOUND, "invoiceNumber", "Invalid invoice number "+request.InvoiceNumber)
+	}
+	ufa, err := getUFA(stub, original.UFANumber)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ufa == nil {
+		return nil, nil, nil, newChaincodeError(ERR_UFA_NOT_FOUND, "invoiceNumber", "Invalid UFA number "+original.UFANumber)
+	}
+	if err := authorizeOnUFA(caller, ufa); err != nil {
+		return nil, nil, nil, err
+	}
+	var errorMessages []*ChaincodeError
+	if !caller.rolesOn(ufa).sellerSide() {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_NOT_AUTHORIZED, "", "Credit notes on UFA "+ufa.UFANumber+" are issued by the seller"))
+	}
+	if !containsString(creditableUFAStatuses, ufa.Status) {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_NOT_CREDITABLE, "invoiceNumber", "Credit notes can not be issued on UFA "+ufa.UFANumber+" in status "+ufa.Status))
+	}
+	if original.isCreditNote() || !containsString(creditableInvoiceStatuses, original.Status) {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_NOT_CREDITABLE, "invoiceNumber", "Invoice "+original.InvoiceNumber+" can not be credited in status "+original.Status))
+	}
+	if original.isBuyerCopy() {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_NOT_CREDITABLE, "invoiceNumber", "Invoice "+original.InvoiceNumber+" is a buyer copy, credit the seller invoice "+original.PairedWith))
+	}
+	if existing, _ := getInvoice(stub, request.CreditNoteNumber); request.CreditNoteNumber == "" || existing != nil {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_DUPLICATE_INVOICE_NUMBER, "creditNoteNumber", "Invalid or duplicate credit note number "+request.CreditNoteNumber))
+	}
+	if request.Reason == "" {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_PAYLOAD, "reason", "A credit note requires a reason"))
+	}
+	//The credit is in the currency of the invoice and converted at the rate the invoice was booked at
+	amount, err := request.Amount.withCurrency(original.InvoiceAmt.Currency)
+	creditable, creditableErr := original.creditableAmount()
+	if err != nil {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_CURRENCY_MISMATCH, "amount", "Invalid credit amount: "+err.Error()))
+	} else if amount.Units <= 0 {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_CREDIT_AMOUNT, "amount", "Invalid credit amount "+amount.String()))
+	} else if creditableErr != nil {
+		errorMessages = append(errorMessages, toChaincodeError(creditableErr))
+	} else if amount.Units > creditable.Units {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_CREDIT_EXCEEDED, "amount",
+			"Credit of "+amount.String()+" exceeds the "+creditable.String()+" left on invoice "+original.InvoiceNumber))
+	}
+	if err := validationFailure("Credit note validation failed", errorMessages); err != nil {
+		return nil, nil, nil, err
+	}
+	creditNote := &Invoice{
+		InvoiceNumber:   request.CreditNoteNumber,
+		UFANumber:       original.UFANumber,
+		BillingPeriod:   original.BillingPeriod,
+		DocumentType:    DOCUMENT_CREDIT_NOTE,
+		CreditedInvoice: original.InvoiceNumber,
+		InvoiceAmt:      amount,
+		RaisedBy:        caller.Email,
+		Status:          CREDIT_NOTE_ISSUED,
+		StatusReason:    request.Reason,
+		FXRate:          original.FXRate,
+	}
+	if original.ConvertedAmt != nil {
+		converted := original.FXRate.convert(amount, ufa.Currency)
+		creditNote.ConvertedAmt = &converted
+	}
+	//Credits on invoices raised as mirrored halves give back half their amount
+	creditNote.BookedAmt = agreementAmount(creditNote)
+	if original.Side == "" {
+		creditNote.BookedAmt = creditNote.BookedAmt.half()
+	}
+	return creditNote, original, ufa, nil
+}
+
+//Issues a credit note giving back part of an approved or paid invoice. The
+//credit lowers the effective raised total of the UFA, reopening it when exhausted.
+func createCreditNote(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("createCreditNote called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	payload := lastArg(args)
+	logger.Info("createCreditNote payload passed " + payload)
+	creditNote, original, ufa, err := validateCreditNote(stub, caller, payload)
+	if err != nil {
+		return nil, err
+	}
+	issuedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	creditNote.StatusChangedBy = caller.Email
+	creditNote.StatusChangedAt = issuedAt
+	err = putInvoice(stub, creditNote)
+	if err != nil {
+		return nil, err
+	}
+	originalBefore := *original
+	credited := creditNote.InvoiceAmt
+	if original.CreditedAmt != nil {
+		credited, err = original.CreditedAmt.plus(credited)
+		if err != nil {
+			return nil, err
+		}
+	}
+	original.CreditedAmt = &credited
+	err = putInvoice(stub, original)
+	if err != nil {
+		return nil, err
+	}
+
+	before := ufa.clone()
+	ufa.CreditedTotal, err = ufa.CreditedTotal.plus(creditNote.BookedAmt)
+	if err != nil {
+		return nil, err
+	}
+	exhausted, err := isUFAExpired(ufa)
+	if err != nil {
+		return nil, err
+	}
+	if ufa.Status == STATUS_EXHAUSTED && !exhausted {
+		err = setUFAStatus(stub, ufa, STATUS_AGREED, caller, "Credit note "+creditNote.InvoiceNumber+" issued")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putUFA(stub, ufa)
+	if err != nil {
+		return nil, err
+	}
+	//The credited invoice is audited on the history of its UFA with the credit note
+	err = recordInvoiceChange(stub, caller, before, ufa, &originalBefore, original)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Credit note " + creditNote.InvoiceNumber + " issued on invoice " + original.InvoiceNumber)
+	event := newUFAEvent(ufa, caller)
+	event.BillingPeriod = creditNote.BillingPeriod
+	event.Invoices = []string{creditNote.InvoiceNumber, original.InvoiceNumber}
+	event.Amount = &creditNote.InvoiceAmt
+	return nil, emitEvent(stub, EVENT_CREDIT_NOTE_ISSUED, event)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//Returns a credit note payload
+func creditNote(number string, invoiceNumber string, amount string) string {
+	return `{"creditNoteNumber":"` + number + `","invoiceNumber":"` + invoiceNumber + `","amount":"` + amount + `","reason":"Service credit"}`
+}
+
+func TestCreditNoteReopensUFA(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 1100)))
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveInvoice", "S-2017-10")
+	stub.setCaller(seller)
+
+	stub.mustInvoke("createCreditNote", creditNote("C-2017-10", "S-2017-10", "200"))
+	if stub.lastEvent == nil || stub.lastEvent.EventName != EVENT_CREDIT_NOTE_ISSUED {
+		t.Fatalf("Expected a %s event, got %+v", EVENT_CREDIT_NOTE_ISSUED, stub.lastEvent)
+	}
+	ufa := readUFA(t, stub, "UFA1")
+	if ufa.Status != STATUS_AGREED || ufa.RaisedInvTotal != whole(1100) || ufa.CreditedTotal != whole(200) {
+		t.Fatalf("Expected the credit to reopen UFA1 at 900, got %s raised %v credited %v", ufa.Status, ufa.RaisedInvTotal, ufa.CreditedTotal)
+	}
+	credit := readInvoice(t, stub, "UFA1", "C-2017-10")
+	if !credit.isCreditNote() || credit.CreditedInvoice != "S-2017-10" || credit.InvoiceAmt != whole(200) || credit.Status != CREDIT_NOTE_ISSUED {
+		t.Fatalf("Expected the credit note to be listed with the invoices, got %+v", credit)
+	}
+	if original := readInvoice(t, stub, "UFA1", "S-2017-10"); original.CreditedAmt == nil || *original.CreditedAmt != whole(200) {
+		t.Fatalf("Expected the credit to be recorded on S-2017-10, got %+v", original)
+	}
+	entries := readHistory(t, stub, "UFA1")
+	if change := findChange(entries[len(entries)-1], "invoices.S-2017-10.creditedAmt"); change == nil || change.Old != nil {
+		t.Fatalf("Expected the credited invoice to be audited, got %+v", entries[len(entries)-1])
+	}
+	if res := stub.invoke("cancelInvoice", "C-2017-10"); res.Status == shim.OK {
+		t.Fatalf("Expected an issued credit note to be final")
+	}
+
+	//The credit frees up room for further invoices but not more
+	err := responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-11", 201))))
+	if !hasDetail(err, ERR_CHARGE_EXCEEDED, "") {
+		t.Fatalf("Expected the charge to still be capped, got %+v", err)
+	}
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-11", 200)))
+	if ufa = readUFA(t, stub, "UFA1"); ufa.Status != STATUS_EXHAUSTED {
+		t.Fatalf("Expected UFA1 to be exhausted again, got %s", ufa.Status)
+	}
+}
+
+func TestCreditNoteValidation(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 500)))
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveInvoice", "S-2017-10")
+	stub.setCaller(seller)
+	stub.mustInvoke("createCreditNote", creditNote("C-1", "S-2017-10", "300"))
+
+	tests := []struct {
+		name    string
+		caller  testIdentity
+		payload string
+		code    string
+	}{
+		{"unknown invoice", seller, creditNote("C-2", "S-2017-12", "10"), ERR_INVOICE_NOT_FOUND},
+		{"buyer issuing", buyer, creditNote("C-2", "S-2017-10", "10"), ERR_NOT_AUTHORIZED},
+		{"invoice not approved", seller, creditNote("C-2", "B-2017-10", "10"), ERR_NOT_CREDITABLE},
+		{"credit of a credit note", seller, creditNote("C-2", "C-1", "10"), ERR_NOT_CREDITABLE},
+		{"duplicate number", seller, creditNote("B-2017-10", "S-2017-10", "10"), ERR_DUPLICATE_INVOICE_NUMBER},
+		{"more than left", seller, creditNote("C-2", "S-2017-10", "200.01"), ERR_CREDIT_EXCEEDED},
+		{"zero amount", seller, creditNote("C-2", "S-2017-10", "0"), ERR_INVALID_CREDIT_AMOUNT},
+		{"other currency", seller, `{"creditNoteNumber":"C-2","invoiceNumber":"S-2017-10","amount":{"amount":"10","currency":"EUR"},"reason":"x"}`, ERR_CURRENCY_MISMATCH},
+		{"missing reason", seller, `{"creditNoteNumber":"C-2","invoiceNumber":"S-2017-10","amount":"10"}`, ERR_INVALID_PAYLOAD},
+		{"outsider", outsider, creditNote("C-2", "S-2017-10", "10"), ERR_NOT_A_PARTY},
+	}
+	for _, test := range tests {
+		stub.setCaller(test.caller)
+		err := responseError(t, stub.invoke("createCreditNote", test.payload))
+		if err.Code != test.code && !hasDetail(err, test.code, "") {
+			t.Fatalf("%s: expected %s, got %+v", test.name, test.code, err)
+		}
+	}
+	stub.setCaller(seller)
+	stub.mustInvoke("createCreditNote", creditNote("C-2", "S-2017-10", "200"))
+	if ufa := readUFA(t, stub, "UFA1"); ufa.CreditedTotal != whole(500) {
+		t.Fatalf("Expected both credits to be booked, got %v", ufa.CreditedTotal)
+	}
+}
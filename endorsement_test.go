@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//endorsedTx Transaction submitted to every simulated endorser
+type endorsedTx struct {
+	caller   testIdentity
+	function string
+	args     []string
+}
+
+//Fields the chaincode stamps with the time of the transaction
+var stampFields = map[string]bool{"statusChangedAt": true, "setAt": true, "proposedAt": true, "decidedAt": true, "timestamp": true}
+
+//Collects the stamps of a decoded record by their dotted path
+func collectStamps(value interface{}, path string, stamps map[string]string) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if stamp, isString := field.(string); isString && stampFields[name] {
+				stamps[path+name] = stamp
+			} else {
+				collectStamps(field, path+name+".", stamps)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			collectStamps(item, path+strconv.Itoa(i)+".", stamps)
+		}
+	}
+}
+
+//Runs Init and the transactions on a fresh ledger and returns the write set of each
+func endorse(t *testing.T, txs []endorsedTx) []map[string][]byte {
+	t.Helper()
+	stub := newLedgerStub(t)
+	writeSets := []map[string][]byte{stub.lastWriteSet}
+	for _, tx := range txs {
+		stub.setCaller(tx.caller)
+		stub.mustInvoke(tx.function, tx.args...)
+		writeSets = append(writeSets, stub.lastWriteSet)
+	}
+	return writeSets
+}
+
+func TestEndorsersProduceIdenticalWriteSets(t *testing.T) {
+	txs := []endorsedTx{
+		{seller, "createUFA", []string{"UFA1", toJSON(t, newTestUFA("UFA1"))}},
+		{seller, "submitUFA", []string{"UFA1"}},
+		{buyer, "approveUFA", []string{"UFA1"}},
+		{admin, "setFXRate", []string{"EUR", "USD", "1.1"}},
+		{admin, "setTaxRule", []string{"VAT", "2017-01-01", "20"}},
+		{seller, "createInvoices", []string{linePair("2017-10", `[{"description":"Jet fuel","quantity":"2","unitPrice":"100","taxCode":"VAT"}]`)}},
+		{buyer, "approveInvoice", []string{"S-2017-10"}},
+		{seller, "createCreditNote", []string{creditNote("C-2017-10", "S-2017-10", "40")}},
+		{seller, "proposeAmendment", []string{"UFA1", `{"netCharge":"1500"}`}},
+		{buyer, "acceptAmendment", []string{"UFA1"}},
+		{seller, "updateUFA", []string{"UFA1", `{"seller":{"name":"Shell Aviation"}}`}},
+	}
+	first := endorse(t, txs)
+	//A second endorser simulates the same transactions, the stamps must come from the transaction
+	second := endorse(t, txs)
+
+	for i := range first {
+		function := "Init"
+		if i > 0 {
+			function = txs[i-1].function
+		}
+		if len(first[i]) == 0 {
+			t.Fatalf("%s wrote nothing", function)
+		}
+		keys := make([]string, 0, len(first[i]))
+		for key := range first[i] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(second[i]) != len(keys) {
+			t.Fatalf("%s: endorsers wrote %d and %d keys", function, len(keys), len(second[i]))
+		}
+		for _, key := range keys {
+			if !bytes.Equal(first[i][key], second[i][key]) {
+				t.Fatalf("%s: endorsers disagree on %q: %s and %s", function, key, first[i][key], second[i][key])
+			}
+		}
+	}
+	//Every stamp a transaction sets is its own time, stamps carried over
+	//from earlier transactions are left as they were
+	committed := make(map[string]map[string]string)
+	stamped := make(map[string]bool)
+	for i, writeSet := range first {
+		txTime := ledgerStubEpoch.Add(time.Duration(i+1) * time.Minute).Format(time.RFC3339)
+		for key, value := range writeSet {
+			var record interface{}
+			json.Unmarshal(value, &record)
+			stamps := make(map[string]string)
+			collectStamps(record, "", stamps)
+			for path, stamp := range stamps {
+				if committed[key][path] == stamp {
+					continue
+				}
+				if stamp != txTime {
+					t.Fatalf("Transaction %d stamped %s of %q with %s, not its time %s", i+1, path, key, stamp, txTime)
+				}
+				stamped[path[strings.LastIndex(path, ".")+1:]] = true
+			}
+			committed[key] = stamps
+		}
+	}
+	for field := range stampFields {
+		if !stamped[field] {
+			t.Fatalf("Expected the transactions to stamp %s", field)
+		}
+	}
+	var deployment Deployment
+	if err := json.Unmarshal(first[0][CHAIN_CODE_VERSION], &deployment); err != nil || deployment.InitializedAt != ledgerStubEpoch.Add(time.Minute).Format(time.RFC3339) {
+		t.Fatalf("Expected Init to stamp the transaction time, got %s", first[0][CHAIN_CODE_VERSION])
+	}
+}
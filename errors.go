@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+//Error codes returned in the error envelope
+const (
+	//Request level failures
+	ERR_UNKNOWN_FUNCTION  = "UNKNOWN_FUNCTION"
+	ERR_ARGUMENT_COUNT    = "ARGUMENT_COUNT"
+	ERR_REQUEST_FAILED    = "REQUEST_FAILED"
+	ERR_VALIDATION_FAILED = "VALIDATION_FAILED"
+	ERR_INVALID_PAYLOAD   = "INVALID_PAYLOAD"
+	ERR_NOT_A_PARTY       = "NOT_A_PARTY"
+	ERR_FUNCTION_RETIRED  = "FUNCTION_RETIRED"
+
+	//Rules of validateNewUFA and createUFA
+	ERR_NOT_AUTHORIZED          = "NOT_AUTHORIZED"
+	ERR_INVALID_NET_CHARGE      = "INVALID_NET_CHARGE"
+	ERR_TOLERANCE_OUT_OF_RANGE  = "TOLERANCE_OUT_OF_RANGE"
+	ERR_INITIAL_STATUS          = "INITIAL_STATUS"
+	ERR_PARTY_MSP_MISSING       = "PARTY_MSP_MISSING"
+	ERR_CALLER_NOT_ON_AGREEMENT = "CALLER_NOT_ON_AGREEMENT"
+	ERR_UFA_NUMBER_MISMATCH     = "UFA_NUMBER_MISMATCH"
+	ERR_UFA_EXISTS              = "UFA_EXISTS"
+	ERR_CURRENCY_MISSING        = "CURRENCY_MISSING"
+	ERR_INVALID_BATCH_LIMIT     = "INVALID_BATCH_LIMIT"
+	ERR_INVALID_FREQUENCY       = "INVALID_FREQUENCY"
+	ERR_INVALID_VALIDITY        = "INVALID_VALIDITY"
+	ERR_UFA_STILL_VALID         = "UFA_STILL_VALID"
+
+	//Rules of validateInvoiceDetails
+	ERR_INVOICE_COUNT            = "INVOICE_COUNT"
+	ERR_UFA_NUMBER_MISSING       = "UFA_NUMBER_MISSING"
+	ERR_UFA_NOT_FOUND            = "UFA_NOT_FOUND"
+	ERR_UFA_NOT_AGREED           = "UFA_NOT_AGREED"
+	ERR_CHARGES_EXHAUSTED        = "CHARGES_EXHAUSTED"
+	ERR_BILLING_PERIOD_MISSING   = "BILLING_PERIOD_MISSING"
+	ERR_INVALID_BILLING_PERIOD   = "INVALID_BILLING_PERIOD"
+	ERR_PERIOD_OUTSIDE_VALIDITY  = "PERIOD_OUTSIDE_VALIDITY"
+	ERR_PERIOD_IN_FUTURE         = "PERIOD_IN_FUTURE"
+	ERR_PERIOD_OUT_OF_SEQUENCE   = "PERIOD_OUT_OF_SEQUENCE"
+	ERR_PERIOD_ALREADY_INVOICED  = "PERIOD_ALREADY_INVOICED"
+	ERR_BATCH_MISMATCH           = "BATCH_MISMATCH"
+	ERR_DUPLICATE_INVOICE_NUMBER = "DUPLICATE_INVOICE_NUMBER"
+	ERR_RAISED_BY_MISMATCH       = "RAISED_BY_MISMATCH"
+	ERR_INVALID_INVOICE_STATUS   = "INVALID_INVOICE_STATUS"
+	ERR_NEGATIVE_INVOICE_AMOUNT  = "NEGATIVE_INVOICE_AMOUNT"
+	ERR_CHARGE_EXCEEDED          = "CHARGE_EXCEEDED"
+	ERR_CURRENCY_MISMATCH        = "CURRENCY_MISMATCH"
+	ERR_NO_ORIGINAL_BATCH        = "NO_ORIGINAL_BATCH"
+	ERR_BATCH_LIMIT_REACHED      = "BATCH_LIMIT_REACHED"
+	ERR_INVALID_SIDE             = "INVALID_SIDE"
+	ERR_BATCH_PAIRING            = "BATCH_PAIRING"
+	ERR_COPIES_DIVERGE           = "COPIES_DIVERGE"
+	ERR_INVALID_LINE_ITEM        = "INVALID_LINE_ITEM"
+	ERR_LINE_TOTAL_MISMATCH      = "LINE_TOTAL_MISMATCH"
+	ERR_UNKNOWN_TAX_CODE         = "UNKNOWN_TAX_CODE"
+	ERR_TAX_MISMATCH             = "TAX_MISMATCH"
+
+	//Exchange rate maintenance
+	ERR_INVALID_CURRENCY = "INVALID_CURRENCY"
+	ERR_INVALID_FX_RATE  = "INVALID_FX_RATE"
+
+	//Tax rule maintenance
+	ERR_INVALID_TAX_RULE = "INVALID_TAX_RULE"
+
+	//Field policy of updateUFA
+	ERR_FIELD_NOT_WRITABLE  = "FIELD_NOT_WRITABLE"
+	ERR_FIELD_NOT_UPDATABLE = "FIELD_NOT_UPDATABLE"
+
+	//Amendments of agreed charges
+	ERR_AMENDMENT_NOT_ALLOWED   = "AMENDMENT_NOT_ALLOWED"
+	ERR_AMENDMENT_PENDING       = "AMENDMENT_PENDING"
+	ERR_NO_PENDING_AMENDMENT    = "NO_PENDING_AMENDMENT"
+	ERR_NET_CHARGE_BELOW_RAISED = "NET_CHARGE_BELOW_RAISED"
+
+	//Rules of createCreditNote
+	ERR_INVOICE_NOT_FOUND     = "INVOICE_NOT_FOUND"
+	ERR_NOT_CREDITABLE        = "NOT_CREDITABLE"
+	ERR_INVALID_CREDIT_AMOUNT = "INVALID_CREDIT_AMOUNT"
+	ERR_CREDIT_EXCEEDED       = "CREDIT_EXCEEDED"
+
+	//Ledger schema migrations
+	ERR_SCHEMA_TOO_NEW   = "SCHEMA_TOO_NEW"
+	ERR_MIGRATION_FAILED = "MIGRATION_FAILED"
+)
+
+//ChaincodeError Error envelope returned as the message of a failed invoke.
+//Validation failures list every broken rule in the details.
+type ChaincodeError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Field   string            `json:"field,omitempty"`
+	Details []*ChaincodeError `json:"details,omitempty"`
+}
+
+//Creates an error for a rule on a field, field may be empty
+func newChaincodeError(code string, field string, message string) *ChaincodeError {
+	return &ChaincodeError{Code: code, Field: field, Message: message}
+}
+
+//Error Message of the error followed by the messages of its details
+func (e *ChaincodeError) Error() string {
+	if len(e.Details) == 0 {
+		return e.Message
+	}
+	messages := make([]string, 0, len(e.Details))
+	for _, detail := range e.Details {
+		messages = append(messages, detail.Error())
+	}
+	return e.Message + ": " + strings.Join(messages, "; ")
+}
+
+//Returns the JSON envelope of the error
+func (e *ChaincodeError) toJSON() []byte {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	//Messages quote user input, keep it readable
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(e); err != nil {
+		return []byte(`{"code":"` + ERR_REQUEST_FAILED + `","message":"Unable to encode the error"}`)
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n")
+}
+
+//Wraps the broken rules of a validation into a single error, nil if there are none
+func validationFailure(message string, details []*ChaincodeError) error {
+	if len(details) == 0 {
+		return nil
+	}
+	return &ChaincodeError{Code: ERR_VALIDATION_FAILED, Message: message, Details: details}
+}
+
+//Converts any error into the envelope, plain errors become REQUEST_FAILED
+func toChaincodeError(err error) *ChaincodeError {
+	if chaincodeErr, ok := err.(*ChaincodeError); ok {
+		return chaincodeErr
+	}
+	return newChaincodeError(ERR_REQUEST_FAILED, "", err.Error())
+}
+
+//validationResult Answer of the validate queries
+type validationResult struct {
+	Validation string          `json:"validation"`
+	Msg        string          `json:"msg"`
+	Error      *ChaincodeError `json:"error,omitempty"`
+}
+
+//Returns the answer of a validate query for the outcome of a validation
+func toValidationResult(err error) []byte {
+	result := validationResult{Validation: "Success"}
+	if err != nil {
+		result.Validation = "Failure"
+		result.Error = toChaincodeError(err)
+		result.Msg = result.Error.Error()
+	}
+	resultBytes, _ := json.Marshal(result)
+	return resultBytes
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//Names of the chaincode events
+const (
+	EVENT_UFA_CREATED     = "UFACreated"
+	EVENT_UFA_UPDATED     = "UFAUpdated"
+	EVENT_INVOICES_RAISED = "InvoicesRaised"
+	EVENT_INVOICE_UPDATED = "InvoiceUpdated"
+	EVENT_UFA_EXHAUSTED   = "UFAExhausted"
+
+	EVENT_AMENDMENT_PROPOSED = "AmendmentProposed"
+	EVENT_AMENDMENT_ACCEPTED = "AmendmentAccepted"
+	EVENT_AMENDMENT_REJECTED = "AmendmentRejected"
+	EVENT_CREDIT_NOTE_ISSUED = "CreditNoteIssued"
+)
+
+//UFAEvent Payload of the chaincode events, the status is the one of the UFA
+//or invoice the event is about. Fabric keeps a single event per transaction,
+//so a batch exhausting its UFA is only announced as UFAExhausted and the
+//payload still lists the invoices raised.
+type UFAEvent struct {
+	UFANumber      string   `json:"ufanumber"`
+	BillingPeriod  string   `json:"billingPeriod,omitempty"`
+	Invoices       []string `json:"invoices,omitempty"`
+	Amount         *Money   `json:"amount,omitempty"`
+	RaisedInvTotal *Money   `json:"raisedInvTotal,omitempty"`
+	Status         string   `json:"status,omitempty"`
+	Amendment      int      `json:"amendment,omitempty"`
+	Actor          string   `json:"actor"`
+}
+
+//Returns the event for an UFA as it stands after the transaction
+func newUFAEvent(ufa *UFA, caller *Caller) UFAEvent {
+	raisedTotal := ufa.RaisedInvTotal
+	return UFAEvent{UFANumber: ufa.UFANumber, RaisedInvTotal: &raisedTotal, Status: ufa.Status, Actor: caller.Email}
+}
+
+//Sets the event of the transaction, replacing any set before
+func emitEvent(stub shim.ChaincodeStubInterface, name string, event UFAEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	logger.Info("Emitting " + name + " " + string(payload))
+	return stub.SetEvent(name, payload)
+}
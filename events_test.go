@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+//Invoke and the event it is expected to emit, none if the name is empty
+type eventStep struct {
+	caller  testIdentity
+	name    string
+	args    []string
+	event   string
+	payload UFAEvent
+}
+
+func TestInvokeEvents(t *testing.T) {
+	ufa := newTestUFA("UFA1")
+	total := func(amount int64) *Money {
+		money := whole(amount)
+		return &money
+	}
+	steps := []eventStep{
+		{seller, "createUFA", []string{"UFA1", toJSON(t, ufa)}, EVENT_UFA_CREATED,
+			UFAEvent{UFANumber: "UFA1", RaisedInvTotal: total(0), Status: STATUS_DRAFT, Actor: sellerEmail}},
+		{seller, "updateUFA", []string{"UFA1", `{"seller":{"name":"Shell Trading","mspid":"SellerMSP"}}`}, EVENT_UFA_UPDATED,
+			UFAEvent{UFANumber: "UFA1", RaisedInvTotal: total(0), Status: STATUS_DRAFT, Actor: sellerEmail}},
+		{seller, "submitUFA", []string{"UFA1"}, EVENT_UFA_UPDATED,
+			UFAEvent{UFANumber: "UFA1", RaisedInvTotal: total(0), Status: STATUS_PENDING_BUYER_APPROVAL, Actor: sellerEmail}},
+		{buyer, "approveUFA", []string{"UFA1"}, EVENT_UFA_UPDATED,
+			UFAEvent{UFANumber: "UFA1", RaisedInvTotal: total(0), Status: STATUS_AGREED, Actor: buyerEmail}},
+		{seller, "createInvoices", []string{toJSON(t, invoicePair("UFA1", "2017-10", 200))}, EVENT_INVOICES_RAISED,
+			UFAEvent{UFANumber: "UFA1", BillingPeriod: "2017-10", Invoices: []string{"S-2017-10", "B-2017-10"},
+				Amount: total(200), RaisedInvTotal: total(200), Status: STATUS_AGREED, Actor: sellerEmail}},
+		{buyer, "approveInvoice", []string{"S-2017-10"}, EVENT_INVOICE_UPDATED,
+			UFAEvent{UFANumber: "UFA1", BillingPeriod: "2017-10", Invoices: []string{"S-2017-10"},
+				Amount: total(200), Status: INVOICE_APPROVED, Actor: buyerEmail}},
+		{buyer, "rejectInvoice", []string{"B-2017-10", "Duplicate"}, EVENT_INVOICE_UPDATED,
+			UFAEvent{UFANumber: "UFA1", BillingPeriod: "2017-10", Invoices: []string{"B-2017-10"},
+				Amount: total(200), RaisedInvTotal: total(200), Status: INVOICE_REJECTED, Actor: buyerEmail}},
+		{seller, "createInvoices", []string{toJSON(t, invoicePair("UFA1", "2017-11", 900))}, EVENT_UFA_EXHAUSTED,
+			UFAEvent{UFANumber: "UFA1", BillingPeriod: "2017-11", Invoices: []string{"S-2017-11", "B-2017-11"},
+				Amount: total(900), RaisedInvTotal: total(1100), Status: STATUS_EXHAUSTED, Actor: sellerEmail}},
+		//Queries and failed invokes emit nothing
+		{seller, "getUFADetails", []string{"UFA1"}, "", UFAEvent{}},
+		{seller, "createInvoices", []string{toJSON(t, invoicePair("UFA1", "2017-12", 1))}, "", UFAEvent{}},
+	}
+	stub := newLedgerStub(t)
+	for _, step := range steps {
+		stub.setCaller(step.caller)
+		stub.invoke(step.name, step.args...)
+		if step.event == "" {
+			if stub.lastEvent != nil {
+				t.Fatalf("Expected %s to emit nothing, got %s", step.name, stub.lastEvent.EventName)
+			}
+			continue
+		}
+		if stub.lastEvent == nil || stub.lastEvent.EventName != step.event {
+			t.Fatalf("Expected %s to emit %s, got %v", step.name, step.event, stub.lastEvent)
+		}
+		if payload := toJSON(t, step.payload); string(stub.lastEvent.Payload) != payload {
+			t.Fatalf("Unexpected %s payload\n got %s\nwant %s", step.event, stub.lastEvent.Payload, payload)
+		}
+	}
+}
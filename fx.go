@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//FX_RATE_KEY_TYPE Composite key object type of exchange rates, fxrate~<from>~<to>
+const FX_RATE_KEY_TYPE = "fxrate"
+
+//RATE_DIGITS Decimal places kept for exchange rates
+const RATE_DIGITS = 6
+
+//ExchangeRate Units of the target currency per unit of the source currency,
+//in millionths. On the wire it is a decimal string.
+type ExchangeRate int64
+
+//FXRate Exchange rate maintained by an administrator
+type FXRate struct {
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	Rate  ExchangeRate `json:"rate"`
+	SetBy string       `json:"setBy"`
+	SetAt string       `json:"setAt"`
+}
+
+//Parses a decimal exchange rate
+func parseExchangeRate(value string) (ExchangeRate, error) {
+	scaled, err := parseDecimal(value, RATE_DIGITS)
+	if err != nil {
+		return 0, errors.New("invalid exchange rate: " + err.Error())
+	}
+	if scaled <= 0 {
+		return 0, errors.New("exchange rates must be positive")
+	}
+	return ExchangeRate(scaled), nil
+}
+
+//String Decimal exchange rate
+func (r ExchangeRate) String() string {
+	return formatDecimal(int64(r), RATE_DIGITS)
+}
+
+//MarshalJSON Writes the rate as a decimal string
+func (r ExchangeRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+//UnmarshalJSON Reads a rate written as a decimal string
+func (r *ExchangeRate) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("exchange rates must be decimal strings")
+	}
+	rate, err := parseExchangeRate(value)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+//Converts an amount into another currency at a rate, rounded half up to the
+//minor unit of the target currency
+func (r ExchangeRate) convert(amount Money, currency string) Money {
+	//units * rate * 10^targetDigits / (10^sourceDigits * 10^RATE_DIGITS)
+	numerator := new(big.Int).Mul(big.NewInt(amount.Units), big.NewInt(int64(r)))
+	numerator.Mul(numerator, pow10(minorDigits(currency)))
+	denominator := new(big.Int).Mul(pow10(minorDigits(amount.Currency)), pow10(RATE_DIGITS))
+	return Money{Units: divideRounded(numerator, denominator), Currency: currency}
+}
+
+//Divides two positive or negative integers rounding half away from zero
+func divideRounded(numerator *big.Int, denominator *big.Int) int64 {
+	negative := numerator.Sign() < 0
+	numerator = new(big.Int).Abs(numerator)
+	quotient, remainder := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+	if remainder.Mul(remainder, big.NewInt(2)).Cmp(denominator) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if negative {
+		quotient.Neg(quotient)
+	}
+	return quotient.Int64()
+}
+
+//Returns 10^n
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+//Returns the ledger key of an exchange rate
+func fxRateKey(stub shim.ChaincodeStubInterface, from string, to string) (string, error) {
+	return stub.CreateCompositeKey(FX_RATE_KEY_TYPE, []string{from, to})
+}
+
+//Reads an exchange rate from the ledger, nil if none is recorded
+func getFXRate(stub shim.ChaincodeStubInterface, from string, to string) (*FXRate, error) {
+	key, err := fxRateKey(stub, from, to)
+	if err != nil {
+		return nil, err
+	}
+	recBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var rate FXRate
+	if err := decodeStrict(recBytes, &rate); err != nil {
+		return nil, errors.New("Corrupt exchange rate " + from + "/" + to + ": " + err.Error())
+	}
+	return &rate, nil
+}
+
+//Records the exchange rate between two currencies, administrators only.
+//Arguments are the source currency, target currency and rate
+func setFXRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("setFXRate called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !caller.isAdmin() {
+		return nil, newChaincodeError(ERR_NOT_AUTHORIZED, "", "User "+caller.Email+" is not allowed to maintain exchange rates")
+	}
+	from, to := args[0], args[1]
+	if !isCurrencyCode(from) || !isCurrencyCode(to) || from == to {
+		return nil, newChaincodeError(ERR_INVALID_CURRENCY, "", "Exchange rates are between two different ISO currency codes, got "+from+" and "+to)
+	}
+	rate, err := parseExchangeRate(args[2])
+	if err != nil {
+		return nil, newChaincodeError(ERR_INVALID_FX_RATE, "rate", err.Error())
+	}
+	setAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	key, err := fxRateKey(stub, from, to)
+	if err != nil {
+		return nil, err
+	}
+	rateBytes, err := json.Marshal(FXRate{From: from, To: to, Rate: rate, SetBy: caller.Email, SetAt: setAt})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("setFXRate " + from + "/" + to + " at " + rate.String())
+	return nil, stub.PutState(key, rateBytes)
+}
+
+//Returns all the recorded exchange rates
+func getFXRates(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	logger.Info("getFXRates called")
+	values, err := getStateByPartialKey(stub, FX_RATE_KEY_TYPE, []string{})
+	if err != nil {
+		return nil, err
+	}
+	rates := make([]FXRate, 0, len(values))
+	for _, value := range values {
+		var rate FXRate
+		if err := decodeStrict(value, &rate); err != nil {
+			return nil, errors.New("Corrupt exchange rate: " + err.Error())
+		}
+		rates = append(rates, rate)
+	}
+	return json.Marshal(rates)
+}
+
+//Brings an invoice into the currency of its UFA. Amounts without a currency
+//are taken to be in it, amounts in another currency are converted at the
+//recorded rate which is captured on the invoice.
+func convertInvoice(stub shim.ChaincodeStubInterface, ufa *UFA, invoice *Invoice) *ChaincodeError {
+	invoice.FXRate = 0
+	invoice.ConvertedAmt = nil
+	amount := invoice.InvoiceAmt
+	if ufa.Currency == "" {
+		if amount.Currency != "" {
+			return newChaincodeError(ERR_CURRENCY_MISMATCH, "invoiceAmt", "Invoice "+invoice.InvoiceNumber+" is in "+amount.Currency+" but UFA "+ufa.UFANumber+" has no currency")
+		}
+		return nil
+	}
+	if amount.Currency == "" || amount.Currency == ufa.Currency {
+		converted, err := amount.withCurrency(ufa.Currency)
+		if err != nil {
+			return newChaincodeError(ERR_INVALID_PAYLOAD, "invoiceAmt", "Invalid amount in invoice "+invoice.InvoiceNumber+": "+err.Error())
+		}
+		invoice.InvoiceAmt = converted
+		return nil
+	}
+	rate, err := getFXRate(stub, amount.Currency, ufa.Currency)
+	if err != nil {
+		return toChaincodeError(err)
+	}
+	if rate == nil {
+		return newChaincodeError(ERR_CURRENCY_MISMATCH, "invoiceAmt", "Invoice "+invoice.InvoiceNumber+" is in "+amount.Currency+", UFA "+ufa.UFANumber+" is in "+ufa.Currency+" and no exchange rate is recorded")
+	}
+	converted := rate.Rate.convert(amount, ufa.Currency)
+	invoice.FXRate = rate.Rate
+	invoice.ConvertedAmt = &converted
+	return nil
+}
+
+//Returns the amount of an invoice in the currency of its UFA
+func agreementAmount(invoice *Invoice) Money {
+	if invoice.ConvertedAmt != nil {
+		return *invoice.ConvertedAmt
+	}
+	return invoice.InvoiceAmt
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+var admin = testIdentity{mspID: "OperatorMSP", email: "admin@shell.com", role: ROLE_ADMIN}
+
+func TestExchangeRateConvert(t *testing.T) {
+	tests := []struct {
+		amount   string
+		from     string
+		rate     string
+		to       string
+		expected string
+	}{
+		{"100", "EUR", "1.0825", "USD", "108.25 USD"},
+		{"1000", "JPY", "0.006712", "USD", "6.71 USD"},
+		//0.005 is rounded half up
+		{"0.01", "USD", "0.5", "EUR", "0.01 EUR"},
+		{"10", "USD", "151.2", "JPY", "1512 JPY"},
+		{"-10", "EUR", "1.1", "USD", "-11.00 USD"},
+	}
+	for _, test := range tests {
+		amount, _ := parseMoney(test.amount, test.from)
+		rate, err := parseExchangeRate(test.rate)
+		if err != nil {
+			t.Fatalf("Unable to parse rate %s: %v", test.rate, err)
+		}
+		if converted := rate.convert(amount, test.to).String(); converted != test.expected {
+			t.Errorf("Expected %s %s at %s to be %s, got %s", test.amount, test.from, test.rate, test.expected, converted)
+		}
+	}
+}
+
+func TestInvoicesInAnotherCurrency(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	euros := invoicePair("UFA1", "2017-10", 0)
+	euros[0].InvoiceAmt = Money{Units: 10000, Currency: "EUR"}
+	euros[1].InvoiceAmt = Money{Units: 10000, Currency: "EUR"}
+
+	err := responseError(t, stub.invoke("createInvoices", toJSON(t, euros)))
+	if !hasDetail(err, ERR_CURRENCY_MISMATCH, "no exchange rate is recorded") {
+		t.Fatalf("Expected euro invoices to be refused without a rate, got %+v", err)
+	}
+	err = responseError(t, stub.invoke("setFXRate", "EUR", "USD", "1.1"))
+	if err.Code != ERR_NOT_AUTHORIZED {
+		t.Fatalf("Expected the seller not to maintain rates, got %+v", err)
+	}
+	stub.setCaller(admin)
+	for _, args := range [][]string{{"EUR", "EUR", "1"}, {"EUR", "usd", "1"}, {"EUR", "USD", "0"}, {"EUR", "USD", "1.1234567"}} {
+		if res := stub.invoke("setFXRate", args...); res.Status == shim.OK {
+			t.Fatalf("Expected rate %v to be refused", args)
+		}
+	}
+	stub.mustInvoke("setFXRate", "EUR", "USD", "1.1")
+	var rates []FXRate
+	json.Unmarshal(stub.mustInvoke("getFXRates"), &rates)
+	if len(rates) != 1 || rates[0].Rate.String() != "1.100000" || rates[0].SetBy != admin.email {
+		t.Fatalf("Expected the recorded EUR/USD rate, got %+v", rates)
+	}
+
+	stub.setCaller(seller)
+	stub.mustInvoke("createInvoices", toJSON(t, euros))
+	if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != whole(110) {
+		t.Fatalf("Expected the converted amount to be booked, got %s", ufa.RaisedInvTotal)
+	}
+	invoice := readInvoice(t, stub, "UFA1", "S-2017-10")
+	if invoice.InvoiceAmt.String() != "100.00 EUR" || invoice.FXRate.String() != "1.100000" || invoice.ConvertedAmt == nil || *invoice.ConvertedAmt != whole(110) {
+		t.Fatalf("Expected the rate to be captured on the invoice, got %+v", invoice)
+	}
+
+	//A later rate does not change invoices already raised
+	stub.setCaller(admin)
+	stub.mustInvoke("setFXRate", "EUR", "USD", "1.2")
+	stub.setCaller(buyer)
+	stub.mustInvoke("rejectInvoice", "S-2017-10", "Wrong rate")
+	if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != whole(0) {
+		t.Fatalf("Expected the booked amount to be withdrawn, got %s", ufa.RaisedInvTotal)
+	}
+}
+
+func TestInvoiceCurrencyOfLegacyUFA(t *testing.T) {
+	stub := newLedgerStub(t)
+	legacy := newTestUFA("UFA1")
+	mustCreateUFA(t, stub, legacy)
+	ufa := readUFA(t, stub, "UFA1")
+	ufa.Currency, ufa.NetCharge.Currency, ufa.RaisedInvTotal.Currency = "", "", ""
+	stub.MockTransactionStart("legacy")
+	key, _ := ufaKey(stub, "UFA1")
+	ufaBytes, _ := json.Marshal(ufa)
+	stub.MockStub.PutState(key, ufaBytes)
+	stub.MockTransactionEnd("legacy")
+
+	err := responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 100))))
+	if !hasDetail(err, ERR_CURRENCY_MISMATCH, "UFA UFA1 has no currency") {
+		t.Fatalf("Expected invoices in a currency to be refused on a legacy UFA, got %+v", err)
+	}
+	pair := invoicePair("UFA1", "2017-10", 0)
+	pair[0].InvoiceAmt, pair[1].InvoiceAmt = Money{Units: 10000}, Money{Units: 10000}
+	stub.mustInvoke("createInvoices", toJSON(t, pair))
+	if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != (Money{Units: 10000}) {
+		t.Fatalf("Expected the legacy UFA to keep booking plain amounts, got %s", ufa.RaisedInvTotal)
+	}
+}
+
+func TestAdminOnlyFromOperatorMSP(t *testing.T) {
+	stub := newLedgerStub(t)
+	//Any organisation's CA can issue the role attribute
+	stub.setCaller(testIdentity{mspID: seller.mspID, email: "admin@seller.com", role: ROLE_ADMIN})
+	for function, args := range map[string][]string{
+		"setFXRate":      {"EUR", "USD", "1.1"},
+		"setTaxRule":     {"VAT", "2017-01-01", "0"},
+		"migrateLedger":  nil,
+		"planMigrations": nil,
+	} {
+		if err := responseError(t, stub.invoke(function, args...)); err.Code != ERR_NOT_AUTHORIZED {
+			t.Errorf("Expected %s to refuse an administrator of %s, got %+v", function, seller.mspID, err)
+		}
+	}
+	stub.setCaller(admin)
+	stub.mustInvoke("setFXRate", "EUR", "USD", "1.1")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//HISTORY_KEY_TYPE Composite key object type of UFA history entries, ufahistory~<ufanumber>~<timestamp>~<txid>
+const HISTORY_KEY_TYPE = "ufahistory"
+
+//Sortable layout of the timestamp in history keys
+const historyKeyTime = "2006-01-02T15:04:05.000000000Z"
+
+//HistoryEntry Change made to an UFA by a transaction. There is one entry per
+//UFA and transaction.
+type HistoryEntry struct {
+	UFANumber string        `json:"ufanumber"`
+	TxID      string        `json:"txId"`
+	Timestamp string        `json:"timestamp"`
+	Actor     string        `json:"actor"`
+	Operation string        `json:"operation"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+//FieldChange Value of a field before and after a change, null when absent
+type FieldChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+//Returns the fields which differ between two field maps in path order.
+//Objects are compared field by field and reported with dotted paths, any
+//other value including an array is reported as a whole.
+func diffFields(before map[string]interface{}, after map[string]interface{}, prefix string) []FieldChange {
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	for name := range before {
+		if _, found := after[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := make([]FieldChange, 0)
+	for _, name := range names {
+		oldValue, newValue := before[name], after[name]
+		oldObject, oldIsObject := oldValue.(map[string]interface{})
+		newObject, newIsObject := newValue.(map[string]interface{})
+		if oldIsObject && newIsObject {
+			changes = append(changes, diffFields(oldObject, newObject, prefix+name+".")...)
+		} else if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, FieldChange{Path: prefix + name, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
+
+//Returns the fields which differ between two versions of an UFA, before is nil for a new UFA
+func diffUFA(before *UFA, after *UFA) ([]FieldChange, error) {
+	beforeFields := make(map[string]interface{})
+	if before != nil {
+		var err error
+		if beforeFields, err = toFieldMap(before); err != nil {
+			return nil, err
+		}
+	}
+	afterFields, err := toFieldMap(after)
+	if err != nil {
+		return nil, err
+	}
+	return diffFields(beforeFields, afterFields, ""), nil
+}
+
+//Records the change made to an UFA by the running transaction under the
+//name of the invoked function
+func recordUFAHistory(stub shim.ChaincodeStubInterface, caller *Caller, before *UFA, after *UFA) error {
+	changes, err := diffUFA(before, after)
+	if err != nil {
+		return err
+	}
+	return recordUFAChanges(stub, caller, after.UFANumber, changes)
+}
+
+//Returns the fields which differ between two versions of an invoice,
+//under invoices.<number>. as they are recorded on the history of its UFA
+func diffInvoice(before *Invoice, after *Invoice) ([]FieldChange, error) {
+	beforeFields, err := toFieldMap(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := toFieldMap(after)
+	if err != nil {
+		return nil, err
+	}
+	return diffFields(beforeFields, afterFields, "invoices."+after.InvoiceNumber+"."), nil
+}
+
+//Records the change made to an UFA and one of its invoices by the running
+//transaction as a single entry, followed by the changes of any other invoice
+//moved with it
+func recordInvoiceChange(stub shim.ChaincodeStubInterface, caller *Caller, beforeUFA *UFA, ufa *UFA, beforeInvoice *Invoice, invoice *Invoice, otherChanges ...FieldChange) error {
+	changes, err := diffUFA(beforeUFA, ufa)
+	if err != nil {
+		return err
+	}
+	invoiceChanges, err := diffInvoice(beforeInvoice, invoice)
+	if err != nil {
+		return err
+	}
+	changes = append(changes, invoiceChanges...)
+	return recordUFAChanges(stub, caller, ufa.UFANumber, append(changes, otherChanges...))
+}
+
+//Records a change set on the history of an UFA
+func recordUFAChanges(stub shim.ChaincodeStubInterface, caller *Caller, ufanumber string, changes []FieldChange) error {
+	record, err := newHistoryRecord(stub, caller.Email, ufanumber, changes)
+	if err != nil {
+		return err
+	}
+	operation, _ := stub.GetFunctionAndParameters()
+	logger.Info("Recording " + operation + " in the history of " + ufanumber)
+	return stub.PutState(record.Key, record.Value)
+}
+
+//Returns the history entry of the running transaction on an UFA as a ledger record
+func newHistoryRecord(stub shim.ChaincodeStubInterface, actor string, ufanumber string, changes []FieldChange) (ledgerRecord, error) {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return ledgerRecord{}, err
+	}
+	operation, _ := stub.GetFunctionAndParameters()
+	entry := HistoryEntry{
+		UFANumber: ufanumber,
+		TxID:      stub.GetTxID(),
+		Timestamp: txTime.Format(time.RFC3339Nano),
+		Actor:     actor,
+		Operation: operation,
+		Changes:   changes,
+	}
+	key, err := stub.CreateCompositeKey(HISTORY_KEY_TYPE, []string{ufanumber, txTime.Format(historyKeyTime), entry.TxID})
+	if err != nil {
+		return ledgerRecord{}, err
+	}
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return ledgerRecord{}, err
+	}
+	return ledgerRecord{Key: key, Value: entryBytes}, nil
+}
+
+//Returns the history of an UFA, oldest first
+func getUFAHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("getUFAHistory called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber := lastArg(args)
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	values, err := getStateByPartialKey(stub, HISTORY_KEY_TYPE, []string{ufanumber})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0, len(values))
+	for _, value := range values {
+		var entry HistoryEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return nil, errors.New("Corrupt history entry of " + ufanumber + ": " + err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return json.Marshal(entries)
+}
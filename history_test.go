@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//Reads the history of an UFA through the getUFAHistory query
+func readHistory(t *testing.T, stub *ledgerStub, ufanumber string) []HistoryEntry {
+	t.Helper()
+	var entries []HistoryEntry
+	if err := json.Unmarshal(stub.mustInvoke("getUFAHistory", ufanumber), &entries); err != nil {
+		t.Fatalf("Unable to parse the history of %s: %v", ufanumber, err)
+	}
+	return entries
+}
+
+//Returns the change of a field in a history entry, nil if it did not change
+func findChange(entry HistoryEntry, path string) *FieldChange {
+	for i := range entry.Changes {
+		if entry.Changes[i].Path == path {
+			return &entry.Changes[i]
+		}
+	}
+	return nil
+}
+
+func TestUFAHistory(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.setCaller(buyer)
+	stub.mustInvoke("updateUFA", "UFA1", `{"buyer":{"name":"Customer Ltd"}}`)
+	stub.setCaller(seller)
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+	for key := range stub.lastWriteSet {
+		if strings.HasPrefix(key, "UFA_TRXN_HISTORY_") {
+			t.Fatalf("Expected no history arrays to be written, got %s", key)
+		}
+	}
+
+	entries := readHistory(t, stub, "UFA1")
+	expected := []struct {
+		operation string
+		actor     string
+	}{
+		{"createUFA", sellerEmail},
+		{"submitUFA", sellerEmail},
+		{"approveUFA", buyerEmail},
+		{"updateUFA", buyerEmail},
+		{"createInvoices", sellerEmail},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d history entries, got %+v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		if entry.Operation != expected[i].operation || entry.Actor != expected[i].actor || entry.UFANumber != "UFA1" || entry.TxID == "" {
+			t.Fatalf("Unexpected history entry %d: %+v", i, entry)
+		}
+		if i > 0 && entry.Timestamp <= entries[i-1].Timestamp {
+			t.Fatalf("History is not in time order: %s after %s", entry.Timestamp, entries[i-1].Timestamp)
+		}
+	}
+	if change := findChange(entries[0], "netCharge"); change == nil || change.Old != nil || change.New == nil {
+		t.Fatalf("Expected the creation to add the net charge, got %+v", entries[0].Changes)
+	}
+	if change := findChange(entries[2], "status"); change == nil || change.Old != STATUS_PENDING_BUYER_APPROVAL || change.New != STATUS_AGREED {
+		t.Fatalf("Expected the approval to change the status, got %+v", entries[2].Changes)
+	}
+	if len(entries[3].Changes) != 1 || entries[3].Changes[0].Path != "buyer.name" {
+		t.Fatalf("Expected the update to only change the buyer, got %+v", entries[3].Changes)
+	}
+	if change := findChange(entries[4], "invoicePeriods"); change == nil || !reflect.DeepEqual(change.New, map[string]interface{}{"2017-10": "S-2017-10,B-2017-10,"}) {
+		t.Fatalf("Expected the invoices to mark the billing period, got %+v", entries[4].Changes)
+	}
+
+	stub.setCaller(outsider)
+	if err := responseError(t, stub.invoke("getUFAHistory", "UFA1")); err.Code != ERR_NOT_A_PARTY {
+		t.Fatalf("Expected an outsider to be refused the history, got %+v", err)
+	}
+}
+
+func TestUpdateFieldsMerge(t *testing.T) {
+	existing := map[string]interface{}{
+		"name":    "Shell",
+		"count":   float64(2),
+		"active":  true,
+		"note":    "obsolete",
+		"lines":   []interface{}{"a", "b"},
+		"address": map[string]interface{}{"city": "London", "zip": "E1"},
+		"contact": "ops@shell.com",
+	}
+	patch := map[string]interface{}{
+		"count":   float64(3),
+		"active":  false,
+		"note":    nil,
+		"lines":   []interface{}{"c"},
+		"address": map[string]interface{}{"zip": "E2", "country": nil},
+		"contact": map[string]interface{}{"email": "ops@shell.com"},
+	}
+	before, _ := json.Marshal(existing)
+	merged, err := updateFields(existing, patch)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	expected := `{"active":false,"address":{"city":"London","zip":"E2"},"contact":{"email":"ops@shell.com"},"count":3,"lines":["c"],"name":"Shell"}`
+	if mergedBytes, _ := json.Marshal(merged); string(mergedBytes) != expected {
+		t.Fatalf("Unexpected merge\n got %s\nwant %s", mergedBytes, expected)
+	}
+
+	var original map[string]interface{}
+	json.Unmarshal(before, &original)
+	changes, _ := json.Marshal(diffFields(original, merged, ""))
+	expectedChanges := `[{"path":"active","old":true,"new":false},{"path":"address.zip","old":"E1","new":"E2"},` +
+		`{"path":"contact","old":"ops@shell.com","new":{"email":"ops@shell.com"}},{"path":"count","old":2,"new":3},` +
+		`{"path":"lines","old":["a","b"],"new":["c"]},{"path":"note","old":"obsolete","new":null}]`
+	if string(changes) != expectedChanges {
+		t.Fatalf("Unexpected change set\n got %s\nwant %s", changes, expectedChanges)
+	}
+}
+
+func TestUFAUpdatesAudited(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("updateUFA", "UFA1", `{"seller":{"address":"London"},"sellerApprover":{"name":null}}`)
+	stub.mustInvoke("updateUFA", "UFA1", `{"seller":{"address":"London"}}`)
+
+	entries := readHistory(t, stub, "UFA1")
+	update := entries[len(entries)-1]
+	if change := findChange(update, "seller.address"); change == nil || change.Old != nil || change.New != "London" {
+		t.Fatalf("Expected the seller address to be added, got %+v", update.Changes)
+	}
+	if change := findChange(update, "sellerApprover.name"); change == nil || change.Old != "Seller" || change.New != nil {
+		t.Fatalf("Expected the approver name to be deleted, got %+v", update.Changes)
+	}
+	//A patch changing nothing writes no record, history entry or event
+	if len(stub.lastWriteSet) != 0 || stub.lastEvent != nil {
+		t.Fatalf("Expected an unchanged UFA to be left alone, got %v and %v", stub.lastWriteSet, stub.lastEvent)
+	}
+}
+
+func TestInvoiceLifecycleAudited(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveInvoice", "S-2017-10")
+	stub.setCaller(seller)
+	stub.mustInvoke("markInvoicePaid", "S-2017-10", "PAY-1")
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-11", 100)))
+	stub.mustInvoke("cancelInvoice", "S-2017-11")
+
+	entries := readHistory(t, stub, "UFA1")
+	approval, payment, cancellation := entries[len(entries)-4], entries[len(entries)-3], entries[len(entries)-1]
+	if change := findChange(approval, "invoices.S-2017-10.status"); approval.Operation != "approveInvoice" || approval.Actor != buyerEmail ||
+		change == nil || change.Old != INVOICE_RAISED || change.New != INVOICE_APPROVED {
+		t.Fatalf("Expected the approval to be audited, got %+v", approval)
+	}
+	if change := findChange(approval, "invoices.S-2017-10.approvedBy"); change == nil || change.New != buyerEmail {
+		t.Fatalf("Expected the approval to record the approver, got %+v", approval.Changes)
+	}
+	if change := findChange(payment, "invoices.S-2017-10.paymentReference"); payment.Operation != "markInvoicePaid" || change == nil || change.New != "PAY-1" {
+		t.Fatalf("Expected the payment to be audited, got %+v", payment)
+	}
+	//A withdrawal is a single entry with the change to the UFA, the invoice and its buyer copy
+	if cancellation.Operation != "cancelInvoice" || findChange(cancellation, "invoices.S-2017-11.status") == nil || findChange(cancellation, "raisedInvTotal.amount") == nil {
+		t.Fatalf("Expected the cancellation to audit the invoice and the UFA, got %+v", cancellation)
+	}
+	if change := findChange(cancellation, "invoices.B-2017-11.status"); change == nil || change.New != INVOICE_CANCELLED {
+		t.Fatalf("Expected the cancellation to audit the buyer copy, got %+v", cancellation.Changes)
+	}
+}
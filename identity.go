@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//EMAIL_ATTRIBUTE Certificate attribute holding the email id of the caller
+const EMAIL_ATTRIBUTE = "email"
+
+//ROLE_ATTRIBUTE Certificate attribute holding the business role of the caller
+const ROLE_ATTRIBUTE = "ufa.role"
+
+//ROLE_SELLER Role attribute value of seller side users
+const ROLE_SELLER = "SELLER"
+
+//ROLE_BUYER Role attribute value of buyer side users
+const ROLE_BUYER = "BUYER"
+
+//ROLE_ADMIN Role attribute value of the administrators maintaining reference data
+const ROLE_ADMIN = "ADMIN"
+
+//OPERATOR_MSP Organisation running the network, only its administrators are
+//trusted as every organisation's CA can issue the role attribute. Set at
+//build time with go build -ldflags "-X main.OPERATOR_MSP=<mspid>".
+var OPERATOR_MSP = "OperatorMSP"
+
+//Caller Submitter of the transaction as stated by its certificate
+type Caller struct {
+	MSPID string
+	Email string
+	Role  string
+}
+
+//Sides of an agreement, naming who proposed an amendment or whose copy an invoice is
+const (
+	SIDE_SELLER = "seller"
+	SIDE_BUYER  = "buyer"
+)
+
+//Checks if the caller administers the reference data and the ledger
+func (c *Caller) isAdmin() bool {
+	return c.MSPID == OPERATOR_MSP && c.Role == ROLE_ADMIN
+}
+
+//UFARoles Roles a caller holds on a particular UFA
+type UFARoles struct {
+	Seller         bool
+	Buyer          bool
+	SellerApprover bool
+	BuyerApprover  bool
+}
+
+//Derives the caller from the creator certificate of the transaction
+func getCaller(stub shim.ChaincodeStubInterface) (*Caller, error) {
+	identity, err := cid.New(stub)
+	if err != nil {
+		return nil, errors.New("Unable to read the caller identity: " + err.Error())
+	}
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return nil, errors.New("Unable to read the caller MSP: " + err.Error())
+	}
+	email, found, err := identity.GetAttributeValue(EMAIL_ATTRIBUTE)
+	if err != nil {
+		return nil, errors.New("Unable to read the caller attributes: " + err.Error())
+	}
+	if !found {
+		//Certificates enrolled without the attribute may still carry the email as a SAN
+		cert, err := identity.GetX509Certificate()
+		if err == nil && cert != nil && len(cert.EmailAddresses) > 0 {
+			email = cert.EmailAddresses[0]
+		}
+	}
+	if email == "" {
+		return nil, errors.New("Caller certificate does not carry an email id")
+	}
+	role, _, err := identity.GetAttributeValue(ROLE_ATTRIBUTE)
+	if err != nil {
+		return nil, errors.New("Unable to read the caller attributes: " + err.Error())
+	}
+	return &Caller{MSPID: mspID, Email: email, Role: role}, nil
+}
+
+//Maps the caller to the roles it holds on an UFA
+func (c *Caller) rolesOn(ufa *UFA) UFARoles {
+	var roles UFARoles
+	if ufa == nil {
+		return roles
+	}
+	if c.MSPID == ufa.Seller.MSPID {
+		roles.Seller = c.Role == ROLE_SELLER
+		roles.SellerApprover = c.Email == ufa.SellerApprover.EmailID
+	}
+	if c.MSPID == ufa.Buyer.MSPID {
+		roles.Buyer = c.Role == ROLE_BUYER
+		roles.BuyerApprover = c.Email == ufa.BuyerApprover.EmailID
+	}
+	return roles
+}
+
+//Checks if the caller is a party to the agreement in any role
+func (r UFARoles) onAgreement() bool {
+	return r.Seller || r.Buyer || r.SellerApprover || r.BuyerApprover
+}
+
+//Returns the side of the agreement the caller acts for
+func (r UFARoles) side() string {
+	if r.sellerSide() {
+		return SIDE_SELLER
+	}
+	if r.buyerSide() {
+		return SIDE_BUYER
+	}
+	return ""
+}
+
+//Rejects callers who are not a party to the agreement
+func authorizeOnUFA(caller *Caller, ufa *UFA) error {
+	if !caller.rolesOn(ufa).onAgreement() {
+		return newChaincodeError(ERR_NOT_A_PARTY, "", "User "+caller.Email+" of "+caller.MSPID+" is not a party to UFA "+ufa.UFANumber)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//UFA_KEY_TYPE Composite key object type of UFA records, ufa~<ufanumber>
+const UFA_KEY_TYPE = "ufa"
+
+//INVOICE_KEY_TYPE Composite key object type of invoice records, invoice~<ufanumber>~<billingPeriod>~<invoiceNumber>
+const INVOICE_KEY_TYPE = "invoice"
+
+//INVOICE_NUMBER_KEY_TYPE Composite key object type of the index from an invoice number to its record key
+const INVOICE_NUMBER_KEY_TYPE = "invoicenumber"
+
+//Returns the transaction timestamp set by the client, identical on every endorser
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Unable to read the transaction timestamp: " + err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+//Returns the transaction timestamp as recorded on the ledger, every record
+//stamped in a transaction carries the same time whichever peer endorses it
+func getTxTimestamp(stub shim.ChaincodeStubInterface) (string, error) {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	return txTime.Format(time.RFC3339), nil
+}
+
+//Returns the day of the transaction, every endorser agrees on it
+func getTxDate(stub shim.ChaincodeStubInterface) (string, error) {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	return txTime.Format(DATE_LAYOUT), nil
+}
+
+//Returns the ledger key of an UFA
+func ufaKey(stub shim.ChaincodeStubInterface, ufanumber string) (string, error) {
+	return stub.CreateCompositeKey(UFA_KEY_TYPE, []string{ufanumber})
+}
+
+//Returns the ledger key of an invoice
+func invoiceKey(stub shim.ChaincodeStubInterface, invoice *Invoice) (string, error) {
+	return stub.CreateCompositeKey(INVOICE_KEY_TYPE, []string{invoice.UFANumber, invoice.BillingPeriod, invoice.InvoiceNumber})
+}
+
+//Returns the ledger key of the invoice number index entry
+func invoiceNumberKey(stub shim.ChaincodeStubInterface, invoiceNumber string) (string, error) {
+	return stub.CreateCompositeKey(INVOICE_NUMBER_KEY_TYPE, []string{invoiceNumber})
+}
+
+//Reads the values of all the records under a partial composite key
+func getStateByPartialKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string) ([][]byte, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+	values := make([][]byte, 0)
+	for iterator.HasNext() {
+		record, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, record.Value)
+	}
+	return values, nil
+}
+
+//ledgerRecord Record read with its key
+type ledgerRecord struct {
+	Key   string
+	Value []byte
+}
+
+//Reads all the records under a partial composite key with their keys
+func getRecordsByPartialKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string) ([]ledgerRecord, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+	records := make([]ledgerRecord, 0)
+	for iterator.HasNext() {
+		record, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, ledgerRecord{Key: record.Key, Value: record.Value})
+	}
+	return records, nil
+}
+
+//Reads an UFA from the ledger, nil if it does not exist
+func getUFA(stub shim.ChaincodeStubInterface, ufanumber string) (*UFA, error) {
+	key, err := ufaKey(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	recBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	ufa, err := parseUFA(recBytes)
+	if err != nil {
+		return nil, errors.New("Corrupt UFA record " + ufanumber + ": " + err.Error())
+	}
+	return &ufa, nil
+}
+
+//Writes an UFA to the ledger
+func putUFA(stub shim.ChaincodeStubInterface, ufa *UFA) error {
+	key, err := ufaKey(stub, ufa.UFANumber)
+	if err != nil {
+		return err
+	}
+	ufaBytes, err := json.Marshal(ufa)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, ufaBytes)
+}
+
+//Returns all the UFAs in ledger key order
+func getAllUFARecords(stub shim.ChaincodeStubInterface) ([]UFA, error) {
+	values, err := getStateByPartialKey(stub, UFA_KEY_TYPE, []string{})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]UFA, 0, len(values))
+	for _, value := range values {
+		ufa, err := parseUFA(value)
+		if err != nil {
+			return nil, errors.New("Corrupt UFA record: " + err.Error())
+		}
+		records = append(records, ufa)
+	}
+	return records, nil
+}
+
+//Reads an invoice from the ledger by its number, nil if it does not exist
+func getInvoice(stub shim.ChaincodeStubInterface, invoiceNumber string) (*Invoice, error) {
+	indexKey, err := invoiceNumberKey(stub, invoiceNumber)
+	if err != nil {
+		return nil, err
+	}
+	key, err := stub.GetState(indexKey)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, nil
+	}
+	recBytes, err := stub.GetState(string(key))
+	if err != nil {
+		return nil, err
+	}
+	if recBytes == nil {
+		return nil, errors.New("Invoice index points to a missing record for " + invoiceNumber)
+	}
+	invoice, err := parseInvoice(recBytes)
+	if err != nil {
+		return nil, errors.New("Corrupt invoice record " + invoiceNumber + ": " + err.Error())
+	}
+	return &invoice, nil
+}
+
+//Writes an invoice and its invoice number index entry to the ledger
+func putInvoice(stub shim.ChaincodeStubInterface, invoice *Invoice) error {
+	key, err := invoiceKey(stub, invoice)
+	if err != nil {
+		return err
+	}
+	indexKey, err := invoiceNumberKey(stub, invoice.InvoiceNumber)
+	if err != nil {
+		return err
+	}
+	invoiceBytes, err := json.Marshal(invoice)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, invoiceBytes); err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte(key))
+}
+
+//Returns the invoices under a partial invoice key, i.e. all, for an UFA or for an UFA and period
+func getInvoiceRecords(stub shim.ChaincodeStubInterface, attributes ...string) ([]Invoice, error) {
+	values, err := getStateByPartialKey(stub, INVOICE_KEY_TYPE, attributes)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Invoice, 0, len(values))
+	for _, value := range values {
+		invoice, err := parseInvoice(value)
+		if err != nil {
+			return nil, errors.New("Corrupt invoice record: " + err.Error())
+		}
+		records = append(records, invoice)
+	}
+	return records, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/attrmgr"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+//testIdentity Enrolment of a test user, turned into a creator certificate
+type testIdentity struct {
+	mspID string
+	email string
+	role  string
+}
+
+//Client timestamp of the first transaction, each following one is a minute later
+var ledgerStubEpoch = time.Date(2017, time.December, 1, 9, 0, 0, 0, time.UTC)
+
+//Serialized creators of the test identities, generating keys is slow
+var testCreators = make(map[testIdentity][]byte)
+
+//ledgerStub In-memory ledger for driving the chaincode offline.
+//Like a peer, reads inside a transaction only see committed state and the
+//writes are buffered until the transaction ends. They are committed when the
+//chaincode returns a successful response and discarded otherwise.
+type ledgerStub struct {
+	*shimtest.MockStub
+	t        *testing.T
+	cc       shim.Chaincode
+	args     [][]byte
+	txCount  int
+	writeSet map[string][]byte
+	//Writes of the last committed transaction, nil values are deletions
+	lastWriteSet map[string][]byte
+	event        *pb.ChaincodeEvent
+	//Event of the last transaction, only delivered when it commits
+	lastEvent *pb.ChaincodeEvent
+}
+
+//Creates a ledger stub for the UFA chaincode and runs Init on it
+func newLedgerStub(t *testing.T) *ledgerStub {
+	cc := new(UFAChainCode)
+	stub := &ledgerStub{MockStub: shimtest.NewMockStub("ufa", cc), t: t, cc: cc}
+	if res := stub.init(); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	return stub
+}
+
+//GetArgs Arguments of the running transaction
+func (s *ledgerStub) GetArgs() [][]byte {
+	return s.args
+}
+
+//GetStringArgs Arguments of the running transaction as strings
+func (s *ledgerStub) GetStringArgs() []string {
+	args := make([]string, len(s.args))
+	for i, arg := range s.args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+//GetFunctionAndParameters Function name and parameters of the running transaction
+func (s *ledgerStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+//PutState Buffers a write until the transaction commits
+func (s *ledgerStub) PutState(key string, value []byte) error {
+	if s.writeSet == nil {
+		return fmt.Errorf("cannot PutState %s outside a transaction", key)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	s.writeSet[key] = value
+	return nil
+}
+
+//DelState Buffers a deletion until the transaction commits
+func (s *ledgerStub) DelState(key string) error {
+	return s.PutState(key, nil)
+}
+
+//SetEvent Sets the event of the transaction, like a peer only the last one is kept
+func (s *ledgerStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty")
+	}
+	s.event = &pb.ChaincodeEvent{EventName: name, Payload: payload}
+	return nil
+}
+
+//Makes the following transactions submitted by the given identity
+func (s *ledgerStub) setCaller(identity testIdentity) {
+	s.t.Helper()
+	creator, cached := testCreators[identity]
+	if !cached {
+		var err error
+		creator, err = newTestCreator(identity)
+		if err != nil {
+			s.t.Fatalf("Unable to create certificate for %s: %v", identity.email, err)
+		}
+		testCreators[identity] = creator
+	}
+	s.Creator = creator
+}
+
+//Issues a self signed certificate carrying the identity attributes like Fabric CA does
+func newTestCreator(identity testIdentity) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]string{}
+	if identity.email != "" {
+		attrs[EMAIL_ATTRIBUTE] = identity.email
+	}
+	if identity.role != "" {
+		attrs[ROLE_ATTRIBUTE] = identity.role
+	}
+	attrBytes, err := json.Marshal(&attrmgr.Attributes{Attrs: attrs})
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: identity.email, Organization: []string{identity.mspID}},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: attrmgr.AttrOID, Value: attrBytes}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return proto.Marshal(&msp.SerializedIdentity{Mspid: identity.mspID, IdBytes: certPEM})
+}
+
+//Runs Init in its own transaction
+func (s *ledgerStub) init(args ...string) pb.Response {
+	return s.transact(args, func() pb.Response { return s.cc.Init(s) })
+}
+
+//Runs Invoke for a function in its own transaction
+func (s *ledgerStub) invoke(function string, args ...string) pb.Response {
+	return s.transact(append([]string{function}, args...), func() pb.Response { return s.cc.Invoke(s) })
+}
+
+//Invokes a function and fails the test if it does not succeed
+func (s *ledgerStub) mustInvoke(function string, args ...string) []byte {
+	s.t.Helper()
+	res := s.invoke(function, args...)
+	if res.Status != shim.OK {
+		s.t.Fatalf("%s failed: %s", function, res.Message)
+	}
+	return res.Payload
+}
+
+//Runs fn inside a transaction and commits its writes on success
+func (s *ledgerStub) transact(args []string, fn func() pb.Response) pb.Response {
+	s.txCount++
+	txID := fmt.Sprintf("tx%d", s.txCount)
+	s.args = make([][]byte, len(args))
+	for i, arg := range args {
+		s.args[i] = []byte(arg)
+	}
+	s.MockTransactionStart(txID)
+	s.TxTimestamp = &timestamp.Timestamp{Seconds: ledgerStubEpoch.Add(time.Duration(s.txCount) * time.Minute).Unix()}
+	s.writeSet = make(map[string][]byte)
+	s.event, s.lastEvent = nil, nil
+	res := fn()
+	if res.Status < shim.ERRORTHRESHOLD {
+		s.commit()
+		s.lastEvent = s.event
+	}
+	s.writeSet = nil
+	s.MockTransactionEnd(txID)
+	return res
+}
+
+//Applies the buffered writes to the committed state
+func (s *ledgerStub) commit() {
+	keys := make([]string, 0, len(s.writeSet))
+	for key := range s.writeSet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value := s.writeSet[key]; value == nil {
+			s.MockStub.DelState(key)
+		} else {
+			s.MockStub.PutState(key, value)
+		}
+	}
+	s.lastWriteSet = s.writeSet
+}
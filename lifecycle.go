@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//UFA statuses. An UFA starts as a draft, is agreed once the counterparty
+//approves it and ends up closed, rejected or terminated.
+const (
+	STATUS_DRAFT                   = "Draft"
+	STATUS_PENDING_BUYER_APPROVAL  = "PendingBuyerApproval"
+	STATUS_PENDING_SELLER_APPROVAL = "PendingSellerApproval"
+	STATUS_AGREED                  = "Agreed"
+	STATUS_SUSPENDED               = "Suspended"
+	STATUS_EXHAUSTED               = "Exhausted"
+	STATUS_EXPIRED                 = "Expired"
+	STATUS_CLOSED                  = "Closed"
+	STATUS_REJECTED                = "Rejected"
+	STATUS_TERMINATED              = "Terminated"
+)
+
+//UFA fields owned by the lifecycle functions
+var statusFields = []string{"status", "statusReason", "statusChangedBy", "statusChangedAt"}
+
+//statusTransition Move of an UFA from one status to another
+type statusTransition struct {
+	from string
+	to   string
+	//Checks the caller holds a role that may make the move
+	allowed func(roles UFARoles) bool
+}
+
+//lifecycleFunction Invoke function changing the status of an UFA
+type lifecycleFunction struct {
+	transitions []statusTransition
+	needsReason bool
+	//Checks the UFA itself is ready for the move, nil if it always is
+	guard func(stub shim.ChaincodeStubInterface, ufa *UFA) error
+}
+
+//Lifecycle functions and the transitions each may make
+var lifecycleFunctions = map[string]lifecycleFunction{
+	"submitUFA": {transitions: []statusTransition{
+		{STATUS_DRAFT, STATUS_PENDING_BUYER_APPROVAL, UFARoles.sellerSide},
+		{STATUS_DRAFT, STATUS_PENDING_SELLER_APPROVAL, UFARoles.buyerSide},
+	}},
+	"approveUFA": {transitions: []statusTransition{
+		{STATUS_PENDING_BUYER_APPROVAL, STATUS_AGREED, UFARoles.isBuyerApprover},
+		{STATUS_PENDING_SELLER_APPROVAL, STATUS_AGREED, UFARoles.isSellerApprover},
+		//Reinstates a suspended agreement
+		{STATUS_SUSPENDED, STATUS_AGREED, UFARoles.approver},
+	}},
+	"rejectUFA": {needsReason: true, transitions: []statusTransition{
+		{STATUS_PENDING_BUYER_APPROVAL, STATUS_REJECTED, UFARoles.isBuyerApprover},
+		{STATUS_PENDING_SELLER_APPROVAL, STATUS_REJECTED, UFARoles.isSellerApprover},
+	}},
+	"suspendUFA": {transitions: []statusTransition{
+		{STATUS_AGREED, STATUS_SUSPENDED, UFARoles.approver},
+	}},
+	"terminateUFA": {needsReason: true, transitions: []statusTransition{
+		{STATUS_AGREED, STATUS_TERMINATED, UFARoles.approver},
+		{STATUS_SUSPENDED, STATUS_TERMINATED, UFARoles.approver},
+	}},
+	//Ends an agreement whose validity ran out, whatever budget it has left
+	"expireUFA": {guard: checkValidityEnded, transitions: []statusTransition{
+		{STATUS_AGREED, STATUS_EXPIRED, UFARoles.onAgreement},
+		{STATUS_SUSPENDED, STATUS_EXPIRED, UFARoles.onAgreement},
+		{STATUS_EXHAUSTED, STATUS_EXPIRED, UFARoles.onAgreement},
+	}},
+	"closeUFA": {transitions: []statusTransition{
+		{STATUS_EXHAUSTED, STATUS_CLOSED, UFARoles.approver},
+		{STATUS_EXPIRED, STATUS_CLOSED, UFARoles.approver},
+	}},
+}
+
+func (r UFARoles) sellerSide() bool       { return r.Seller || r.SellerApprover }
+func (r UFARoles) buyerSide() bool        { return r.Buyer || r.BuyerApprover }
+func (r UFARoles) approver() bool         { return r.SellerApprover || r.BuyerApprover }
+func (r UFARoles) isSellerApprover() bool { return r.SellerApprover }
+func (r UFARoles) isBuyerApprover() bool  { return r.BuyerApprover }
+
+//Moves an UFA along its lifecycle. Arguments are the UFA number and a reason
+func changeUFAStatus(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	logger.Info(function + " called")
+	lifecycle := lifecycleFunctions[function]
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber := args[0]
+	reason := ""
+	if len(args) > 1 {
+		reason = args[1]
+	}
+	if lifecycle.needsReason && reason == "" {
+		return nil, errors.New(function + " requires a reason")
+	}
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	roles := caller.rolesOn(ufa)
+	validFrom := false
+	target := ""
+	for _, transition := range lifecycle.transitions {
+		if transition.from != ufa.Status {
+			continue
+		}
+		validFrom = true
+		if transition.allowed(roles) {
+			target = transition.to
+			break
+		}
+	}
+	if !validFrom {
+		return nil, errors.New(function + " is not allowed on UFA " + ufanumber + " in status " + ufa.Status)
+	}
+	if target == "" {
+		return nil, errors.New("User " + caller.Email + " is not allowed to " + function + " " + ufanumber + " in status " + ufa.Status)
+	}
+	if lifecycle.guard != nil {
+		err = lifecycle.guard(stub, ufa)
+		if err != nil {
+			return nil, err
+		}
+	}
+	before := ufa.clone()
+	err = setUFAStatus(stub, ufa, target, caller, reason)
+	if err != nil {
+		return nil, err
+	}
+	err = putUFA(stub, ufa)
+	if err != nil {
+		return nil, err
+	}
+	err = recordUFAHistory(stub, caller, before, ufa)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(function + " moved " + ufanumber + " to " + ufa.Status)
+	return nil, emitEvent(stub, EVENT_UFA_UPDATED, newUFAEvent(ufa, caller))
+}
+
+//Records a status change on the UFA, stamped with the transaction time
+func setUFAStatus(stub shim.ChaincodeStubInterface, ufa *UFA, status string, caller *Caller, reason string) error {
+	changedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	ufa.Status = status
+	ufa.StatusReason = reason
+	ufa.StatusChangedBy = caller.Email
+	ufa.StatusChangedAt = changedAt
+	return nil
+}
+
+//Rejects patches touching the fields owned by the lifecycle functions
+func checkStatusUntouched(patch map[string]interface{}) error {
+	for _, field := range statusFields {
+		if _, found := patch[field]; found {
+			return errors.New("Field " + field + " can only be changed through the UFA lifecycle functions")
+		}
+	}
+	return nil
+}
+
+//Invoice statuses. An invoice is raised, optionally taken under review and
+//then approved and paid, or rejected or cancelled.
+const (
+	INVOICE_RAISED       = "Raised"
+	INVOICE_UNDER_REVIEW = "UnderReview"
+	INVOICE_APPROVED     = "Approved"
+	INVOICE_REJECTED     = "Rejected"
+	INVOICE_PAID         = "Paid"
+	INVOICE_CANCELLED    = "Cancelled"
+)
+
+//invoiceTransition Move of an invoice from one status to another
+type invoiceTransition struct {
+	from []string
+	to   string
+	//Checks the caller may make the move on the invoice
+	allowed func(caller *Caller, roles UFARoles, invoice *Invoice) bool
+}
+
+//invoiceLifecycleFunction Invoke function changing the status of an invoice
+type invoiceLifecycleFunction struct {
+	transition invoiceTransition
+	//Name of the mandatory second argument, if any
+	argument string
+}
+
+//Invoice lifecycle functions and the transition each makes
+var invoiceLifecycleFunctions = map[string]invoiceLifecycleFunction{
+	"reviewInvoice": {transition: invoiceTransition{
+		[]string{INVOICE_RAISED}, INVOICE_UNDER_REVIEW, isInvoiceReviewer,
+	}},
+	"approveInvoice": {transition: invoiceTransition{
+		[]string{INVOICE_RAISED, INVOICE_UNDER_REVIEW}, INVOICE_APPROVED, isInvoiceReviewer,
+	}},
+	"rejectInvoice": {argument: "reason", transition: invoiceTransition{
+		[]string{INVOICE_RAISED, INVOICE_UNDER_REVIEW}, INVOICE_REJECTED, isInvoiceReviewer,
+	}},
+	"cancelInvoice": {transition: invoiceTransition{
+		[]string{INVOICE_RAISED, INVOICE_UNDER_REVIEW}, INVOICE_CANCELLED, isInvoiceRaiser,
+	}},
+	"markInvoicePaid": {argument: "payment reference", transition: invoiceTransition{
+		[]string{INVOICE_APPROVED}, INVOICE_PAID, isInvoiceApprover,
+	}},
+}
+
+//Invoices are reviewed by an approver of the UFA other than the user who raised them
+func isInvoiceReviewer(caller *Caller, roles UFARoles, invoice *Invoice) bool {
+	return roles.approver() && caller.Email != invoice.RaisedBy
+}
+
+func isInvoiceRaiser(caller *Caller, roles UFARoles, invoice *Invoice) bool {
+	return caller.Email == invoice.RaisedBy
+}
+
+func isInvoiceApprover(caller *Caller, roles UFARoles, invoice *Invoice) bool {
+	return roles.approver()
+}
+
+//Checks if an invoice status takes the invoice out of the UFA totals
+func isWithdrawnInvoice(status string) bool {
+	return status == INVOICE_REJECTED || status == INVOICE_CANCELLED
+}
+
+//Amount an invoice consumes from its UFA, as booked when it was raised
+func invoiceContribution(invoice *Invoice) Money {
+	if invoice.Side == "" && invoice.BookedAmt.Units == 0 && invoice.BookedAmt.Currency == "" {
+		//Invoices raised before the booked amount was recorded were mirrored
+		//copies each counting for half
+		return agreementAmount(invoice).half()
+	}
+	return invoice.BookedAmt
+}
+
+//Books a batch of invoices against its UFA. The seller invoice carries the
+//charge, the buyer copy mirrors it and books nothing.
+func bookInvoices(invoices []Invoice) (Money, error) {
+	var booked Money
+	for i := range invoices {
+		invoice := &invoices[i]
+		amount := agreementAmount(invoice)
+		if invoice.isBuyerCopy() {
+			invoice.BookedAmt = Money{Currency: amount.Currency}
+			continue
+		}
+		invoice.BookedAmt = amount
+		var err error
+		booked, err = booked.plus(amount)
+		if err != nil {
+			return Money{}, err
+		}
+	}
+	return booked, nil
+}
+
+//Moves an invoice along its lifecycle. Arguments are the invoice number and
+//the reason or payment reference
+func changeInvoiceStatus(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	logger.Info(function + " called")
+	lifecycle := invoiceLifecycleFunctions[function]
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	invoiceNumber := args[0]
+	argument := ""
+	if len(args) > 1 {
+		argument = args[1]
+	}
+	if lifecycle.argument != "" && argument == "" {
+		return nil, errors.New(function + " requires a " + lifecycle.argument)
+	}
+	invoice, err := getInvoice(stub, invoiceNumber)
+	if err != nil {
+		return nil, err
+	}
+	if invoice == nil {
+		return nil, errors.New("Invalid invoice number " + invoiceNumber)
+	}
+	ufa, err := getUFA(stub, invoice.UFANumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + invoice.UFANumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	transition := lifecycle.transition
+	if !containsString(transition.from, invoice.Status) {
+		return nil, errors.New(function + " is not allowed on invoice " + invoiceNumber + " in status " + invoice.Status)
+	}
+	if !transition.allowed(caller, caller.rolesOn(ufa), invoice) {
+		return nil, errors.New("User " + caller.Email + " is not allowed to " + function + " " + invoiceNumber)
+	}
+	//The buyer copy mirrors the seller invoice and is withdrawn with it
+	var pairedCopy *Invoice
+	if isWithdrawnInvoice(transition.to) && !invoice.isBuyerCopy() && invoice.PairedWith != "" {
+		pairedCopy, err = getInvoice(stub, invoice.PairedWith)
+		if err != nil {
+			return nil, err
+		}
+		if pairedCopy != nil && isWithdrawnInvoice(pairedCopy.Status) {
+			pairedCopy = nil
+		}
+		if pairedCopy != nil && pairedCopy.Status == INVOICE_PAID {
+			return nil, errors.New("Invoice " + invoiceNumber + " can not be withdrawn, its copy " + pairedCopy.InvoiceNumber + " is paid")
+		}
+	}
+	changedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	invoiceBefore := *invoice
+	before := ufa.clone()
+	setInvoiceStatus(invoice, transition.to, caller, changedAt, argument)
+	err = putInvoice(stub, invoice)
+	if err != nil {
+		return nil, err
+	}
+	event := UFAEvent{UFANumber: ufa.UFANumber, BillingPeriod: invoice.BillingPeriod, Invoices: []string{invoiceNumber},
+		Amount: &invoice.InvoiceAmt, Status: invoice.Status, Actor: caller.Email}
+	var copyChanges []FieldChange
+	if pairedCopy != nil {
+		copyBefore := *pairedCopy
+		setInvoiceStatus(pairedCopy, transition.to, caller, changedAt, "Invoice "+invoiceNumber+" withdrawn")
+		err = putInvoice(stub, pairedCopy)
+		if err != nil {
+			return nil, err
+		}
+		copyChanges, err = diffInvoice(&copyBefore, pairedCopy)
+		if err != nil {
+			return nil, err
+		}
+		event.Invoices = append(event.Invoices, pairedCopy.InvoiceNumber)
+	}
+	if isWithdrawnInvoice(invoice.Status) {
+		err = withdrawInvoiceFromUFA(stub, ufa, invoice, caller)
+		if err != nil {
+			return nil, err
+		}
+		event.RaisedInvTotal = &ufa.RaisedInvTotal
+	}
+	//Every move of an invoice is audited on the history of its UFA
+	err = recordInvoiceChange(stub, caller, before, ufa, &invoiceBefore, invoice, copyChanges...)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(function + " moved " + invoiceNumber + " to " + invoice.Status)
+	return nil, emitEvent(stub, EVENT_INVOICE_UPDATED, event)
+}
+
+//Records a status change on an invoice, stamped with the transaction time.
+//The argument is the payment reference of a payment and the reason otherwise.
+func setInvoiceStatus(invoice *Invoice, status string, caller *Caller, changedAt string, argument string) {
+	invoice.Status = status
+	invoice.StatusChangedBy = caller.Email
+	invoice.StatusChangedAt = changedAt
+	switch status {
+	case INVOICE_APPROVED:
+		invoice.ApprovedBy = caller.Email
+	case INVOICE_PAID:
+		invoice.PaymentReference = argument
+	default:
+		invoice.StatusReason = argument
+	}
+}
+
+//Rolls back the contribution of a rejected or cancelled invoice to its UFA,
+//reopening the billing period once none of its invoices stand
+func withdrawInvoiceFromUFA(stub shim.ChaincodeStubInterface, ufa *UFA, invoice *Invoice, caller *Caller) error {
+	raisedTotal, err := ufa.RaisedInvTotal.minus(invoiceContribution(invoice))
+	if err != nil {
+		return err
+	}
+	ufa.RaisedInvTotal = raisedTotal
+	periodInvoices, err := getInvoiceRecords(stub, ufa.UFANumber, invoice.BillingPeriod)
+	if err != nil {
+		return err
+	}
+	periodOpen := true
+	for _, periodInvoice := range periodInvoices {
+		//The ledger still holds the previous status of the invoice being withdrawn
+		if periodInvoice.InvoiceNumber != invoice.InvoiceNumber && !periodInvoice.isCreditNote() && !periodInvoice.isBuyerCopy() && !isWithdrawnInvoice(periodInvoice.Status) {
+			periodOpen = false
+		}
+	}
+	if periodOpen {
+		delete(ufa.InvoicePeriods, invoice.BillingPeriod)
+	}
+	exhausted, err := isUFAExpired(ufa)
+	if err != nil {
+		return err
+	}
+	if ufa.Status == STATUS_EXHAUSTED && !exhausted {
+		err = setUFAStatus(stub, ufa, STATUS_AGREED, caller, "Invoice "+invoice.InvoiceNumber+" withdrawn")
+		if err != nil {
+			return err
+		}
+	}
+	return putUFA(stub, ufa)
+}
+
+//Checks if a list contains a value
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//Lifecycle call made by a test identity
+type lifecycleStep struct {
+	caller   testIdentity
+	function string
+	args     []string
+	status   string
+	errorMsg string
+}
+
+var sellerOnly = testIdentity{mspID: seller.mspID, email: "sales@shell.com", role: ROLE_SELLER}
+
+func TestUFAStatusTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []lifecycleStep
+	}{
+		{"seller proposes, buyer approves", []lifecycleStep{
+			{seller, "submitUFA", nil, STATUS_PENDING_BUYER_APPROVAL, ""},
+			{seller, "approveUFA", nil, STATUS_PENDING_BUYER_APPROVAL, "is not allowed to approveUFA"},
+			{buyer, "approveUFA", nil, STATUS_AGREED, ""},
+		}},
+		{"buyer proposes, seller approves", []lifecycleStep{
+			{buyer, "submitUFA", nil, STATUS_PENDING_SELLER_APPROVAL, ""},
+			{sellerOnly, "approveUFA", nil, STATUS_PENDING_SELLER_APPROVAL, "is not allowed to approveUFA"},
+			{seller, "approveUFA", nil, STATUS_AGREED, ""},
+		}},
+		{"buyer rejects with a reason", []lifecycleStep{
+			{seller, "submitUFA", nil, STATUS_PENDING_BUYER_APPROVAL, ""},
+			{buyer, "rejectUFA", nil, STATUS_PENDING_BUYER_APPROVAL, "rejectUFA requires a reason"},
+			{buyer, "rejectUFA", []string{"Charges too high"}, STATUS_REJECTED, ""},
+			{buyer, "approveUFA", nil, STATUS_REJECTED, "approveUFA is not allowed on UFA UFA1 in status Rejected"},
+		}},
+		{"suspend, reinstate and terminate", []lifecycleStep{
+			{seller, "suspendUFA", nil, STATUS_DRAFT, "suspendUFA is not allowed on UFA UFA1 in status Draft"},
+			{seller, "submitUFA", nil, STATUS_PENDING_BUYER_APPROVAL, ""},
+			{buyer, "approveUFA", nil, STATUS_AGREED, ""},
+			{sellerOnly, "suspendUFA", nil, STATUS_AGREED, "is not allowed to suspendUFA"},
+			{buyer, "suspendUFA", nil, STATUS_SUSPENDED, ""},
+			{seller, "approveUFA", nil, STATUS_AGREED, ""},
+			{seller, "terminateUFA", []string{"Contract breach"}, STATUS_TERMINATED, ""},
+			{seller, "closeUFA", nil, STATUS_TERMINATED, "closeUFA is not allowed"},
+		}},
+		{"outsider can not move the UFA", []lifecycleStep{
+			{outsider, "submitUFA", nil, STATUS_DRAFT, "is not a party to UFA UFA1"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newLedgerStub(t)
+			stub.setCaller(seller)
+			stub.mustInvoke("createUFA", "UFA1", toJSON(t, newTestUFA("UFA1")))
+			for _, step := range test.steps {
+				stub.setCaller(step.caller)
+				res := stub.invoke(step.function, append([]string{"UFA1"}, step.args...)...)
+				if step.errorMsg == "" && res.Status != shim.OK {
+					t.Fatalf("%s by %s failed: %s", step.function, step.caller.email, res.Message)
+				}
+				if step.errorMsg != "" && (res.Status == shim.OK || !strings.Contains(res.Message, step.errorMsg)) {
+					t.Fatalf("Expected %s by %s to fail with %q, got %d: %s", step.function, step.caller.email, step.errorMsg, res.Status, res.Message)
+				}
+				stub.setCaller(seller)
+				if ufa := readUFA(t, stub, "UFA1"); ufa.Status != step.status {
+					t.Fatalf("Expected status %s after %s, got %s", step.status, step.function, ufa.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusNotPatchable(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	res := stub.invoke("updateUFA", "UFA1", `{"status":"Closed"}`)
+	if res.Status == shim.OK || !strings.Contains(res.Message, "status can only be changed through the UFA lifecycle functions") {
+		t.Fatalf("Expected updateUFA to refuse a status change, got %d: %s", res.Status, res.Message)
+	}
+	ufa := readUFA(t, stub, "UFA1")
+	if ufa.Status != STATUS_AGREED || ufa.StatusChangedBy != buyerEmail || ufa.StatusChangedAt == "" {
+		t.Fatalf("Expected the approval to be recorded, got %+v", ufa)
+	}
+
+	stub.setCaller(buyer)
+	output := string(stub.mustInvoke("validateNewInvoideData", toJSON(t, invoicePair("UFA1", "2017-10", 100))))
+	if !strings.Contains(output, `"Success"`) {
+		t.Fatalf("Expected invoices to be accepted on an agreed UFA, got %s", output)
+	}
+	stub.mustInvoke("suspendUFA", "UFA1")
+	output = string(stub.mustInvoke("validateNewInvoideData", toJSON(t, invoicePair("UFA1", "2017-10", 100))))
+	if !strings.Contains(output, "Invoices can only be raised against an Agreed UFA") {
+		t.Fatalf("Expected invoices on a suspended UFA to be rejected, got %s", output)
+	}
+}
+
+//Reads an invoice back through the getInvoicesForUFA query
+func readInvoice(t *testing.T, stub *ledgerStub, ufanumber string, invoiceNumber string) Invoice {
+	t.Helper()
+	var invoices []Invoice
+	if err := json.Unmarshal(stub.mustInvoke("getInvoicesForUFA", ufanumber), &invoices); err != nil {
+		t.Fatalf("Unable to parse invoices of %s: %v", ufanumber, err)
+	}
+	for _, invoice := range invoices {
+		if invoice.InvoiceNumber == invoiceNumber {
+			return invoice
+		}
+	}
+	t.Fatalf("Invoice %s not found on %s", invoiceNumber, ufanumber)
+	return Invoice{}
+}
+
+func TestInvoiceStatusTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []lifecycleStep
+	}{
+		{"reviewed, approved and paid", []lifecycleStep{
+			{seller, "approveInvoice", nil, INVOICE_RAISED, "is not allowed to approveInvoice"},
+			{buyer, "reviewInvoice", nil, INVOICE_UNDER_REVIEW, ""},
+			{buyer, "markInvoicePaid", []string{"PAY-1"}, INVOICE_UNDER_REVIEW, "markInvoicePaid is not allowed on invoice S-2017-10 in status UnderReview"},
+			{buyer, "approveInvoice", nil, INVOICE_APPROVED, ""},
+			{seller, "markInvoicePaid", nil, INVOICE_APPROVED, "markInvoicePaid requires a payment reference"},
+			{seller, "markInvoicePaid", []string{"PAY-1"}, INVOICE_PAID, ""},
+			{seller, "cancelInvoice", nil, INVOICE_PAID, "cancelInvoice is not allowed"},
+		}},
+		{"rejected with a reason", []lifecycleStep{
+			{buyer, "rejectInvoice", nil, INVOICE_RAISED, "rejectInvoice requires a reason"},
+			{buyer, "rejectInvoice", []string{"Wrong rate"}, INVOICE_REJECTED, ""},
+			{buyer, "approveInvoice", nil, INVOICE_REJECTED, "approveInvoice is not allowed"},
+		}},
+		{"cancelled by the raiser only", []lifecycleStep{
+			{buyer, "cancelInvoice", nil, INVOICE_RAISED, "is not allowed to cancelInvoice"},
+			{outsider, "cancelInvoice", nil, INVOICE_RAISED, "is not a party to UFA UFA1"},
+			{seller, "cancelInvoice", nil, INVOICE_CANCELLED, ""},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newLedgerStub(t)
+			mustCreateUFA(t, stub, newTestUFA("UFA1"))
+			stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+			for _, step := range test.steps {
+				stub.setCaller(step.caller)
+				res := stub.invoke(step.function, append([]string{"S-2017-10"}, step.args...)...)
+				if step.errorMsg == "" && res.Status != shim.OK {
+					t.Fatalf("%s by %s failed: %s", step.function, step.caller.email, res.Message)
+				}
+				if step.errorMsg != "" && (res.Status == shim.OK || !strings.Contains(res.Message, step.errorMsg)) {
+					t.Fatalf("Expected %s by %s to fail with %q, got %d: %s", step.function, step.caller.email, step.errorMsg, res.Status, res.Message)
+				}
+				stub.setCaller(seller)
+				if invoice := readInvoice(t, stub, "UFA1", "S-2017-10"); invoice.Status != step.status {
+					t.Fatalf("Expected status %s after %s, got %s", step.status, step.function, invoice.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestWithdrawnInvoicesRollBackUFATotal(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 1100)))
+	if ufa := readUFA(t, stub, "UFA1"); ufa.Status != STATUS_EXHAUSTED {
+		t.Fatalf("Expected UFA1 to be exhausted, got %s", ufa.Status)
+	}
+
+	stub.setCaller(buyer)
+	stub.mustInvoke("rejectInvoice", "S-2017-10", "Over the agreed charge")
+	ufa := readUFA(t, stub, "UFA1")
+	if ufa.RaisedInvTotal != whole(0) || ufa.Status != STATUS_AGREED {
+		t.Fatalf("Expected the rejection to reopen UFA1 with nothing raised, got %v in %s", ufa.RaisedInvTotal, ufa.Status)
+	}
+	//The buyer copy carries no charge and does not hold the period
+	if _, billed := ufa.InvoicePeriods["2017-10"]; billed {
+		t.Fatalf("Expected 2017-10 to be open again, got %+v", ufa.InvoicePeriods)
+	}
+	if invoice := readInvoice(t, stub, "UFA1", "S-2017-10"); invoice.StatusReason != "Over the agreed charge" || invoice.StatusChangedBy != buyerEmail {
+		t.Fatalf("Expected the rejection to be recorded, got %+v", invoice)
+	}
+
+	//The buyer copy is rejected with the seller invoice and leaves the lifecycle
+	if invoice := readInvoice(t, stub, "UFA1", "B-2017-10"); invoice.Status != INVOICE_REJECTED || invoice.StatusReason != "Invoice S-2017-10 withdrawn" {
+		t.Fatalf("Expected the buyer copy to be rejected with the seller invoice, got %+v", invoice)
+	}
+	for _, function := range []string{"approveInvoice", "cancelInvoice"} {
+		if res := stub.invoke(function, "B-2017-10"); res.Status == shim.OK || !strings.Contains(res.Message, "in status Rejected") {
+			t.Fatalf("Expected %s of the rejected copy to fail, got %d: %s", function, res.Status, res.Message)
+		}
+	}
+	stub.setCaller(seller)
+	replacement := invoicePair("UFA1", "2017-10", 500)
+	replacement[0].InvoiceNumber, replacement[1].InvoiceNumber = "S-2017-10a", "B-2017-10a"
+	stub.mustInvoke("createInvoices", toJSON(t, replacement))
+	if ufa = readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != whole(500) {
+		t.Fatalf("Expected the replacement invoices to be booked, got %v", ufa.RaisedInvTotal)
+	}
+}
+
+func TestPaidCopyBlocksWithdrawal(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveInvoice", "B-2017-10")
+	stub.mustInvoke("markInvoicePaid", "B-2017-10", "PAY-1")
+	if res := stub.invoke("rejectInvoice", "S-2017-10", "Wrong rate"); res.Status == shim.OK || !strings.Contains(res.Message, "its copy B-2017-10 is paid") {
+		t.Fatalf("Expected the paid copy to keep the seller invoice, got %d: %s", res.Status, res.Message)
+	}
+	stub.setCaller(seller)
+	if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != whole(200) {
+		t.Fatalf("Expected the charge to stay booked, got %v", ufa.RaisedInvTotal)
+	}
+}
+
+//Invoices left behind by a removed UFA are refused rather than crashing the chaincode
+func TestInvoiceOfMissingUFA(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+	key, _ := ufaKey(stub, "UFA1")
+	stub.MockTransactionStart("remove")
+	stub.MockStub.DelState(key)
+	stub.MockTransactionEnd("remove")
+
+	stub.setCaller(buyer)
+	if res := stub.invoke("approveInvoice", "S-2017-10"); res.Status == shim.OK || !strings.Contains(res.Message, "Invalid UFA number UFA1") {
+		t.Fatalf("Expected the approval to be refused, got %d: %s", res.Status, res.Message)
+	}
+	stub.setCaller(seller)
+	if err := responseError(t, stub.invoke("createCreditNote", creditNote("C-1", "S-2017-10", "50"))); err.Code != ERR_UFA_NOT_FOUND {
+		t.Fatalf("Expected the credit note to be refused, got %+v", err)
+	}
+}
+
+func TestInvoiceUpdatesRetired(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+	for _, patch := range []string{
+		`[{"invoiceNumber":"S-2017-10"}]`,
+		`[{"invoiceNumber":"S-2017-10","status":"Paid"}]`,
+		`[{"invoiceNumber":"S-2017-10","raisedBy":"billing@shell.com"}]`,
+	} {
+		err := responseError(t, stub.invoke("updateInvoices", patch))
+		if err.Code != ERR_FUNCTION_RETIRED {
+			t.Fatalf("Expected %s to be refused as retired, got %+v", patch, err)
+		}
+	}
+	if invoice := readInvoice(t, stub, "UFA1", "S-2017-10"); invoice.Status != INVOICE_RAISED || invoice.RaisedBy != sellerEmail {
+		t.Fatalf("Expected the invoice untouched, got %+v", invoice)
+	}
+}
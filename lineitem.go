@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//QUANTITY_DIGITS Decimal places kept for line item quantities
+const QUANTITY_DIGITS = 3
+
+//Quantity Quantity in thousandths, "1.5" is 1500.
+//Kept as an integer so the priced lines agree on every peer.
+type Quantity int64
+
+//LineItem Charge on an invoice, the chaincode prices it from the quantity
+//and the unit price
+type LineItem struct {
+	Description string   `json:"description"`
+	Quantity    Quantity `json:"quantity"`
+	UnitPrice   Money    `json:"unitPrice"`
+	TaxCode     string   `json:"taxCode,omitempty"`
+	//Rate of the tax code on the day the invoice was raised and the tax
+	//at that rate on the net amount, computed by the chaincode
+	TaxRate Percentage `json:"taxRate,omitempty"`
+	TaxAmt  Money      `json:"taxAmt"`
+	//Quantity times the unit price, computed by the chaincode
+	NetAmt Money `json:"netAmt"`
+}
+
+//InvoiceLine Line item of an invoice as listed by getInvoiceLines
+type InvoiceLine struct {
+	InvoiceNumber string `json:"invoiceNumber"`
+	BillingPeriod string `json:"billingPeriod"`
+	Side          string `json:"side,omitempty"`
+	Status        string `json:"status,omitempty"`
+	//Position of the line on the invoice, numbered from 1
+	Line int `json:"line"`
+	LineItem
+	//Net amount plus tax of the line
+	TotalAmt Money `json:"totalAmt"`
+}
+
+//Parses a decimal quantity
+func parseQuantity(value string) (Quantity, error) {
+	scaled, err := parseDecimal(value, QUANTITY_DIGITS)
+	if err != nil {
+		return 0, errors.New("invalid quantity: " + err.Error())
+	}
+	return Quantity(scaled), nil
+}
+
+//String Decimal quantity
+func (q Quantity) String() string {
+	return formatDecimal(int64(q), QUANTITY_DIGITS)
+}
+
+//MarshalJSON Writes the quantity as a decimal string
+func (q Quantity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.String())
+}
+
+//UnmarshalJSON Reads a quantity written as a decimal string
+func (q *Quantity) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("quantities must be decimal strings")
+	}
+	quantity, err := parseQuantity(value)
+	if err != nil {
+		return err
+	}
+	*q = quantity
+	return nil
+}
+
+//Returns the price of a quantity, rounded half up to the minor unit
+func (q Quantity) times(price Money) Money {
+	numerator := new(big.Int).Mul(big.NewInt(int64(q)), big.NewInt(price.Units))
+	return Money{Units: divideRounded(numerator, pow10(QUANTITY_DIGITS)), Currency: price.Currency}
+}
+
+//Checks if an amount was left out of the payload
+func isUnset(m Money) bool {
+	return m.Units == 0 && m.Currency == ""
+}
+
+//Returns the path of a field of a line item in the error envelope
+func lineField(line int, field string) string {
+	return "lines[" + strconv.Itoa(line) + "]." + field
+}
+
+//Prices the line items of an invoice and computes their tax. The invoice
+//amount is the sum of the priced lines and tax, it is filled in when left out
+//and must match when sent. Invoices without line items keep the amount they
+//were raised with, lines naming no currency are taken to be in the currency of the UFA.
+func priceInvoiceLines(stub shim.ChaincodeStubInterface, invoice *Invoice, ufaCurrency string, taxDate string) []*ChaincodeError {
+	if len(invoice.Lines) == 0 {
+		return nil
+	}
+	errorMessages := computeLineTaxes(stub, invoice, taxDate)
+	if len(errorMessages) > 0 {
+		return errorMessages
+	}
+	//The lines are in the currency of the invoice, or the first one named on a line
+	currency := invoice.InvoiceAmt.Currency
+	for _, line := range invoice.Lines {
+		for _, amount := range []Money{line.UnitPrice, line.TaxAmt} {
+			if currency == "" {
+				currency = amount.Currency
+			}
+		}
+	}
+	if currency == "" {
+		currency = ufaCurrency
+	}
+	total := Money{Currency: currency}
+	taxTotal := Money{Currency: currency}
+	for i := range invoice.Lines {
+		line := &invoice.Lines[i]
+		if line.Description == "" {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_LINE_ITEM, lineField(i, "description"), "Line "+strconv.Itoa(i+1)+" of invoice "+invoice.InvoiceNumber+" needs a description"))
+		}
+		if line.Quantity <= 0 {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_LINE_ITEM, lineField(i, "quantity"), "Invalid quantity "+line.Quantity.String()+" on line "+strconv.Itoa(i+1)+" of invoice "+invoice.InvoiceNumber))
+		}
+		unitPrice, err := labelAmount(line.UnitPrice, currency)
+		if err != nil {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_CURRENCY_MISMATCH, lineField(i, "unitPrice"), "Invalid unit price on invoice "+invoice.InvoiceNumber+": "+err.Error()))
+			continue
+		}
+		taxAmt, err := labelAmount(line.TaxAmt, currency)
+		if err != nil {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_CURRENCY_MISMATCH, lineField(i, "taxAmt"), "Invalid tax amount on invoice "+invoice.InvoiceNumber+": "+err.Error()))
+			continue
+		}
+		if unitPrice.Units < 0 {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_LINE_ITEM, lineField(i, "unitPrice"), "Negative price on line "+strconv.Itoa(i+1)+" of invoice "+invoice.InvoiceNumber))
+		}
+		netAmt := line.Quantity.times(unitPrice)
+		//The tax sent with a line is checked against the tax computed from the rules
+		computedTax := line.TaxRate.taxOn(netAmt)
+		if !isUnset(line.TaxAmt) && taxAmt != computedTax && line.TaxCode == "" {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_TAX_MISMATCH, lineField(i, "taxAmt"),
+				"Line "+strconv.Itoa(i+1)+" of invoice "+invoice.InvoiceNumber+" has no tax code and is not taxed"))
+		} else if !isUnset(line.TaxAmt) && taxAmt != computedTax {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_TAX_MISMATCH, lineField(i, "taxAmt"),
+				"Tax on line "+strconv.Itoa(i+1)+" of invoice "+invoice.InvoiceNumber+" is "+computedTax.String()+" under tax code "+line.TaxCode+" at "+line.TaxRate.String()+"%, not "+taxAmt.String()))
+		}
+		taxAmt = computedTax
+		if sent, err := labelAmount(line.NetAmt, currency); !isUnset(line.NetAmt) && (err != nil || sent != netAmt) {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_LINE_TOTAL_MISMATCH, lineField(i, "netAmt"),
+				"Line "+strconv.Itoa(i+1)+" of invoice "+invoice.InvoiceNumber+" comes to "+netAmt.String()+", not "+line.NetAmt.String()))
+		}
+		line.UnitPrice = unitPrice
+		line.TaxAmt = taxAmt
+		line.NetAmt = netAmt
+		lineTotal, err := netAmt.plus(taxAmt)
+		if err == nil {
+			total, err = total.plus(lineTotal)
+		}
+		if err == nil {
+			taxTotal, err = taxTotal.plus(taxAmt)
+		}
+		if err != nil {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_CURRENCY_MISMATCH, lineField(i, "netAmt"), "Invalid line "+strconv.Itoa(i+1)+" of invoice "+invoice.InvoiceNumber+": "+err.Error()))
+		}
+	}
+	if len(errorMessages) > 0 {
+		return errorMessages
+	}
+	invoice.TaxAmt = &taxTotal
+	if isUnset(invoice.InvoiceAmt) {
+		invoice.InvoiceAmt = total
+	} else if amount, err := labelAmount(invoice.InvoiceAmt, currency); err != nil || amount != total {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_LINE_TOTAL_MISMATCH, "invoiceAmt",
+			"Invoice "+invoice.InvoiceNumber+" is for "+invoice.InvoiceAmt.String()+" but its lines come to "+total.String()))
+	}
+	return errorMessages
+}
+
+//Labels an amount with the currency of the lines, amounts stay unlabelled
+//when neither the lines nor the UFA name one
+func labelAmount(amount Money, currency string) (Money, error) {
+	if currency == "" {
+		return amount, nil
+	}
+	return amount.withCurrency(currency)
+}
+
+//Returns the line items of the invoices raised for an UFA, one entry per line
+func getInvoiceLines(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("getInvoiceLines called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber := lastArg(args)
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	invoices, err := getInvoiceRecords(stub, ufanumber)
+	if err != nil {
+		return nil, errors.New("Unable to get the invoices of UFA " + ufanumber + ": " + err.Error())
+	}
+	lines := []InvoiceLine{}
+	for _, invoice := range invoices {
+		for i, item := range invoice.Lines {
+			totalAmt, err := item.NetAmt.plus(item.TaxAmt)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, InvoiceLine{
+				InvoiceNumber: invoice.InvoiceNumber,
+				BillingPeriod: invoice.BillingPeriod,
+				Side:          invoice.Side,
+				Status:        invoice.Status,
+				Line:          i + 1,
+				LineItem:      item,
+				TotalAmt:      totalAmt,
+			})
+		}
+	}
+	logger.Info("Returning " + strconv.Itoa(len(lines)) + " invoice lines of UFA " + ufanumber)
+	return json.Marshal(lines)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+//Returns a seller invoice and its buyer copy for a billing period carrying
+//the line items, the invoice amount is left to the chaincode
+func linePair(period string, lines string) string {
+	return `[{"invoiceNumber":"S-` + period + `","ufanumber":"UFA1","billingPeriod":"` + period + `","side":"seller","lines":` + lines + `},` +
+		`{"invoiceNumber":"B-` + period + `","ufanumber":"UFA1","billingPeriod":"` + period + `","side":"buyer","lines":` + lines + `}]`
+}
+
+func TestInvoiceLinesPriced(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.setCaller(admin)
+	stub.mustInvoke("setTaxRule", "VAT", "2017-01-01", "20")
+	stub.setCaller(seller)
+	stub.mustInvoke("createInvoices", linePair("2017-10", `[
+		{"description":"Jet fuel","quantity":"2.5","unitPrice":"10.01","taxCode":"VAT"},
+		{"description":"Handling","quantity":"1","unitPrice":"100"}]`))
+
+	invoice := readInvoice(t, stub, "UFA1", "S-2017-10")
+	//2.5 at 10.01 is 25.025 and 20% tax on it 5.006, both rounded half up
+	if invoice.InvoiceAmt != (Money{Units: 13004, Currency: "USD"}) || invoice.Lines[0].NetAmt != (Money{Units: 2503, Currency: "USD"}) {
+		t.Fatalf("Expected the invoice to be priced from its lines, got %+v", invoice)
+	}
+	if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal != invoice.InvoiceAmt {
+		t.Fatalf("Expected the priced amount to be booked, got %v", ufa.RaisedInvTotal)
+	}
+
+	var lines []InvoiceLine
+	if err := json.Unmarshal(stub.mustInvoke("getInvoiceLines", "UFA1"), &lines); err != nil {
+		t.Fatalf("Unable to parse the invoice lines: %v", err)
+	}
+	if len(lines) != 4 || lines[0].Line != 1 || lines[1].Line != 2 || lines[0].TotalAmt != (Money{Units: 3004, Currency: "USD"}) {
+		t.Fatalf("Expected a line per charge of both copies, got %+v", lines)
+	}
+	stub.setCaller(outsider)
+	if err := responseError(t, stub.invoke("getInvoiceLines", "UFA1")); err.Code != ERR_NOT_A_PARTY {
+		t.Fatalf("Expected an outsider to be refused the lines, got %+v", err)
+	}
+}
+
+func TestInvoiceLinesValidation(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+
+	line := `{"description":"Jet fuel","quantity":"2","unitPrice":"10"}`
+	tests := []struct {
+		name    string
+		payload string
+		code    string
+	}{
+		{"amount not matching", strings.Replace(linePair("2017-10", "["+line+"]"), `"side"`, `"invoiceAmt":"21","side"`, -1), ERR_LINE_TOTAL_MISMATCH},
+		{"net amount not matching", linePair("2017-10", `[{"description":"Jet fuel","quantity":"2","unitPrice":"10","netAmt":"19"}]`), ERR_LINE_TOTAL_MISMATCH},
+		{"zero quantity", linePair("2017-10", `[{"description":"Jet fuel","quantity":"0","unitPrice":"10"}]`), ERR_INVALID_LINE_ITEM},
+		{"missing description", linePair("2017-10", `[{"quantity":"1","unitPrice":"10"}]`), ERR_INVALID_LINE_ITEM},
+		{"negative price", linePair("2017-10", `[{"description":"Jet fuel","quantity":"1","unitPrice":"-10"}]`), ERR_INVALID_LINE_ITEM},
+		{"mixed currencies", linePair("2017-10", `[{"description":"Jet fuel","quantity":"1","unitPrice":{"amount":"10","currency":"USD"},"taxAmt":{"amount":"1","currency":"EUR"}}]`), ERR_CURRENCY_MISMATCH},
+		{"copies diverging", strings.Replace(linePair("2017-10", "["+line+"]"), `"buyer","lines":[{"description":"Jet fuel","quantity":"2"`, `"buyer","lines":[{"description":"Jet fuel","quantity":"3"`, 1), ERR_COPIES_DIVERGE},
+	}
+	for _, test := range tests {
+		err := responseError(t, stub.invoke("createInvoices", test.payload))
+		if !hasDetail(err, test.code, "") {
+			t.Fatalf("%s: expected %s, got %+v", test.name, test.code, err)
+		}
+	}
+	stub.mustInvoke("createInvoices", strings.Replace(linePair("2017-10", `[{"description":"Jet fuel","quantity":"2","unitPrice":"10","netAmt":"20"}]`), `"side"`, `"invoiceAmt":"20","side"`, -1))
+}
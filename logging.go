@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+//chaincodeLogger Levelled logger standing in for the shim logger dropped after Fabric v0.6
+type chaincodeLogger struct {
+	*log.Logger
+}
+
+//Creates a logger writing to the chaincode container's stdout
+func newChaincodeLogger(name string) *chaincodeLogger {
+	return &chaincodeLogger{log.New(os.Stdout, name+" ", log.LstdFlags|log.Lmicroseconds)}
+}
+
+//Info Logs an informational message
+func (l *chaincodeLogger) Info(args ...interface{}) {
+	l.Output(2, "INFO "+fmt.Sprint(args...))
+}
+
+//Error Logs an error message
+func (l *chaincodeLogger) Error(args ...interface{}) {
+	l.Output(2, "ERROR "+fmt.Sprint(args...))
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//recordFields Ledger record as its raw JSON attributes. Migrations rewrite
+//these rather than the model so they keep working as the model moves on.
+type recordFields map[string]json.RawMessage
+
+//recordRewrite Rewrites a record in place and tells whether it changed
+type recordRewrite func(stub shim.ChaincodeStubInterface, fields recordFields) (bool, error)
+
+//migration Rewrite of the ledger records into a schema version
+type migration struct {
+	version     int
+	description string
+	//Moves the records of an older layout under their composite keys, nil if none
+	relayout func(stub shim.ChaincodeStubInterface) (*ledgerMove, error)
+	//Rewrites by object type of the records
+	rewrites map[string]recordRewrite
+}
+
+//ledgerMove Records moved under composite keys by a relayout
+type ledgerMove struct {
+	//Moved records by object type, rewritten by the migrations which follow
+	records map[string][]ledgerRecord
+	//Records written as they are, e.g. index and history entries
+	written []ledgerRecord
+	//Keys of the older layout the move empties
+	deleted []string
+	changes []RecordChange
+}
+
+//Keys of the layout of schema 0, written by the releases before composite keys
+const (
+	//ALL_ELEMENENTS Key of the list of all the UFA numbers
+	ALL_ELEMENENTS = "ALL_RECS"
+	//ALL_INVOICES Key of the list of all the invoice numbers
+	ALL_INVOICES = "ALL_INVOICES"
+	//UFA_TRXN_PREFIX Key prefix of the array of payloads an UFA was written with
+	UFA_TRXN_PREFIX = "UFA_TRXN_HISTORY_"
+)
+
+//Migrations in schema version order, the last one moves the records into
+//LEDGER_SCHEMA_VERSION. Ledgers without a schema version are in the layout
+//of schema 0: the releases which kept UFAs and invoices under their bare
+//numbers and the first builds with composite keys, the move finds nothing on those.
+var migrations = []migration{
+	{1, "Move the UFAs and invoices of ALL_RECS and ALL_INVOICES under composite keys and fold the UFA_TRXN_HISTORY_ arrays into the history", moveBaselineRecords, nil},
+	{2, "Nest the invperiod_ attributes of UFAs under invoicePeriods", nil, map[string]recordRewrite{
+		UFA_KEY_TYPE: nestInvoicePeriods,
+	}},
+	{3, "Write the string amounts of UFAs and invoices as money in the currency of the UFA", nil, map[string]recordRewrite{
+		UFA_KEY_TYPE:     labelUFAAmounts,
+		INVOICE_KEY_TYPE: labelInvoiceAmounts,
+	}},
+	{4, "Round the float amounts of UFAs and invoices without a currency to cents", nil, map[string]recordRewrite{
+		UFA_KEY_TYPE:     roundUFAAmounts,
+		INVOICE_KEY_TYPE: roundInvoiceAmounts,
+	}},
+	{5, "Drop the allInvoiceList of UFAs, the invoices are listed from their records", nil, map[string]recordRewrite{
+		UFA_KEY_TYPE: dropInvoiceList,
+	}},
+}
+
+//Object types of the records migrations rewrite, in the order they are migrated
+var migratedObjectTypes = []string{UFA_KEY_TYPE, INVOICE_KEY_TYPE}
+
+//Amounts of the records, plain decimal strings before currencies were recorded
+var ufaAmountFields = []string{"netCharge", "raisedInvTotal", "creditedTotal"}
+var invoiceAmountFields = []string{"invoiceAmt", "bookedAmt"}
+
+//MigrationReport Migrations run on the ledger, or on a dry run the ones which would be
+type MigrationReport struct {
+	DryRun      bool              `json:"dryRun"`
+	FromVersion int               `json:"fromVersion"`
+	ToVersion   int               `json:"toVersion"`
+	Migrations  []MigrationResult `json:"migrations"`
+}
+
+//MigrationResult Records rewritten by a migration
+type MigrationResult struct {
+	Version     int            `json:"version"`
+	Description string         `json:"description"`
+	Changes     []RecordChange `json:"changes"`
+}
+
+//RecordChange Record before and after a migration rewrote it
+type RecordChange struct {
+	ObjectType string          `json:"objectType"`
+	Key        []string        `json:"key"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+}
+
+//migrationState Ledger as the running migrations left it. Reads in a
+//transaction do not see its own writes, reads through the state see the
+//records already migrated.
+type migrationState struct {
+	shim.ChaincodeStubInterface
+	//Records written by the migrations, nil values are deletions
+	written map[string][]byte
+}
+
+//GetState Reads a record as migrated so far
+func (s *migrationState) GetState(key string) ([]byte, error) {
+	if value, found := s.written[key]; found {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+//pendingRecord Record to migrate and the first migration which applies to it
+type pendingRecord struct {
+	ledgerRecord
+	from int
+}
+
+//Runs the migrations from the schema version of the ledger to the one of
+//this build and records it. Each record is written once with all the
+//migrations applied. A dry run reports the changes without writing anything.
+func runMigrations(stub shim.ChaincodeStubInterface, dryRun bool) (*MigrationReport, error) {
+	from, err := getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	if from > LEDGER_SCHEMA_VERSION {
+		return nil, newChaincodeError(ERR_SCHEMA_TOO_NEW, "", "Ledger schema version "+strconv.Itoa(from)+" is newer than version "+strconv.Itoa(LEDGER_SCHEMA_VERSION)+" of this build")
+	}
+	report := &MigrationReport{DryRun: dryRun, FromVersion: from, ToVersion: LEDGER_SCHEMA_VERSION, Migrations: make([]MigrationResult, 0)}
+	if from == LEDGER_SCHEMA_VERSION {
+		return report, nil
+	}
+	pending := make([]migration, 0)
+	for _, m := range migrations {
+		if m.version > from {
+			pending = append(pending, m)
+			report.Migrations = append(report.Migrations, MigrationResult{Version: m.version, Description: m.description, Changes: make([]RecordChange, 0)})
+		}
+	}
+	state := &migrationState{ChaincodeStubInterface: stub, written: make(map[string][]byte)}
+	records := make(map[string][]pendingRecord)
+	for _, objectType := range migratedObjectTypes {
+		committed, err := getRecordsByPartialKey(stub, objectType, []string{})
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range committed {
+			records[objectType] = append(records[objectType], pendingRecord{record, 0})
+		}
+	}
+	for i, m := range pending {
+		if m.relayout == nil {
+			continue
+		}
+		move, err := m.relayout(state)
+		if err != nil {
+			return nil, newChaincodeError(ERR_MIGRATION_FAILED, "", fmt.Sprintf("Migration %d failed: %s", m.version, err.Error()))
+		}
+		report.Migrations[i].Changes = append(report.Migrations[i].Changes, move.changes...)
+		for _, key := range move.deleted {
+			state.written[key] = nil
+		}
+		for _, record := range move.written {
+			state.written[record.Key] = record.Value
+		}
+		for objectType, moved := range move.records {
+			for _, record := range moved {
+				state.written[record.Key] = record.Value
+				records[objectType] = append(records[objectType], pendingRecord{record, i + 1})
+			}
+		}
+	}
+	for _, objectType := range migratedObjectTypes {
+		for _, record := range records[objectType] {
+			_, attributes, err := stub.SplitCompositeKey(record.Key)
+			if err != nil {
+				return nil, err
+			}
+			value := record.Value
+			for i, m := range pending[record.from:] {
+				rewrite, found := m.rewrites[objectType]
+				if !found {
+					continue
+				}
+				rewritten, changed, err := applyRewrite(state, rewrite, value)
+				if err != nil {
+					return nil, newChaincodeError(ERR_MIGRATION_FAILED, "", fmt.Sprintf("Migration %d failed on %s %s: %s", m.version, objectType, strings.Join(attributes, "/"), err.Error()))
+				}
+				if changed {
+					report.Migrations[record.from+i].Changes = append(report.Migrations[record.from+i].Changes, RecordChange{ObjectType: objectType, Key: attributes, Before: value, After: rewritten})
+					value = rewritten
+				}
+			}
+			//Later records, e.g. the invoices of an UFA, read it as migrated
+			if !bytes.Equal(value, record.Value) {
+				state.written[record.Key] = value
+			}
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+	keys := make([]string, 0, len(state.written))
+	for key := range state.written {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if state.written[key] == nil {
+			err = stub.DelState(key)
+		} else {
+			err = stub.PutState(key, state.written[key])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.Info(fmt.Sprintf("Migrated the ledger from schema version %d to %d", from, LEDGER_SCHEMA_VERSION))
+	if err := putSchemaVersion(stub, LEDGER_SCHEMA_VERSION); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+//Applies a rewrite to a record, returns the rewritten record if it changed
+func applyRewrite(stub shim.ChaincodeStubInterface, rewrite recordRewrite, value []byte) ([]byte, bool, error) {
+	var fields recordFields
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, false, err
+	}
+	changed, err := rewrite(stub, fields)
+	if err != nil || !changed {
+		return nil, false, err
+	}
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false, err
+	}
+	return rewritten, true, nil
+}
+
+//Reads a list of record numbers of schema 0, nil if the ledger has none
+func getBaselineList(stub shim.ChaincodeStubInterface, key string) ([]byte, []string, error) {
+	listBytes, err := stub.GetState(key)
+	if err != nil || listBytes == nil {
+		return nil, nil, err
+	}
+	var numbers []string
+	if err := json.Unmarshal(listBytes, &numbers); err != nil {
+		return nil, nil, errors.New(key + ": " + err.Error())
+	}
+	return listBytes, numbers, nil
+}
+
+//Reads a record of schema 0 kept under its bare number, filling in the number
+//when the payload it was created with lacks it. Nil if it does not exist.
+func getBaselineRecord(stub shim.ChaincodeStubInterface, number string, numberField string) ([]byte, recordFields, error) {
+	value, err := stub.GetState(number)
+	if err != nil || value == nil {
+		return nil, nil, err
+	}
+	var fields recordFields
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, nil, errors.New(number + ": " + err.Error())
+	}
+	if _, found := fields[numberField]; !found {
+		fields[numberField], _ = json.Marshal(number)
+	}
+	return value, fields, nil
+}
+
+//Moves the UFAs and invoices schema 0 kept under their bare numbers, listed
+//in ALL_RECS and ALL_INVOICES, under their composite keys and indexes the
+//invoices by number. The lists are dropped. Numbers listed without a record
+//are skipped, the releases of schema 0 listed an empty invoice number for
+//every invoice raised.
+func moveBaselineRecords(stub shim.ChaincodeStubInterface) (*ledgerMove, error) {
+	move := &ledgerMove{records: make(map[string][]ledgerRecord)}
+	ufaList, ufanumbers, err := getBaselineList(stub, ALL_ELEMENENTS)
+	if err != nil {
+		return nil, err
+	}
+	invoiceList, invoiceNumbers, err := getBaselineList(stub, ALL_INVOICES)
+	if err != nil {
+		return nil, err
+	}
+	for _, ufanumber := range ufanumbers {
+		value, fields, err := getBaselineRecord(stub, ufanumber, "ufanumber")
+		if err != nil {
+			return nil, errors.New("UFA " + err.Error())
+		}
+		if value == nil {
+			logger.Info("UFA " + ufanumber + " listed in " + ALL_ELEMENENTS + " does not exist, skipped")
+			continue
+		}
+		key, err := ufaKey(stub, ufanumber)
+		if err != nil {
+			return nil, err
+		}
+		moved, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		move.records[UFA_KEY_TYPE] = append(move.records[UFA_KEY_TYPE], ledgerRecord{Key: key, Value: moved})
+		move.deleted = append(move.deleted, ufanumber)
+		move.changes = append(move.changes, RecordChange{ObjectType: UFA_KEY_TYPE, Key: []string{ufanumber}, Before: value, After: moved})
+		if err := foldBaselineHistory(stub, move, ufanumber); err != nil {
+			return nil, err
+		}
+	}
+	for _, invoiceNumber := range invoiceNumbers {
+		if invoiceNumber == "" {
+			continue
+		}
+		value, fields, err := getBaselineRecord(stub, invoiceNumber, "invoiceNumber")
+		if err != nil {
+			return nil, errors.New("Invoice " + err.Error())
+		}
+		if value == nil {
+			logger.Info("Invoice " + invoiceNumber + " listed in " + ALL_INVOICES + " does not exist, skipped")
+			continue
+		}
+		var invoice Invoice
+		json.Unmarshal(fields["ufanumber"], &invoice.UFANumber)
+		json.Unmarshal(fields["billingPeriod"], &invoice.BillingPeriod)
+		if invoice.UFANumber == "" || invoice.BillingPeriod == "" {
+			return nil, errors.New("Invoice " + invoiceNumber + " has no UFA number or billing period")
+		}
+		invoice.InvoiceNumber = invoiceNumber
+		//Invoices were raised without a lifecycle, they enter it as raised
+		if _, found := fields["status"]; !found {
+			fields["status"], _ = json.Marshal(INVOICE_RAISED)
+		}
+		key, err := invoiceKey(stub, &invoice)
+		if err != nil {
+			return nil, err
+		}
+		indexKey, err := invoiceNumberKey(stub, invoiceNumber)
+		if err != nil {
+			return nil, err
+		}
+		moved, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		move.records[INVOICE_KEY_TYPE] = append(move.records[INVOICE_KEY_TYPE], ledgerRecord{Key: key, Value: moved})
+		move.written = append(move.written, ledgerRecord{Key: indexKey, Value: []byte(key)})
+		move.deleted = append(move.deleted, invoiceNumber)
+		move.changes = append(move.changes, RecordChange{ObjectType: INVOICE_KEY_TYPE, Key: []string{invoice.UFANumber, invoice.BillingPeriod, invoiceNumber}, Before: value, After: moved})
+	}
+	if ufaList != nil {
+		move.deleted = append(move.deleted, ALL_ELEMENENTS)
+	}
+	if invoiceList != nil {
+		move.deleted = append(move.deleted, ALL_INVOICES)
+	}
+	return move, nil
+}
+
+//Folds the UFA_TRXN_HISTORY_ array of an UFA into one history entry of the
+//migration listing the payloads under legacyHistory. The array records
+//neither the time nor the author of the payloads.
+func foldBaselineHistory(stub shim.ChaincodeStubInterface, move *ledgerMove, ufanumber string) error {
+	key := UFA_TRXN_PREFIX + ufanumber
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return err
+	}
+	var payloads []string
+	if err := json.Unmarshal(value, &payloads); err != nil {
+		return errors.New(key + ": " + err.Error())
+	}
+	legacyHistory := make([]interface{}, 0, len(payloads))
+	for _, payload := range payloads {
+		var written interface{}
+		if err := json.Unmarshal([]byte(payload), &written); err != nil {
+			//Kept as written when it is not JSON
+			written = payload
+		}
+		legacyHistory = append(legacyHistory, written)
+	}
+	record, err := newHistoryRecord(stub, "", ufanumber, []FieldChange{{Path: "legacyHistory", New: legacyHistory}})
+	if err != nil {
+		return err
+	}
+	_, attributes, err := stub.SplitCompositeKey(record.Key)
+	if err != nil {
+		return err
+	}
+	move.written = append(move.written, record)
+	move.deleted = append(move.deleted, key)
+	move.changes = append(move.changes, RecordChange{ObjectType: HISTORY_KEY_TYPE, Key: attributes, Before: value, After: record.Value})
+	return nil
+}
+
+//Moves the invperiod_<period> attributes of an UFA into the invoicePeriods object
+func nestInvoicePeriods(stub shim.ChaincodeStubInterface, fields recordFields) (bool, error) {
+	periods := make(map[string]string)
+	if nested, found := fields["invoicePeriods"]; found {
+		if err := json.Unmarshal(nested, &periods); err != nil {
+			return false, errors.New("invoicePeriods: " + err.Error())
+		}
+	}
+	moved := false
+	for name, value := range fields {
+		if !strings.HasPrefix(name, INVOICE_PERIOD_PREFIX) {
+			continue
+		}
+		var invoiceList string
+		if err := json.Unmarshal(value, &invoiceList); err != nil {
+			return false, errors.New(name + ": " + err.Error())
+		}
+		periods[strings.TrimPrefix(name, INVOICE_PERIOD_PREFIX)] = invoiceList
+		delete(fields, name)
+		moved = true
+	}
+	if !moved {
+		return false, nil
+	}
+	nested, err := json.Marshal(periods)
+	if err != nil {
+		return false, err
+	}
+	fields["invoicePeriods"] = nested
+	return true, nil
+}
+
+//Returns the currency of a record, empty if it has none
+func recordCurrency(fields recordFields) (string, error) {
+	var currency string
+	if value, found := fields["currency"]; found {
+		if err := json.Unmarshal(value, &currency); err != nil {
+			return "", errors.New("currency: " + err.Error())
+		}
+	}
+	return currency, nil
+}
+
+//Writes the amounts of a record given as plain decimal strings as money in the currency
+func labelAmounts(fields recordFields, names []string, currency string) (bool, error) {
+	changed := false
+	for _, name := range names {
+		value, found := fields[name]
+		if !found || !bytes.HasPrefix(bytes.TrimSpace(value), []byte(`"`)) {
+			continue
+		}
+		var amount Money
+		if err := json.Unmarshal(value, &amount); err != nil {
+			return false, errors.New(name + ": " + err.Error())
+		}
+		labelled, err := amount.withCurrency(currency)
+		if err != nil {
+			return false, errors.New(name + ": " + err.Error())
+		}
+		if fields[name], err = json.Marshal(labelled); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+//Writes the string amounts of an UFA with a currency as money in it
+func labelUFAAmounts(stub shim.ChaincodeStubInterface, fields recordFields) (bool, error) {
+	currency, err := recordCurrency(fields)
+	if err != nil || currency == "" {
+		return false, err
+	}
+	return labelAmounts(fields, ufaAmountFields, currency)
+}
+
+//Writes the string amounts of an invoice as money in the currency of its UFA,
+//invoices of UFAs without a currency keep plain amounts. No migration changes
+//the currency, so the UFA as committed has the right one.
+func labelInvoiceAmounts(stub shim.ChaincodeStubInterface, fields recordFields) (bool, error) {
+	var ufanumber string
+	if err := json.Unmarshal(fields["ufanumber"], &ufanumber); err != nil {
+		return false, errors.New("ufanumber: " + err.Error())
+	}
+	key, err := ufaKey(stub, ufanumber)
+	if err != nil {
+		return false, err
+	}
+	ufaBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	if ufaBytes == nil {
+		return false, errors.New("UFA " + ufanumber + " does not exist")
+	}
+	var ufa recordFields
+	if err := json.Unmarshal(ufaBytes, &ufa); err != nil {
+		return false, errors.New("UFA " + ufanumber + ": " + err.Error())
+	}
+	currency, err := recordCurrency(ufa)
+	if err != nil || currency == "" {
+		return false, err
+	}
+	return labelAmounts(fields, invoiceAmountFields, currency)
+}
+
+//Rounds the amounts of a record still given as plain decimal strings to
+//cents, see roundDecimal. Amounts in a currency were labelled with it by
+//migration 3 and are exact.
+func roundAmounts(fields recordFields, names []string) (bool, error) {
+	changed := false
+	for _, name := range names {
+		value, found := fields[name]
+		if !found || !bytes.HasPrefix(bytes.TrimSpace(value), []byte(`"`)) {
+			continue
+		}
+		var amount string
+		if err := json.Unmarshal(value, &amount); err != nil {
+			return false, errors.New(name + ": " + err.Error())
+		}
+		rounded, err := roundDecimal(amount, DEFAULT_MINOR_DIGITS)
+		if err != nil {
+			return false, errors.New(name + ": " + err.Error())
+		}
+		if rounded == amount {
+			continue
+		}
+		if fields[name], err = json.Marshal(rounded); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+//Rounds the float amounts of an UFA without a currency
+func roundUFAAmounts(stub shim.ChaincodeStubInterface, fields recordFields) (bool, error) {
+	return roundAmounts(fields, ufaAmountFields)
+}
+
+//Rounds the float amounts of an invoice of an UFA without a currency
+func roundInvoiceAmounts(stub shim.ChaincodeStubInterface, fields recordFields) (bool, error) {
+	return roundAmounts(fields, invoiceAmountFields)
+}
+
+//Drops the list of all the invoice numbers of an UFA, the invoices of each
+//billing period stay under invoicePeriods
+func dropInvoiceList(stub shim.ChaincodeStubInterface, fields recordFields) (bool, error) {
+	if _, found := fields["allInvoiceList"]; !found {
+		return false, nil
+	}
+	delete(fields, "allInvoiceList")
+	return true, nil
+}
+
+//Runs the migrations for an administrator and returns the report
+func migrateByAdmin(stub shim.ChaincodeStubInterface, dryRun bool) ([]byte, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !caller.isAdmin() {
+		return nil, newChaincodeError(ERR_NOT_AUTHORIZED, "", "User "+caller.Email+" is not allowed to migrate the ledger")
+	}
+	report, err := runMigrations(stub, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(report)
+}
+
+//Migrates the ledger to the schema of this build, for upgrades which do not run Init
+func migrateLedger(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	logger.Info("migrateLedger called")
+	return migrateByAdmin(stub, false)
+}
+
+//Reports the changes migrating the ledger would make without making them
+func planMigrations(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	logger.Info("planMigrations called")
+	return migrateByAdmin(stub, true)
+}
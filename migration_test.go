@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+)
+
+//Reads the raw fields of a committed record
+func readRecord(t *testing.T, stub *ledgerStub, key string) map[string]interface{} {
+	t.Helper()
+	var fields map[string]interface{}
+	recBytes, _ := stub.MockStub.GetState(key)
+	if err := json.Unmarshal(recBytes, &fields); err != nil {
+		t.Fatalf("Unable to parse the record: %v", err)
+	}
+	return fields
+}
+
+//Commits records and the schema version as an older build left them
+func putLegacyState(t *testing.T, stub *ledgerStub, schemaVersion string, records map[string]map[string]interface{}) {
+	t.Helper()
+	stub.MockTransactionStart("legacy")
+	defer stub.MockTransactionEnd("legacy")
+	stub.MockStub.PutState(SCHEMA_VERSION, []byte(schemaVersion))
+	for key, fields := range records {
+		recBytes, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Unable to marshal the record: %v", err)
+		}
+		stub.MockStub.PutState(key, recBytes)
+	}
+}
+
+//Returns a ledger holding an UFA and an invoice in the layout of schema 1
+func newLegacyLedger(t *testing.T) (*ledgerStub, string, string) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 100)))
+	key, _ := ufaKey(stub, "UFA1")
+	invKey, _ := invoiceKey(stub, &Invoice{UFANumber: "UFA1", BillingPeriod: "2017-10", InvoiceNumber: "S-2017-10"})
+	ufa := readRecord(t, stub, key)
+	for period, invoiceList := range ufa["invoicePeriods"].(map[string]interface{}) {
+		ufa[INVOICE_PERIOD_PREFIX+period] = invoiceList
+	}
+	delete(ufa, "invoicePeriods")
+	ufa["netCharge"], ufa["raisedInvTotal"] = "1000.00", "100.00"
+	invoice := readRecord(t, stub, invKey)
+	invoice["invoiceAmt"], invoice["bookedAmt"] = "100", "100"
+	putLegacyState(t, stub, "1", map[string]map[string]interface{}{key: ufa, invKey: invoice})
+	return stub, key, invKey
+}
+
+//Payloads of UFA1 as the releases of schema 0 wrote them, on createUFA and createInvoices
+const (
+	baselineUFA = `{"seller":{"name":"Shell","mspid":"SellerMSP"},"buyer":{"name":"Customer","mspid":"BuyerMSP"},` +
+		`"sellerApprover":{"emailid":"seller@shell.com"},"buyerApprover":{"emailid":"buyer@customer.com"},` +
+		`"netCharge":"1000","chargTolrence":"10","status":"Agreed"}`
+	baselineInvoicedUFA = `{"allInvoiceList":"S-2017-10,B-2017-10,","buyer":{"mspid":"BuyerMSP","name":"Customer"},` +
+		`"buyerApprover":{"emailid":"buyer@customer.com"},"chargTolrence":"10","invperiod_2017-10":"S-2017-10,B-2017-10,",` +
+		`"netCharge":"1000","raisedInvTotal":"100","seller":{"mspid":"SellerMSP","name":"Shell"},` +
+		`"sellerApprover":{"emailid":"seller@shell.com"},"status":"Agreed"}`
+)
+
+//Returns a ledger written the way the releases of schema 0 wrote it: Init,
+//createUFA of UFA1 and createInvoices of a pair for 2017-10. Init of this
+//build has not run on it.
+func newBaselineLedger(t *testing.T) *ledgerStub {
+	cc := new(UFAChainCode)
+	stub := &ledgerStub{MockStub: shimtest.NewMockStub("ufa", cc), t: t, cc: cc}
+	history, _ := json.Marshal([]string{baselineUFA, baselineInvoicedUFA})
+	stub.MockTransactionStart("baseline")
+	defer stub.MockTransactionEnd("baseline")
+	for key, value := range map[string]string{
+		CHAIN_CODE_VERSION:       "Fri Dec  1 08:00:00 UTC 2017",
+		ALL_ELEMENENTS:           `["UFA1"]`,
+		ALL_INVOICES:             `["","","S-2017-10","B-2017-10"]`,
+		"UFA1":                   baselineInvoicedUFA,
+		UFA_TRXN_PREFIX + "UFA1": string(history),
+		"S-2017-10":              `{"invoiceNumber":"S-2017-10","ufanumber":"UFA1","billingPeriod":"2017-10","invoiceAmt":"100","raisedBy":"seller@shell.com"}`,
+		"B-2017-10":              `{"invoiceNumber":"B-2017-10","ufanumber":"UFA1","billingPeriod":"2017-10","invoiceAmt":"100","raisedBy":"seller@shell.com"}`,
+	} {
+		stub.MockStub.PutState(key, []byte(value))
+	}
+	return stub
+}
+
+func TestMigrateBaselineLedger(t *testing.T) {
+	stub := newBaselineLedger(t)
+	stub.setCaller(admin)
+	var plan MigrationReport
+	json.Unmarshal(stub.mustInvoke("planMigrations"), &plan)
+	if plan.FromVersion != 0 || len(plan.Migrations) != LEDGER_SCHEMA_VERSION {
+		t.Fatalf("Expected every migration to run on a ledger of schema 0, got %+v", plan)
+	}
+	//The UFA, its history and both invoices are moved
+	if changes := plan.Migrations[0].Changes; len(changes) != 4 || changes[0].ObjectType != UFA_KEY_TYPE || changes[1].ObjectType != HISTORY_KEY_TYPE ||
+		strings.Join(changes[3].Key, "/") != "UFA1/2017-10/B-2017-10" {
+		t.Fatalf("Expected UFA1 and its invoices to be moved, got %+v", changes)
+	}
+	if changes := plan.Migrations[1].Changes; len(changes) != 1 || strings.Join(changes[0].Key, "/") != "UFA1" {
+		t.Fatalf("Expected the invoice periods of the moved UFA to be nested, got %+v", changes)
+	}
+
+	if res := stub.init(); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	for _, key := range []string{ALL_ELEMENENTS, ALL_INVOICES, "UFA1", UFA_TRXN_PREFIX + "UFA1", "S-2017-10", "B-2017-10"} {
+		if value, _ := stub.MockStub.GetState(key); value != nil {
+			t.Errorf("Expected %s to be removed, got %s", key, value)
+		}
+	}
+	if result := readProbe(t, stub); result.Counts.UFAs != 1 || result.Counts.Invoices != 2 || result.LedgerSchema != LEDGER_SCHEMA_VERSION {
+		t.Fatalf("Expected the moved records to be counted, got %+v", result)
+	}
+	stub.setCaller(seller)
+	var ufas []UFA
+	json.Unmarshal(stub.mustInvoke("getAllUFA"), &ufas)
+	if len(ufas) != 1 || ufas[0].UFANumber != "UFA1" || ufas[0].InvoicePeriods["2017-10"] != "S-2017-10,B-2017-10," || ufas[0].RaisedInvTotal.String() != "100.00" {
+		t.Fatalf("Expected UFA1 to be listed as it was written, got %+v", ufas)
+	}
+	key, _ := ufaKey(stub, "UFA1")
+	if _, found := readRecord(t, stub, key)["allInvoiceList"]; found {
+		t.Fatal("Expected the invoice list of UFA1 to be dropped")
+	}
+	if invoice := readInvoice(t, stub, "UFA1", "B-2017-10"); invoice.InvoiceAmt.String() != "100.00" {
+		t.Fatalf("Expected the invoices of UFA1, got %+v", invoice)
+	}
+	//The invoice number index is written for the lifecycle functions
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveInvoice", "S-2017-10")
+	entries := readHistory(t, stub, "UFA1")
+	if len(entries) != 2 || entries[0].Changes[0].Path != "legacyHistory" || len(entries[0].Changes[0].New.([]interface{})) != 2 {
+		t.Fatalf("Expected the history array to be folded into the history, got %+v", entries)
+	}
+}
+
+func TestRoundBaselineFloats(t *testing.T) {
+	stub := newBaselineLedger(t)
+	drifted := strings.Replace(baselineInvoicedUFA, `"raisedInvTotal":"100"`, `"raisedInvTotal":"333.33333333333337"`, 1)
+	stub.MockTransactionStart("drift")
+	stub.MockStub.PutState("UFA1", []byte(drifted))
+	stub.MockStub.PutState("S-2017-10", []byte(`{"invoiceNumber":"S-2017-10","ufanumber":"UFA1","billingPeriod":"2017-10","invoiceAmt":"666.665"}`))
+	stub.MockTransactionEnd("drift")
+	if res := stub.init(); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	stub.setCaller(seller)
+	if ufa := readUFA(t, stub, "UFA1"); ufa.RaisedInvTotal.String() != "333.33" {
+		t.Fatalf("Expected the drifted total to be rounded to cents, got %s", ufa.RaisedInvTotal)
+	}
+	if invoice := readInvoice(t, stub, "UFA1", "S-2017-10"); invoice.InvoiceAmt.String() != "666.67" {
+		t.Fatalf("Expected the invoice amount to be rounded half up, got %s", invoice.InvoiceAmt)
+	}
+}
+
+func TestInitIsIdempotent(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 100)))
+	if res := stub.init(); res.Status != shim.OK || len(stub.lastWriteSet) != 0 {
+		t.Fatalf("Expected Init of the same build to write nothing, got %s %v", res.Message, stub.lastWriteSet)
+	}
+	if ufa := readUFA(t, stub, "UFA1"); ufa.InvoicePeriods["2017-10"] == "" {
+		t.Fatalf("Expected Init to keep the records, got %+v", ufa)
+	}
+
+	defer func(commit string) { buildCommit = commit }(buildCommit)
+	buildCommit = "abc1234"
+	if stub.init(); len(stub.lastWriteSet) != 1 || stub.lastWriteSet[CHAIN_CODE_VERSION] == nil {
+		t.Fatalf("Expected an upgrade to only record the new build, got %v", stub.lastWriteSet)
+	}
+	if result := readProbe(t, stub); result.Deployment.Commit != "abc1234" || result.Counts.UFAs != 1 {
+		t.Fatalf("Expected the new build on the same ledger, got %+v", result)
+	}
+}
+
+func TestPlanAndRunMigrations(t *testing.T) {
+	stub, key, invKey := newLegacyLedger(t)
+	if err := responseError(t, stub.invoke("planMigrations")); err.Code != ERR_NOT_AUTHORIZED {
+		t.Fatalf("Expected only administrators to plan migrations, got %+v", err)
+	}
+	stub.setCaller(admin)
+	var plan MigrationReport
+	json.Unmarshal(stub.mustInvoke("planMigrations"), &plan)
+	if !plan.DryRun || plan.FromVersion != 1 || plan.ToVersion != LEDGER_SCHEMA_VERSION || len(plan.Migrations) != LEDGER_SCHEMA_VERSION-1 {
+		t.Fatalf("Expected the migrations from schema 1, got %+v", plan)
+	}
+	if changes := plan.Migrations[0].Changes; len(changes) != 1 || changes[0].ObjectType != UFA_KEY_TYPE || strings.Join(changes[0].Key, "/") != "UFA1" {
+		t.Fatalf("Expected the invoice periods of UFA1 to be nested, got %+v", changes)
+	}
+	//The UFA and the seller invoice carry plain amounts, the buyer copy does not
+	if changes := plan.Migrations[1].Changes; len(changes) != 2 || changes[1].ObjectType != INVOICE_KEY_TYPE {
+		t.Fatalf("Expected the amounts of UFA1 and its invoice to be labelled, got %+v", changes)
+	}
+	if _, flat := readRecord(t, stub, key)[INVOICE_PERIOD_PREFIX+"2017-10"]; !flat || len(stub.lastWriteSet) != 0 {
+		t.Fatalf("Expected a dry run to leave the ledger alone, wrote %v", stub.lastWriteSet)
+	}
+	stub.setCaller(seller)
+	if ufa := readUFA(t, stub, "UFA1"); ufa.InvoicePeriods["2017-10"] != "S-2017-10,B-2017-10," || ufa.NetCharge != whole(1000) {
+		t.Fatalf("Expected unmigrated UFAs to stay readable, got %+v", ufa)
+	}
+
+	stub.setCaller(admin)
+	stub.mustInvoke("migrateLedger")
+	ufa := readRecord(t, stub, key)
+	if _, flat := ufa[INVOICE_PERIOD_PREFIX+"2017-10"]; flat || ufa["invoicePeriods"] == nil {
+		t.Fatalf("Expected the invoice periods to be nested, got %v", ufa)
+	}
+	if amount, labelled := ufa["netCharge"].(map[string]interface{}); !labelled || amount["currency"] != "USD" {
+		t.Fatalf("Expected the net charge in USD, got %v", ufa["netCharge"])
+	}
+	if invoice := readRecord(t, stub, invKey); invoice["invoiceAmt"].(map[string]interface{})["amount"] != "100.00" {
+		t.Fatalf("Expected the invoice amount in USD, got %v", invoice["invoiceAmt"])
+	}
+	if schema, _ := stub.MockStub.GetState(SCHEMA_VERSION); string(schema) != strconv.Itoa(LEDGER_SCHEMA_VERSION) {
+		t.Fatalf("Expected the ledger to be at schema %d, got %s", LEDGER_SCHEMA_VERSION, schema)
+	}
+	json.Unmarshal(stub.mustInvoke("planMigrations"), &plan)
+	if len(plan.Migrations) != 0 {
+		t.Fatalf("Expected no migrations left, got %+v", plan.Migrations)
+	}
+	stub.setCaller(seller)
+	if ufa := readUFA(t, stub, "UFA1"); ufa.InvoicePeriods["2017-10"] != "S-2017-10,B-2017-10," || ufa.RaisedInvTotal != whole(100) {
+		t.Fatalf("Expected the migrated UFA to read the same, got %+v", ufa)
+	}
+}
+
+func TestInitMigratesLedger(t *testing.T) {
+	stub, key, _ := newLegacyLedger(t)
+	if res := stub.init(); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	if _, flat := readRecord(t, stub, key)[INVOICE_PERIOD_PREFIX+"2017-10"]; flat {
+		t.Fatalf("Expected Init to run the pending migrations")
+	}
+}
+
+func TestMigrationFailures(t *testing.T) {
+	stub, key, _ := newLegacyLedger(t)
+	ufa := readRecord(t, stub, key)
+	ufa["netCharge"] = "1000.005"
+	putLegacyState(t, stub, "1", map[string]map[string]interface{}{key: ufa})
+	stub.setCaller(admin)
+	if err := responseError(t, stub.invoke("migrateLedger")); err.Code != ERR_MIGRATION_FAILED || !strings.Contains(err.Message, "ufa UFA1") {
+		t.Fatalf("Expected the malformed amount to fail the migration, got %+v", err)
+	}
+	if schema, _ := stub.MockStub.GetState(SCHEMA_VERSION); string(schema) != "1" {
+		t.Fatalf("Expected a failed migration to write nothing, got schema %s", schema)
+	}
+
+	putLegacyState(t, stub, strconv.Itoa(LEDGER_SCHEMA_VERSION+1), nil)
+	if err := responseError(t, stub.invoke("migrateLedger")); err.Code != ERR_SCHEMA_TOO_NEW {
+		t.Fatalf("Expected a newer ledger to be refused, got %+v", err)
+	}
+	if res := stub.init(); res.Status == shim.OK {
+		t.Fatalf("Expected Init of an older build to fail on a newer ledger")
+	}
+}
+
+func TestMigrationsReachSchemaVersion(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("Expected migration %d to be numbered %d, got %d", i, i+1, m.version)
+		}
+	}
+	if last := migrations[len(migrations)-1].version; last != LEDGER_SCHEMA_VERSION {
+		t.Fatalf("Expected the last migration to reach schema %d, got %d", LEDGER_SCHEMA_VERSION, last)
+	}
+}
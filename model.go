@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//INVOICE_PERIOD_PREFIX Attribute prefix marking a billing period as invoiced on UFAs of schema 1
+const INVOICE_PERIOD_PREFIX = "invperiod_"
+
+//Party A business entity taking part in an agreement
+type Party struct {
+	Name    string `json:"name"`
+	MSPID   string `json:"mspid"`
+	Address string `json:"address,omitempty"`
+}
+
+//Approver Person who signs off an agreement or its invoices on behalf of a party
+type Approver struct {
+	Name    string `json:"name,omitempty"`
+	EmailID string `json:"emailid"`
+}
+
+//UFA Upfront agreement between a seller and a buyer
+type UFA struct {
+	UFANumber      string   `json:"ufanumber"`
+	Seller         Party    `json:"seller"`
+	Buyer          Party    `json:"buyer"`
+	SellerApprover Approver `json:"sellerApprover"`
+	BuyerApprover  Approver `json:"buyerApprover"`
+	//ISO 4217 code of the currency the charges are agreed in
+	Currency      string     `json:"currency,omitempty"`
+	NetCharge     Money      `json:"netCharge"`
+	ChargTolrence Percentage `json:"chargTolrence"`
+	//First and last day invoices can be raised for, as 2006-01-02
+	StartDate string `json:"startDate,omitempty"`
+	EndDate   string `json:"endDate,omitempty"`
+	//Monthly, Quarterly or Milestone, invoices are raised for periods of it. Empty is monthly.
+	BillingFrequency string `json:"billingFrequency,omitempty"`
+	//Milestones billed in order when the frequency is Milestone
+	Milestones []string `json:"milestones,omitempty"`
+	//Invoice batches allowed per billing period, the original one included. 0 allows one.
+	BatchesPerPeriod int    `json:"batchesPerPeriod,omitempty"`
+	Status           string `json:"status"`
+	StatusReason     string `json:"statusReason,omitempty"`
+	StatusChangedBy  string `json:"statusChangedBy,omitempty"`
+	StatusChangedAt  string `json:"statusChangedAt,omitempty"`
+	RaisedInvTotal   Money  `json:"raisedInvTotal"`
+	//Amount given back through credit notes, booked like the invoices
+	CreditedTotal Money `json:"creditedTotal"`
+	//Version of the agreed terms, raised by every accepted amendment
+	Version int `json:"version,omitempty"`
+	//Sequence of the amendment awaiting the counterparty, 0 if none is open
+	PendingAmendment int `json:"pendingAmendment,omitempty"`
+	//Invoice numbers raised per billing period. Records of schema 1 hold them
+	//flat as invperiod_<period> attributes, which are still read.
+	InvoicePeriods map[string]string `json:"invoicePeriods,omitempty"`
+}
+
+//Invoice A single invoice raised against an UFA
+type Invoice struct {
+	InvoiceNumber string `json:"invoiceNumber"`
+	UFANumber     string `json:"ufanumber"`
+	BillingPeriod string `json:"billingPeriod"`
+	InvoiceAmt    Money  `json:"invoiceAmt"`
+	RaisedBy      string `json:"raisedBy,omitempty"`
+	ApprovedBy    string `json:"approvedBy,omitempty"`
+	//Whose copy of the charges the invoice is, the seller invoice carries them
+	Side string `json:"side,omitempty"`
+	//Number of the other copy raised in the same batch
+	PairedWith string `json:"pairedWith,omitempty"`
+	//Supplementary invoices add late charges or adjustments to an invoiced billing period
+	Supplementary bool `json:"supplementary,omitempty"`
+	//Batch of the billing period the invoice was raised in, numbered from 1
+	Batch int `json:"batch,omitempty"`
+	//Part of the amount booked against the UFA total when the invoice was raised
+	BookedAmt Money `json:"bookedAmt"`
+	//Lifecycle of the invoice, changed through the invoice lifecycle functions
+	Status           string `json:"status,omitempty"`
+	StatusReason     string `json:"statusReason,omitempty"`
+	StatusChangedBy  string `json:"statusChangedBy,omitempty"`
+	StatusChangedAt  string `json:"statusChangedAt,omitempty"`
+	PaymentReference string `json:"paymentReference,omitempty"`
+	//Rate the amount was converted at when not in the currency of the UFA
+	FXRate       ExchangeRate `json:"fxRate,omitempty"`
+	ConvertedAmt *Money       `json:"convertedAmt,omitempty"`
+	//Credit notes share the invoice records, they name the invoice they credit
+	DocumentType    string `json:"documentType,omitempty"`
+	CreditedInvoice string `json:"creditedInvoice,omitempty"`
+	//Amount given back on the invoice through credit notes, in its own currency
+	CreditedAmt *Money `json:"creditedAmt,omitempty"`
+	//Charges making up the invoice amount, invoices may be raised without them
+	Lines []LineItem `json:"lines,omitempty"`
+	//Tax of the line items, computed by the chaincode
+	TaxAmt *Money `json:"taxAmt,omitempty"`
+}
+
+//ufaFields UFA without the custom JSON methods
+type ufaFields UFA
+
+//UnmarshalJSON Strictly decodes an UFA, collecting the invperiod_ attributes of unmigrated records
+func (u *UFA) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	periods := make(map[string]string)
+	for key, value := range raw {
+		if !strings.HasPrefix(key, INVOICE_PERIOD_PREFIX) {
+			continue
+		}
+		var invoiceList string
+		if err := json.Unmarshal(value, &invoiceList); err != nil {
+			return fmt.Errorf("json: invalid value for field %q", key)
+		}
+		periods[strings.TrimPrefix(key, INVOICE_PERIOD_PREFIX)] = invoiceList
+		delete(raw, key)
+	}
+	rest, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	var fields ufaFields
+	if err := decodeStrict(rest, &fields); err != nil {
+		return err
+	}
+	*u = UFA(fields)
+	for period, invoiceList := range periods {
+		if u.InvoicePeriods == nil {
+			u.InvoicePeriods = make(map[string]string)
+		}
+		u.InvoicePeriods[period] = invoiceList
+	}
+	//Amounts without a currency are in the currency of the agreement
+	if u.Currency != "" {
+		if u.NetCharge, err = u.NetCharge.withCurrency(u.Currency); err != nil {
+			return errors.New("netCharge: " + err.Error())
+		}
+		if u.RaisedInvTotal, err = u.RaisedInvTotal.withCurrency(u.Currency); err != nil {
+			return errors.New("raisedInvTotal: " + err.Error())
+		}
+		if u.CreditedTotal, err = u.CreditedTotal.withCurrency(u.Currency); err != nil {
+			return errors.New("creditedTotal: " + err.Error())
+		}
+	}
+	return nil
+}
+
+//Returns the maximum amount that can be invoiced including the tolerance,
+//the tolerance amount is truncated to the minor unit
+func (u *UFA) maxCharge() Money {
+	tolerance := u.NetCharge.percent(u.ChargTolrence)
+	return Money{Units: u.NetCharge.Units + tolerance.Units, Currency: u.NetCharge.Currency}
+}
+
+//Returns the amount invoiced against the UFA net of the credit notes
+func (u *UFA) effectiveRaisedTotal() (Money, error) {
+	return u.RaisedInvTotal.minus(u.CreditedTotal)
+}
+
+//Returns a copy of the UFA which does not share the invoice periods
+func (u *UFA) clone() *UFA {
+	copied := *u
+	if u.InvoicePeriods != nil {
+		copied.InvoicePeriods = make(map[string]string, len(u.InvoicePeriods))
+		for period, invoiceList := range u.InvoicePeriods {
+			copied.InvoicePeriods[period] = invoiceList
+		}
+	}
+	return &copied
+}
+
+//Decodes JSON rejecting unknown fields, mistyped values and trailing data
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("json: unexpected data after top-level value")
+	}
+	return nil
+}
+
+//Parse an UFA payload
+func parseUFA(payload []byte) (UFA, error) {
+	var ufa UFA
+	err := decodeStrict(payload, &ufa)
+	return ufa, err
+}
+
+//Parse a single invoice
+func parseInvoice(payload []byte) (Invoice, error) {
+	var invoice Invoice
+	err := decodeStrict(payload, &invoice)
+	return invoice, err
+}
+
+//Parse a list of invoices
+func parseInvoices(payload []byte) ([]Invoice, error) {
+	var invoices []Invoice
+	err := decodeStrict(payload, &invoices)
+	return invoices, err
+}
+
+//Converts a record into a generic field map
+func toFieldMap(record interface{}) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	recBytes, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(recBytes, &fields)
+	return fields, err
+}
+
+//Merges a field patch into a record and strictly decodes the result into
+//target. Returns the fields changed, compared once the result is decoded so
+//values written differently but meaning the same are not reported.
+func applyPatch(record interface{}, patch map[string]interface{}, target interface{}) ([]FieldChange, error) {
+	fields, err := toFieldMap(record)
+	if err != nil {
+		return nil, err
+	}
+	//The merge works on its own copy, fields is kept for the comparison
+	working, err := toFieldMap(record)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := updateFields(working, patch)
+	if err != nil {
+		return nil, err
+	}
+	mergedBytes, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeStrict(mergedBytes, target); err != nil {
+		return nil, err
+	}
+	updated, err := toFieldMap(target)
+	if err != nil {
+		return nil, err
+	}
+	return diffFields(fields, updated, ""), nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//DEFAULT_MINOR_DIGITS Decimal places of amounts without a currency and of most currencies
+const DEFAULT_MINOR_DIGITS = 2
+
+//Decimal places of the ISO 4217 currencies which do not use cents
+var currencyMinorDigits = map[string]int{
+	"BHD": 3, "CLP": 0, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+	"KWD": 3, "OMR": 3, "TND": 3, "UGX": 0, "VND": 0, "XAF": 0, "XOF": 0,
+}
+
+//Money Amount in minor units of an ISO 4217 currency. Amounts of records
+//created before currencies were recorded have no currency and use cents.
+//On the wire an amount is a decimal string, "1250.50", or an object with the
+//currency, {"amount":"1250.50","currency":"EUR"}.
+type Money struct {
+	Units    int64
+	Currency string
+}
+
+//moneyFields Wire format of an amount with a currency
+type moneyFields struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+//Percentage Percentage in hundredths of a percent, "2.5" is 250.
+//On the wire it is a decimal string.
+type Percentage int64
+
+//PERCENTAGE_DIGITS Decimal places kept for percentages
+const PERCENTAGE_DIGITS = 2
+
+//Returns the decimal places of a currency
+func minorDigits(currency string) int {
+	if digits, found := currencyMinorDigits[currency]; found {
+		return digits
+	}
+	return DEFAULT_MINOR_DIGITS
+}
+
+//Checks a currency is an ISO 4217 style code, three upper case letters
+func isCurrencyCode(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+//Parses a decimal string into an integer scaled by 10^digits. More decimal
+//places than digits is an error rather than silently rounded.
+func parseDecimal(value string, digits int) (int64, error) {
+	negative := strings.HasPrefix(value, "-")
+	whole, fraction := strings.TrimPrefix(value, "-"), ""
+	if point := strings.Index(whole, "."); point >= 0 {
+		whole, fraction = whole[:point], whole[point+1:]
+	}
+	if whole == "" || strings.Trim(whole+fraction, "0123456789") != "" {
+		return 0, errors.New("invalid decimal " + strconv.Quote(value))
+	}
+	if len(fraction) > digits {
+		return 0, errors.New("more than " + strconv.Itoa(digits) + " decimal places in " + value)
+	}
+	scaled, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", digits-len(fraction)), 10, 64)
+	if err != nil {
+		return 0, errors.New("decimal out of range " + value)
+	}
+	if negative {
+		scaled = -scaled
+	}
+	return scaled, nil
+}
+
+//Rounds a decimal to digits decimal places, half away from zero. The
+//releases of schema 0 wrote totals as floats, "333.33333333333337", which
+//parseDecimal refuses. The value is read as the float it was written from
+//and rounded on its shortest decimal form, so a total which drifted by less
+//than half a minor unit gets back its exact value. Decimals with at most
+//digits places are returned as they are.
+func roundDecimal(value string, digits int) (string, error) {
+	if _, err := parseDecimal(value, digits); err == nil {
+		return value, nil
+	}
+	float, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", errors.New("invalid decimal " + strconv.Quote(value))
+	}
+	shortest := strconv.FormatFloat(float, 'f', -1, 64)
+	negative := strings.HasPrefix(shortest, "-")
+	whole, fraction := strings.TrimPrefix(shortest, "-"), ""
+	if point := strings.Index(whole, "."); point >= 0 {
+		whole, fraction = whole[:point], whole[point+1:]
+	}
+	roundUp := len(fraction) > digits && fraction[digits] >= '5'
+	fraction = (fraction + strings.Repeat("0", digits))[:digits]
+	scaled, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return "", errors.New("decimal out of range " + value)
+	}
+	if roundUp {
+		scaled++
+	}
+	if negative {
+		scaled = -scaled
+	}
+	return formatDecimal(scaled, digits), nil
+}
+
+//Formats an integer scaled by 10^digits as a decimal string
+func formatDecimal(scaled int64, digits int) string {
+	sign := ""
+	if scaled < 0 {
+		sign, scaled = "-", -scaled
+	}
+	text := strconv.FormatInt(scaled, 10)
+	if digits == 0 {
+		return sign + text
+	}
+	if len(text) <= digits {
+		text = strings.Repeat("0", digits-len(text)+1) + text
+	}
+	return sign + text[:len(text)-digits] + "." + text[len(text)-digits:]
+}
+
+//Parses a decimal amount of a currency, the currency may be empty
+func parseMoney(amount string, currency string) (Money, error) {
+	if currency != "" && !isCurrencyCode(currency) {
+		return Money{}, errors.New("invalid currency code " + strconv.Quote(currency))
+	}
+	units, err := parseDecimal(amount, minorDigits(currency))
+	if err != nil {
+		return Money{}, errors.New("invalid amount: " + err.Error())
+	}
+	return Money{Units: units, Currency: currency}, nil
+}
+
+//String Decimal amount followed by the currency, if any
+func (m Money) String() string {
+	amount := formatDecimal(m.Units, minorDigits(m.Currency))
+	if m.Currency == "" {
+		return amount
+	}
+	return amount + " " + m.Currency
+}
+
+//MarshalJSON Writes the amount as a decimal string or an object with the currency
+func (m Money) MarshalJSON() ([]byte, error) {
+	amount := formatDecimal(m.Units, minorDigits(m.Currency))
+	if m.Currency == "" {
+		return json.Marshal(amount)
+	}
+	return json.Marshal(moneyFields{Amount: amount, Currency: m.Currency})
+}
+
+//UnmarshalJSON Reads an amount written as a decimal string or an object with the currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var fields moneyFields
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err := decodeStrict(data, &fields); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(data, &fields.Amount); err != nil {
+		return errors.New("amounts must be decimal strings")
+	}
+	money, err := parseMoney(fields.Amount, fields.Currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+//Labels an amount without a currency with one, rescaling its minor units.
+//An amount already in another currency is an error.
+func (m Money) withCurrency(currency string) (Money, error) {
+	if m.Currency == currency {
+		return m, nil
+	}
+	if m.Currency != "" {
+		return Money{}, errors.New("amount " + m.String() + " is not in " + currency)
+	}
+	if !isCurrencyCode(currency) {
+		return Money{}, errors.New("invalid currency code " + strconv.Quote(currency))
+	}
+	units := m.Units
+	for digits := DEFAULT_MINOR_DIGITS; digits < minorDigits(currency); digits++ {
+		units = units * 10
+	}
+	for digits := DEFAULT_MINOR_DIGITS; digits > minorDigits(currency); digits-- {
+		if units%10 != 0 {
+			return Money{}, errors.New("more than " + strconv.Itoa(minorDigits(currency)) + " decimal places in " + m.String() + " " + currency)
+		}
+		units = units / 10
+	}
+	return Money{Units: units, Currency: currency}, nil
+}
+
+//Returns the sum of two amounts, an amount without a currency takes the other's.
+//Callers check the currencies before adding, a mismatch is a corrupt record
+//and is never summed.
+func (m Money) plus(other Money) (Money, error) {
+	currency := m.Currency
+	if currency == "" {
+		currency = other.Currency
+	}
+	if other.Currency != "" && other.Currency != currency {
+		return Money{}, newChaincodeError(ERR_CURRENCY_MISMATCH, "", "Unable to add "+other.String()+" to "+m.String())
+	}
+	return Money{Units: m.Units + other.Units, Currency: currency}, nil
+}
+
+//Returns the difference of two amounts
+func (m Money) minus(other Money) (Money, error) {
+	return m.plus(Money{Units: -other.Units, Currency: other.Currency})
+}
+
+//Returns the percentage of an amount, truncated to the minor unit so a
+//tolerance never allows more than the agreed percentage
+func (m Money) percent(p Percentage) Money {
+	return Money{Units: m.Units * int64(p) / 10000, Currency: m.Currency}
+}
+
+//Returns half of an amount, rounded half up to the minor unit
+func (m Money) half() Money {
+	units := m.Units / 2
+	if m.Units%2 != 0 && m.Units > 0 {
+		units++
+	}
+	return Money{Units: units, Currency: m.Currency}
+}
+
+//Parses a decimal percentage
+func parsePercentage(value string) (Percentage, error) {
+	scaled, err := parseDecimal(value, PERCENTAGE_DIGITS)
+	if err != nil {
+		return 0, errors.New("invalid percentage: " + err.Error())
+	}
+	return Percentage(scaled), nil
+}
+
+//String Decimal percentage
+func (p Percentage) String() string {
+	return formatDecimal(int64(p), PERCENTAGE_DIGITS)
+}
+
+//MarshalJSON Writes the percentage as a decimal string
+func (p Percentage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+//UnmarshalJSON Reads a percentage written as a decimal string
+func (p *Percentage) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("percentages must be decimal strings")
+	}
+	percentage, err := parsePercentage(value)
+	if err != nil {
+		return err
+	}
+	*p = percentage
+	return nil
+}
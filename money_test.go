@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoneyParseAndFormat(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		units    int64
+		text     string
+		fails    bool
+	}{
+		{"1000", "", 100000, "1000.00", false},
+		{"0.1", "EUR", 10, "0.10 EUR", false},
+		{"-12.34", "USD", -1234, "-12.34 USD", false},
+		{"1500", "JPY", 1500, "1500 JPY", false},
+		{"1.005", "KWD", 1005, "1.005 KWD", false},
+		{"1.005", "USD", 0, "", true},
+		{"1.5", "JPY", 0, "", true},
+		{"12,50", "", 0, "", true},
+		{"", "", 0, "", true},
+		{"10", "usd", 0, "", true},
+	}
+	for _, test := range tests {
+		money, err := parseMoney(test.amount, test.currency)
+		if test.fails {
+			if err == nil {
+				t.Errorf("Expected %q %q to be rejected, got %v", test.amount, test.currency, money)
+			}
+			continue
+		}
+		if err != nil || money.Units != test.units || money.String() != test.text {
+			t.Errorf("Parsing %q %q gave %d %q, %v", test.amount, test.currency, money.Units, money.String(), err)
+		}
+	}
+}
+
+func TestRoundDecimal(t *testing.T) {
+	tests := []struct {
+		value   string
+		rounded string
+	}{
+		{"333.33333333333337", "333.33"},
+		{"66.66666666666667", "66.67"},
+		{"0.005", "0.01"},
+		{"-2.675", "-2.68"},
+		{"1e3", "1000.00"},
+		{"100", "100"},
+		{"12.5", "12.5"},
+	}
+	for _, test := range tests {
+		if rounded, err := roundDecimal(test.value, DEFAULT_MINOR_DIGITS); err != nil || rounded != test.rounded {
+			t.Errorf("Expected %s to round to %s, got %s %v", test.value, test.rounded, rounded, err)
+		}
+	}
+	if _, err := roundDecimal("12,50", DEFAULT_MINOR_DIGITS); err == nil {
+		t.Errorf("Expected 12,50 to be refused")
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var amounts []Money
+	if err := decodeStrict([]byte(`["10.5",{"amount":"7","currency":"EUR"}]`), &amounts); err != nil {
+		t.Fatalf("Unable to decode amounts: %v", err)
+	}
+	if amounts[0] != (Money{Units: 1050}) || amounts[1] != (Money{Units: 700, Currency: "EUR"}) {
+		t.Fatalf("Unexpected amounts %+v", amounts)
+	}
+	output, _ := json.Marshal(amounts)
+	if string(output) != `["10.50",{"amount":"7.00","currency":"EUR"}]` {
+		t.Fatalf("Unexpected JSON %s", output)
+	}
+	for _, payload := range []string{`10.5`, `{"amount":"7","currency":"EUR","rate":"1"}`, `"1e3"`} {
+		var money Money
+		if err := decodeStrict([]byte(payload), &money); err == nil {
+			t.Errorf("Expected %s to be rejected, got %v", payload, money)
+		}
+	}
+}
+
+func TestToleranceRounding(t *testing.T) {
+	tests := []struct {
+		netCharge string
+		tolerance string
+		maxCharge string
+	}{
+		{"1000", "10", "1100.00"},
+		//24.99975 is truncated, the tolerance never exceeds the agreed percentage
+		{"999.99", "2.5", "1024.98"},
+		{"0.09", "10", "0.09"},
+		{"100", "0", "100.00"},
+	}
+	for _, test := range tests {
+		netCharge, _ := parseMoney(test.netCharge, "")
+		tolerance, err := parsePercentage(test.tolerance)
+		if err != nil {
+			t.Fatalf("Unable to parse tolerance %s: %v", test.tolerance, err)
+		}
+		ufa := UFA{NetCharge: netCharge, ChargTolrence: tolerance}
+		if maxCharge := ufa.maxCharge().String(); maxCharge != test.maxCharge {
+			t.Errorf("Expected %s plus %s%% to allow %s, got %s", test.netCharge, test.tolerance, test.maxCharge, maxCharge)
+		}
+	}
+}
+
+func TestRaisedTotalDoesNotDrift(t *testing.T) {
+	var total Money
+	var raised []Invoice
+	for i := 0; i < 500; i++ {
+		pair := []Invoice{{InvoiceAmt: Money{Units: 11111}, Side: SIDE_SELLER}, {InvoiceAmt: Money{Units: 11111}, Side: SIDE_BUYER}}
+		booked, _ := bookInvoices(pair)
+		total, _ = total.plus(booked)
+		raised = append(raised, pair...)
+	}
+	if total.String() != "55555.00" {
+		t.Fatalf("Expected 500 pairs of 111.11 to book 55555.00, got %s", total)
+	}
+	for i := range raised[:500] {
+		total, _ = total.minus(invoiceContribution(&raised[i]))
+	}
+	if total.String() != "27777.50" {
+		t.Fatalf("Expected withdrawing 250 pairs to leave 27777.50, got %s", total)
+	}
+	//Invoices raised before the pairing was explicit count for half
+	if legacy := invoiceContribution(&Invoice{InvoiceAmt: Money{Units: 11111}}); legacy.String() != "55.56" {
+		t.Fatalf("Expected a legacy invoice to count for half, got %s", legacy)
+	}
+}
+
+func TestMoneyOfDifferentCurrenciesNotAdded(t *testing.T) {
+	if sum, err := (Money{Units: 100}).plus(Money{Units: 50, Currency: "EUR"}); err != nil || sum != (Money{Units: 150, Currency: "EUR"}) {
+		t.Fatalf("Expected an amount without a currency to take the other's, got %+v, %v", sum, err)
+	}
+	if _, err := (Money{Units: 100, Currency: "USD"}).minus(Money{Units: 50, Currency: "EUR"}); err == nil || toChaincodeError(err).Code != ERR_CURRENCY_MISMATCH {
+		t.Fatalf("Expected subtracting EUR from USD to fail with a currency mismatch, got %v", err)
+	}
+}
+
+func TestUFAExhaustedExactly(t *testing.T) {
+	stub := newLedgerStub(t)
+	ufa := newTestUFA("UFA1")
+	ufa.NetCharge, _ = parseMoney("333.33", "")
+	ufa.ChargTolrence = 0
+	mustCreateUFA(t, stub, ufa)
+	for i, period := range []string{"2017-10", "2017-11", "2017-12"} {
+		pair := invoicePair("UFA1", period, 0)
+		pair[0].InvoiceAmt, pair[1].InvoiceAmt = Money{Units: 11111}, Money{Units: 11111}
+		stub.mustInvoke("createInvoices", toJSON(t, pair))
+		if exhausted := readUFA(t, stub, "UFA1").Status == STATUS_EXHAUSTED; exhausted != (i == 2) {
+			t.Fatalf("Unexpected exhaustion after %s", period)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+//Fields the chaincode maintains itself, no patch may write them
+var computedUFAFields = []string{"raisedInvTotal", "invoicePeriods", "creditedTotal", "version", "pendingAmendment"}
+
+//fieldRule Fields the holders of a role may patch while a record is in one
+//of the statuses. A field also covers everything nested under it.
+type fieldRule struct {
+	statuses []string
+	allowed  func(roles UFARoles) bool
+	fields   []string
+}
+
+//Statuses in which an UFA is proposed or in force
+var ufaActiveStatuses = []string{
+	STATUS_PENDING_BUYER_APPROVAL, STATUS_PENDING_SELLER_APPROVAL, STATUS_AGREED,
+	STATUS_SUSPENDED, STATUS_EXHAUSTED, STATUS_EXPIRED,
+}
+
+//Who may patch which UFA fields. The terms are open while the UFA is a draft,
+//the parties and approvers only to their own side so neither can take over
+//the other's. Afterwards each side only maintains its own contact details.
+var ufaFieldPolicy = []fieldRule{
+	{[]string{STATUS_DRAFT}, UFARoles.onAgreement, []string{
+		"currency", "netCharge", "chargTolrence", "batchesPerPeriod", "startDate", "endDate", "billingFrequency", "milestones",
+	}},
+	{[]string{STATUS_DRAFT}, UFARoles.sellerSide, []string{"seller", "sellerApprover"}},
+	{[]string{STATUS_DRAFT}, UFARoles.buyerSide, []string{"buyer", "buyerApprover"}},
+	{ufaActiveStatuses, UFARoles.sellerSide, []string{"seller.name", "seller.address", "sellerApprover.name"}},
+	{ufaActiveStatuses, UFARoles.buyerSide, []string{"buyer.name", "buyer.address", "buyerApprover.name"}},
+}
+
+//Returns the dotted paths of the values a patch writes, objects are descended into
+func patchPaths(patch map[string]interface{}, prefix string) []string {
+	paths := make([]string, 0, len(patch))
+	for name, value := range patch {
+		if object, isObject := value.(map[string]interface{}); isObject {
+			paths = append(paths, patchPaths(object, prefix+name+".")...)
+		} else {
+			paths = append(paths, prefix+name)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+//Checks if a path is a field or nested under it
+func pathCovered(path string, field string) bool {
+	return path == field || strings.HasPrefix(path, field+".")
+}
+
+//Checks if any of the fields covers a path
+func anyPathCovered(path string, fields []string) bool {
+	for _, field := range fields {
+		if pathCovered(path, field) {
+			return true
+		}
+	}
+	return false
+}
+
+//Rejects UFA patches writing computed fields or fields the caller may not
+//change in the current status
+func checkUFAPatch(caller *Caller, ufa *UFA, patch map[string]interface{}) error {
+	roles := caller.rolesOn(ufa)
+	for _, path := range patchPaths(patch, "") {
+		if anyPathCovered(path, computedUFAFields) || strings.HasPrefix(path, INVOICE_PERIOD_PREFIX) {
+			return newChaincodeError(ERR_FIELD_NOT_WRITABLE, path, "Field "+path+" is computed by the chaincode and can not be updated")
+		}
+		allowed := false
+		for _, rule := range ufaFieldPolicy {
+			if containsString(rule.statuses, ufa.Status) && rule.allowed(roles) && anyPathCovered(path, rule.fields) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return newChaincodeError(ERR_FIELD_NOT_UPDATABLE, path, "User "+caller.Email+" can not update "+path+" of UFA "+ufa.UFANumber+" in status "+ufa.Status)
+		}
+	}
+	return nil
+}
+
+//presetField Computed field of a new record and whether the payload sets it
+type presetField struct {
+	name string
+	set  bool
+}
+
+//Rejects the computed and lifecycle fields a new record sets, a new record
+//starts with them empty and the chaincode fills them in
+func checkNothingPreset(record string, fields []presetField) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	for _, field := range fields {
+		if field.set {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_PAYLOAD, field.name, "Field "+field.name+" is computed by the chaincode and can not be set on "+record))
+		}
+	}
+	return errorMessages
+}
+
+//Rejects computed UFA fields in a createUFA payload
+func checkNewUFAFields(ufa *UFA) []*ChaincodeError {
+	return checkNothingPreset("a new UFA", []presetField{
+		{"raisedInvTotal", ufa.RaisedInvTotal.Units != 0},
+		{"invoicePeriods", len(ufa.InvoicePeriods) > 0},
+		{"creditedTotal", ufa.CreditedTotal.Units != 0},
+		{"version", ufa.Version != 0},
+		{"pendingAmendment", ufa.PendingAmendment != 0},
+		{"statusReason", ufa.StatusReason != ""},
+		{"statusChangedBy", ufa.StatusChangedBy != ""},
+		{"statusChangedAt", ufa.StatusChangedAt != ""},
+	})
+}
+
+//Rejects computed and lifecycle invoice fields in a createInvoices payload
+func checkNewInvoiceFields(invoice *Invoice) []*ChaincodeError {
+	return checkNothingPreset("invoice "+invoice.InvoiceNumber, []presetField{
+		{"bookedAmt", invoice.BookedAmt.Units != 0},
+		{"fxRate", invoice.FXRate != 0},
+		{"convertedAmt", invoice.ConvertedAmt != nil},
+		{"documentType", invoice.DocumentType != ""},
+		{"creditedInvoice", invoice.CreditedInvoice != ""},
+		{"creditedAmt", invoice.CreditedAmt != nil},
+		{"batch", invoice.Batch != 0},
+		{"pairedWith", invoice.PairedWith != ""},
+		{"taxAmt", invoice.TaxAmt != nil},
+		{"statusReason", invoice.StatusReason != ""},
+		{"statusChangedBy", invoice.StatusChangedBy != ""},
+		{"statusChangedAt", invoice.StatusChangedAt != ""},
+		{"approvedBy", invoice.ApprovedBy != ""},
+		{"paymentReference", invoice.PaymentReference != ""},
+	})
+}
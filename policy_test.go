@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUFAFieldPolicy(t *testing.T) {
+	stub := newLedgerStub(t)
+	ufa := newTestUFA("UFA1")
+	stub.setCaller(seller)
+	stub.mustInvoke("createUFA", ufa.UFANumber, toJSON(t, ufa))
+
+	//The terms are open to both parties while the UFA is a draft
+	stub.setCaller(buyer)
+	stub.mustInvoke("updateUFA", "UFA1", `{"netCharge":"1200","buyer":{"mspid":"BuyerMSP"}}`)
+	if ufa := readUFA(t, stub, "UFA1"); ufa.NetCharge != whole(1200) {
+		t.Fatalf("Expected the draft net charge to be updated, got %v", ufa.NetCharge)
+	}
+	//Neither side can take over the party or the approver of the other
+	for patch, field := range map[string]string{
+		`{"seller":{"mspid":"BuyerMSP"}}`:                     "seller.mspid",
+		`{"sellerApprover":{"emailid":"` + buyerEmail + `"}}`: "sellerApprover.emailid",
+	} {
+		if err := responseError(t, stub.invoke("updateUFA", "UFA1", patch)); err.Code != ERR_FIELD_NOT_UPDATABLE || err.Field != field {
+			t.Fatalf("Expected the buyer to be refused %s, got %+v", field, err)
+		}
+	}
+	if ufa := readUFA(t, stub, "UFA1"); ufa.Seller.MSPID != seller.mspID || ufa.SellerApprover.EmailID != sellerEmail {
+		t.Fatalf("Expected the seller side untouched, got %+v", ufa)
+	}
+	//Patched terms are checked as on creation
+	for patch, code := range map[string]string{
+		`{"chargTolrence":"50"}`: ERR_TOLERANCE_OUT_OF_RANGE,
+		`{"netCharge":"-5"}`:     ERR_INVALID_NET_CHARGE,
+		`{"currency":null}`:      ERR_CURRENCY_MISSING,
+	} {
+		if err := responseError(t, stub.invoke("updateUFA", "UFA1", patch)); !hasDetail(err, code, "") {
+			t.Fatalf("Expected %s to fail with %s, got %+v", patch, code, err)
+		}
+	}
+	//Numbers are refused as amounts instead of crashing the merge
+	if err := responseError(t, stub.invoke("updateUFA", "UFA1", `{"netCharge":1200}`)); !strings.Contains(err.Message, "Invalid UFA update") {
+		t.Fatalf("Expected a numeric amount to be refused, got %+v", err)
+	}
+	stub.setCaller(seller)
+	stub.mustInvoke("submitUFA", "UFA1")
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveUFA", "UFA1")
+
+	tests := []struct {
+		name   string
+		caller testIdentity
+		patch  string
+		code   string
+		field  string
+	}{
+		{"agreed terms", seller, `{"netCharge":"1500"}`, ERR_FIELD_NOT_UPDATABLE, "netCharge"},
+		{"counterparty details", seller, `{"buyer":{"name":"Someone"}}`, ERR_FIELD_NOT_UPDATABLE, "buyer.name"},
+		{"approver identity", seller, `{"sellerApprover":{"emailid":"x@shell.com"}}`, ERR_FIELD_NOT_UPDATABLE, "sellerApprover.emailid"},
+		{"whole party", seller, `{"seller":null}`, ERR_FIELD_NOT_UPDATABLE, "seller"},
+		{"raised total", seller, `{"raisedInvTotal":"0"}`, ERR_FIELD_NOT_WRITABLE, "raisedInvTotal"},
+		{"billing period marker", seller, `{"invperiod_2017-10":"S-1,B-1,"}`, ERR_FIELD_NOT_WRITABLE, "invperiod_2017-10"},
+	}
+	for _, test := range tests {
+		stub.setCaller(test.caller)
+		err := responseError(t, stub.invoke("updateUFA", "UFA1", test.patch))
+		if err.Code != test.code || err.Field != test.field {
+			t.Fatalf("%s: expected %s on %s, got %+v", test.name, test.code, test.field, err)
+		}
+	}
+
+	//Each side keeps its own contact details up to date
+	stub.setCaller(seller)
+	stub.mustInvoke("updateUFA", "UFA1", `{"seller":{"name":"Shell Trading","address":"London"}}`)
+	stub.setCaller(buyer)
+	stub.mustInvoke("updateUFA", "UFA1", `{"buyerApprover":{"name":"Accounts"}}`)
+	if ufa := readUFA(t, stub, "UFA1"); ufa.Seller.Name != "Shell Trading" || ufa.BuyerApprover.Name != "Accounts" || ufa.NetCharge != whole(1200) {
+		t.Fatalf("Expected only the contact details to change, got %+v", ufa)
+	}
+}
+
+//The seller approver raising an invoice can not hand it to someone else and approve it
+func TestRaiserCanNotApproveOwnInvoice(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 200)))
+
+	if err := responseError(t, stub.invoke("approveInvoice", "S-2017-10")); !strings.Contains(err.Message, "is not allowed to approveInvoice") {
+		t.Fatalf("Expected the raiser to be refused the approval, got %+v", err)
+	}
+	if invoice := readInvoice(t, stub, "UFA1", "S-2017-10"); invoice.RaisedBy != sellerEmail || invoice.Status != INVOICE_RAISED {
+		t.Fatalf("Expected the invoice untouched, got %+v", invoice)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//TAX_RULE_KEY_TYPE Composite key object type of tax rules, taxrule~<code>~<effectiveFrom>
+const TAX_RULE_KEY_TYPE = "taxrule"
+
+//MAX_TAX_CODE_LENGTH Longest tax code accepted
+const MAX_TAX_CODE_LENGTH = 20
+
+//TaxRule Rate of a tax code from a date on, maintained by an administrator.
+//A later rule of the same code replaces it from its own date.
+type TaxRule struct {
+	TaxCode       string     `json:"taxCode"`
+	EffectiveFrom string     `json:"effectiveFrom"`
+	Rate          Percentage `json:"rate"`
+	SetBy         string     `json:"setBy"`
+	SetAt         string     `json:"setAt"`
+}
+
+//TaxSummary Tax on the invoices of an UFA for a billing period, by tax code and rate
+type TaxSummary struct {
+	UFANumber     string           `json:"ufanumber"`
+	BillingPeriod string           `json:"billingPeriod"`
+	Taxes         []TaxSummaryLine `json:"taxes"`
+}
+
+//TaxSummaryLine Lines of the billing period taxed under one code at one rate
+type TaxSummaryLine struct {
+	TaxCode  string     `json:"taxCode"`
+	TaxRate  Percentage `json:"taxRate"`
+	Lines    int        `json:"lines"`
+	NetAmt   Money      `json:"netAmt"`
+	TaxAmt   Money      `json:"taxAmt"`
+	Invoices []string   `json:"invoices"`
+}
+
+//Checks a tax code can be used as a ledger key, upper case letters, digits, - and _
+func isTaxCode(code string) bool {
+	if code == "" || len(code) > MAX_TAX_CODE_LENGTH {
+		return false
+	}
+	for _, c := range code {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns the tax at a rate on a net amount, rounded half up to the minor unit
+func (p Percentage) taxOn(net Money) Money {
+	numerator := new(big.Int).Mul(big.NewInt(net.Units), big.NewInt(int64(p)))
+	return Money{Units: divideRounded(numerator, pow10(PERCENTAGE_DIGITS+2)), Currency: net.Currency}
+}
+
+//Returns the ledger key of a tax rule
+func taxRuleKey(stub shim.ChaincodeStubInterface, code string, effectiveFrom string) (string, error) {
+	return stub.CreateCompositeKey(TAX_RULE_KEY_TYPE, []string{code, effectiveFrom})
+}
+
+//Reads the tax rules of a code, or of all codes when it is empty, oldest first
+func getTaxRules(stub shim.ChaincodeStubInterface, code string) ([]TaxRule, error) {
+	var attributes []string
+	if code != "" {
+		attributes = []string{code}
+	}
+	values, err := getStateByPartialKey(stub, TAX_RULE_KEY_TYPE, attributes)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]TaxRule, 0, len(values))
+	for _, value := range values {
+		var rule TaxRule
+		if err := decodeStrict(value, &rule); err != nil {
+			return nil, errors.New("Corrupt tax rule: " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+//Reads the rule of a tax code in effect on a date, nil if there is none
+func getTaxRule(stub shim.ChaincodeStubInterface, code string, date string) (*TaxRule, error) {
+	rules, err := getTaxRules(stub, code)
+	if err != nil {
+		return nil, err
+	}
+	var effective *TaxRule
+	//Keys sort by date so the last rule started on or before the date applies
+	for i := range rules {
+		if rules[i].EffectiveFrom <= date {
+			effective = &rules[i]
+		}
+	}
+	return effective, nil
+}
+
+//Records the rate of a tax code from a date on, administrators only.
+//Arguments are the tax code, the date it takes effect and the rate in percent
+func setTaxRule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("setTaxRule called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !caller.isAdmin() {
+		return nil, newChaincodeError(ERR_NOT_AUTHORIZED, "", "User "+caller.Email+" is not allowed to maintain tax rules")
+	}
+	code, effectiveFrom := args[0], args[1]
+	if !isTaxCode(code) {
+		return nil, newChaincodeError(ERR_INVALID_TAX_RULE, "taxCode", "Tax codes are upper case letters, digits, - and _, got "+code)
+	}
+	if _, err := time.Parse(DATE_LAYOUT, effectiveFrom); err != nil {
+		return nil, newChaincodeError(ERR_INVALID_TAX_RULE, "effectiveFrom", "Tax rules take effect on a date written as "+DATE_LAYOUT+", got "+effectiveFrom)
+	}
+	rate, err := parsePercentage(args[2])
+	if err != nil || rate < 0 || rate > 100*100 {
+		return nil, newChaincodeError(ERR_INVALID_TAX_RULE, "rate", "Tax rates are percentages between 0 and 100, got "+args[2])
+	}
+	setAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	key, err := taxRuleKey(stub, code, effectiveFrom)
+	if err != nil {
+		return nil, err
+	}
+	ruleBytes, err := json.Marshal(TaxRule{TaxCode: code, EffectiveFrom: effectiveFrom, Rate: rate, SetBy: caller.Email, SetAt: setAt})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("setTaxRule " + code + " from " + effectiveFrom + " at " + rate.String())
+	return nil, stub.PutState(key, ruleBytes)
+}
+
+//Returns all the recorded tax rules
+func getAllTaxRules(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	logger.Info("getTaxRules called")
+	rules, err := getTaxRules(stub, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rules)
+}
+
+//Computes the tax of the line items of an invoice from the rules in effect on
+//the date it is raised. Lines without a tax code are not taxed.
+func computeLineTaxes(stub shim.ChaincodeStubInterface, invoice *Invoice, taxDate string) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	for i := range invoice.Lines {
+		line := &invoice.Lines[i]
+		line.TaxRate = 0
+		if line.TaxCode == "" {
+			continue
+		}
+		rule, err := getTaxRule(stub, line.TaxCode, taxDate)
+		if err != nil {
+			errorMessages = append(errorMessages, toChaincodeError(err))
+			continue
+		}
+		if rule == nil {
+			errorMessages = append(errorMessages, newChaincodeError(ERR_UNKNOWN_TAX_CODE, lineField(i, "taxCode"),
+				"No rate of tax code "+line.TaxCode+" is in effect on "+taxDate))
+			continue
+		}
+		line.TaxRate = rule.Rate
+	}
+	return errorMessages
+}
+
+//Returns the tax charged on the invoices of an UFA for a billing period.
+//Buyer copies repeat the seller invoice and withdrawn invoices are left out.
+//Arguments are the UFA number and the billing period
+func getTaxSummary(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("getTaxSummary called")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	ufanumber, period := args[0], args[1]
+	ufa, err := getUFA(stub, ufanumber)
+	if err != nil {
+		return nil, err
+	}
+	if ufa == nil {
+		return nil, errors.New("Invalid UFA number " + ufanumber)
+	}
+	err = authorizeOnUFA(caller, ufa)
+	if err != nil {
+		return nil, err
+	}
+	//Invoices are keyed by the period as createInvoices normalized it
+	period, err = normalizeBillingPeriod(ufa, period)
+	if err != nil {
+		return nil, newChaincodeError(ERR_INVALID_BILLING_PERIOD, "billingPeriod", "Invalid "+strings.ToLower(ufa.billingFrequency())+" billing period "+args[1]+", "+err.Error())
+	}
+	invoices, err := getInvoiceRecords(stub, ufanumber, period)
+	if err != nil {
+		return nil, errors.New("Unable to get the invoices of UFA " + ufanumber + ": " + err.Error())
+	}
+	summary := TaxSummary{UFANumber: ufanumber, BillingPeriod: period, Taxes: []TaxSummaryLine{}}
+	byRate := make(map[string]*TaxSummaryLine)
+	for _, invoice := range invoices {
+		if invoice.isBuyerCopy() || isWithdrawnInvoice(invoice.Status) {
+			continue
+		}
+		for _, line := range invoice.Lines {
+			//Lines in different currencies are summed apart
+			group := line.TaxCode + "~" + line.TaxRate.String() + "~" + line.NetAmt.Currency
+			taxes, found := byRate[group]
+			if !found {
+				taxes = &TaxSummaryLine{TaxCode: line.TaxCode, TaxRate: line.TaxRate, NetAmt: Money{Currency: line.NetAmt.Currency}, TaxAmt: Money{Currency: line.NetAmt.Currency}}
+				byRate[group] = taxes
+			}
+			taxes.Lines++
+			if taxes.NetAmt, err = taxes.NetAmt.plus(line.NetAmt); err != nil {
+				return nil, err
+			}
+			if taxes.TaxAmt, err = taxes.TaxAmt.plus(line.TaxAmt); err != nil {
+				return nil, err
+			}
+			if len(taxes.Invoices) == 0 || taxes.Invoices[len(taxes.Invoices)-1] != invoice.InvoiceNumber {
+				taxes.Invoices = append(taxes.Invoices, invoice.InvoiceNumber)
+			}
+		}
+	}
+	for _, taxes := range byRate {
+		summary.Taxes = append(summary.Taxes, *taxes)
+	}
+	sort.Slice(summary.Taxes, func(i, j int) bool {
+		left, right := summary.Taxes[i], summary.Taxes[j]
+		if left.TaxCode != right.TaxCode {
+			return left.TaxCode < right.TaxCode
+		}
+		if left.TaxRate != right.TaxRate {
+			return left.TaxRate < right.TaxRate
+		}
+		return left.NetAmt.Currency < right.NetAmt.Currency
+	})
+	return json.Marshal(summary)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTaxRules(t *testing.T) {
+	stub := newLedgerStub(t)
+	tests := []struct {
+		name   string
+		caller testIdentity
+		args   []string
+		code   string
+	}{
+		{"not an administrator", seller, []string{"VAT", "2017-01-01", "20"}, ERR_NOT_AUTHORIZED},
+		{"lower case code", admin, []string{"vat", "2017-01-01", "20"}, ERR_INVALID_TAX_RULE},
+		{"invalid date", admin, []string{"VAT", "2017-13-01", "20"}, ERR_INVALID_TAX_RULE},
+		{"rate over 100", admin, []string{"VAT", "2017-01-01", "100.01"}, ERR_INVALID_TAX_RULE},
+		{"negative rate", admin, []string{"VAT", "2017-01-01", "-1"}, ERR_INVALID_TAX_RULE},
+	}
+	for _, test := range tests {
+		stub.setCaller(test.caller)
+		if err := responseError(t, stub.invoke("setTaxRule", test.args...)); err.Code != test.code {
+			t.Fatalf("%s: expected %s, got %+v", test.name, test.code, err)
+		}
+	}
+
+	stub.setCaller(admin)
+	stub.mustInvoke("setTaxRule", "VAT", "2017-01-01", "20")
+	stub.mustInvoke("setTaxRule", "VAT", "2017-10-02", "21")
+	stub.mustInvoke("setTaxRule", "GST", "2017-01-01", "5")
+	var rules []TaxRule
+	if err := json.Unmarshal(stub.mustInvoke("getTaxRules"), &rules); err != nil || len(rules) != 3 {
+		t.Fatalf("Expected the three rules to be listed, got %+v %v", rules, err)
+	}
+	for date, expected := range map[string]Percentage{"2016-12-31": 0, "2017-10-01": 20 * 100, "2017-10-02": 21 * 100, "2018-01-01": 21 * 100} {
+		rule, err := getTaxRule(stub, "VAT", date)
+		if err != nil {
+			t.Fatalf("Unable to read the VAT rule on %s: %v", date, err)
+		}
+		if rule == nil && expected != 0 || rule != nil && rule.Rate != expected {
+			t.Errorf("Expected VAT at %s on %s, got %+v", expected, date, rule)
+		}
+	}
+}
+
+func TestTaxComputedOnInvoices(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.setCaller(admin)
+	stub.mustInvoke("setTaxRule", "VAT", "2017-01-01", "20")
+	stub.mustInvoke("setTaxRule", "ZERO", "2017-01-01", "0")
+	stub.setCaller(seller)
+
+	for payload, code := range map[string]string{
+		linePair("2017-10", `[{"description":"Jet fuel","quantity":"1","unitPrice":"100","taxCode":"GST"}]`):                  ERR_UNKNOWN_TAX_CODE,
+		linePair("2017-10", `[{"description":"Jet fuel","quantity":"1","unitPrice":"100","taxCode":"VAT","taxAmt":"19.99"}]`): ERR_TAX_MISMATCH,
+		linePair("2017-10", `[{"description":"Jet fuel","quantity":"1","unitPrice":"100","taxAmt":"20"}]`):                    ERR_TAX_MISMATCH,
+	} {
+		if err := responseError(t, stub.invoke("createInvoices", payload)); !hasDetail(err, code, "") {
+			t.Fatalf("Expected %s to fail with %s, got %+v", payload, code, err)
+		}
+	}
+
+	stub.mustInvoke("createInvoices", linePair("2017-10", `[
+		{"description":"Jet fuel","quantity":"2","unitPrice":"100","taxCode":"VAT","taxAmt":"40"},
+		{"description":"Into-plane","quantity":"1","unitPrice":"50","taxCode":"VAT"},
+		{"description":"Export","quantity":"1","unitPrice":"30","taxCode":"ZERO"},
+		{"description":"Handling","quantity":"1","unitPrice":"10"}]`))
+	invoice := readInvoice(t, stub, "UFA1", "S-2017-10")
+	if invoice.TaxAmt == nil || *invoice.TaxAmt != whole(50) || invoice.InvoiceAmt != whole(340) || invoice.Lines[1].TaxRate != 20*100 {
+		t.Fatalf("Expected 50 of tax on 290, got %+v", invoice)
+	}
+
+	var summary TaxSummary
+	if err := json.Unmarshal(stub.mustInvoke("getTaxSummary", "UFA1", "2017-10"), &summary); err != nil {
+		t.Fatalf("Unable to parse the tax summary: %v", err)
+	}
+	if len(summary.Taxes) != 3 {
+		t.Fatalf("Expected untaxed, VAT and zero rated lines, got %+v", summary)
+	}
+	untaxed, vat, zero := summary.Taxes[0], summary.Taxes[1], summary.Taxes[2]
+	if untaxed.TaxCode != "" || untaxed.NetAmt != whole(10) || untaxed.TaxAmt != whole(0) {
+		t.Errorf("Expected the handling to be untaxed, got %+v", untaxed)
+	}
+	//The buyer copy repeats the seller invoice and is not counted again
+	if vat.TaxCode != "VAT" || vat.Lines != 2 || vat.NetAmt != whole(250) || vat.TaxAmt != whole(50) || len(vat.Invoices) != 1 {
+		t.Errorf("Expected 50 of VAT on 250, got %+v", vat)
+	}
+	if zero.TaxCode != "ZERO" || zero.NetAmt != whole(30) || zero.TaxAmt != whole(0) {
+		t.Errorf("Expected the export to be zero rated, got %+v", zero)
+	}
+	//The period is read in any spelling createInvoices accepts
+	for _, period := range []string{"2017-10", "10/2017", "Oct 2017", " 2017-10 "} {
+		var respelled TaxSummary
+		json.Unmarshal(stub.mustInvoke("getTaxSummary", "UFA1", period), &respelled)
+		if respelled.BillingPeriod != "2017-10" || !reflect.DeepEqual(respelled.Taxes, summary.Taxes) {
+			t.Errorf("Expected the summary of %q to be the one of 2017-10, got %+v", period, respelled)
+		}
+	}
+	if err := responseError(t, stub.invoke("getTaxSummary", "UFA1", "2017-Q4")); err.Code != ERR_INVALID_BILLING_PERIOD {
+		t.Fatalf("Expected a quarter to be refused on a monthly UFA, got %+v", err)
+	}
+	if err := json.Unmarshal(stub.mustInvoke("getTaxSummary", "UFA1", "2017-1"), &summary); err != nil || summary.BillingPeriod != "2017-01" || len(summary.Taxes) != 0 {
+		t.Fatalf("Expected an empty summary of 2017-01, got %+v", summary)
+	}
+	stub.setCaller(outsider)
+	if err := responseError(t, stub.invoke("getTaxSummary", "UFA1", "2017-10")); err.Code != ERR_NOT_A_PARTY {
+		t.Fatalf("Expected an outsider to be refused the summary, got %+v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//DATE_LAYOUT Layout of calendar dates, validity dates and the dates tax rules take effect on
+const DATE_LAYOUT = "2006-01-02"
+
+//Validates the validity window of a new UFA
+func validateValidity(ufa *UFA) []*ChaincodeError {
+	var errorMessages []*ChaincodeError
+	start, startErr := time.Parse(DATE_LAYOUT, ufa.StartDate)
+	if startErr != nil {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_VALIDITY, "startDate", "Start date of the UFA is required as "+DATE_LAYOUT+", got "+ufa.StartDate))
+	}
+	end, endErr := time.Parse(DATE_LAYOUT, ufa.EndDate)
+	if endErr != nil {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_VALIDITY, "endDate", "End date of the UFA is required as "+DATE_LAYOUT+", got "+ufa.EndDate))
+	}
+	if startErr == nil && endErr == nil && end.Before(start) {
+		errorMessages = append(errorMessages, newChaincodeError(ERR_INVALID_VALIDITY, "endDate", "UFA ends on "+ufa.EndDate+" before it starts on "+ufa.StartDate))
+	}
+	return errorMessages
+}
+
+//Checks if the validity of an UFA ended before a day. UFAs agreed before
+//validity dates were recorded never end by date.
+func (u *UFA) validityEnded(today string) bool {
+	return u.EndDate != "" && u.EndDate < today
+}
+
+//Allows expireUFA only once the validity of the UFA ended, as of the day of the transaction
+func checkValidityEnded(stub shim.ChaincodeStubInterface, ufa *UFA) error {
+	today, err := getTxDate(stub)
+	if err != nil {
+		return err
+	}
+	if ufa.EndDate == "" {
+		return newChaincodeError(ERR_UFA_STILL_VALID, "endDate", "UFA "+ufa.UFANumber+" has no end date")
+	}
+	if !ufa.validityEnded(today) {
+		return newChaincodeError(ERR_UFA_STILL_VALID, "endDate", "UFA "+ufa.UFANumber+" is valid until "+ufa.EndDate)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUFAValidityDates(t *testing.T) {
+	valid := newTestUFA("UFA1")
+	noDates := valid
+	noDates.StartDate, noDates.EndDate = "", ""
+	reversed := valid
+	reversed.StartDate, reversed.EndDate = "2018-01-01", "2017-12-31"
+	malformed := valid
+	malformed.EndDate = "31/12/2018"
+	for name, ufa := range map[string]UFA{"missing dates": noDates, "end before start": reversed, "malformed date": malformed} {
+		if errs := validateValidity(&ufa); len(errs) == 0 || errs[0].Code != ERR_INVALID_VALIDITY {
+			t.Errorf("%s: expected %s, got %+v", name, ERR_INVALID_VALIDITY, errs)
+		}
+	}
+	if errs := validateValidity(&valid); len(errs) != 0 {
+		t.Errorf("Expected the test UFA to be valid, got %+v", errs)
+	}
+
+	stub := newLedgerStub(t)
+	stub.setCaller(seller)
+	stub.mustInvoke("createUFA", "UFA1", toJSON(t, valid))
+	if err := responseError(t, stub.invoke("updateUFA", "UFA1", `{"endDate":"2016-12-31"}`)); !hasDetail(err, ERR_INVALID_VALIDITY, "") {
+		t.Fatalf("Expected a patched validity to be checked, got %+v", err)
+	}
+	stub.mustInvoke("updateUFA", "UFA1", `{"endDate":"2017-12-31"}`)
+	if ufa := readUFA(t, stub, "UFA1"); ufa.EndDate != "2017-12-31" {
+		t.Fatalf("Expected the draft validity to be updated, got %s", ufa.EndDate)
+	}
+}
+
+func TestBillingPeriodWithinValidity(t *testing.T) {
+	stub := newLedgerStub(t)
+	ufa := newTestUFA("UFA1")
+	ufa.StartDate, ufa.EndDate = "2017-03-15", "2017-10-15"
+	mustCreateUFA(t, stub, ufa)
+	for period, code := range map[string]string{
+		"2017-02": ERR_PERIOD_OUTSIDE_VALIDITY,
+		"2017-11": ERR_PERIOD_OUTSIDE_VALIDITY,
+		"10.2017": ERR_INVALID_BILLING_PERIOD,
+	} {
+		if err := responseError(t, stub.invoke("createInvoices", toJSON(t, invoicePair("UFA1", period, 10)))); !hasDetail(err, code, "") {
+			t.Errorf("Expected %s to fail with %s, got %+v", period, code, err)
+		}
+	}
+	//Partly covered months at either end can be invoiced
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-03", 10)))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 10)))
+}
+
+func TestExpireUFA(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	ended := newTestUFA("UFA2")
+	//The ledger stub transacts on 2017-12-01
+	ended.StartDate, ended.EndDate = "2016-10-01", "2017-09-30"
+	mustCreateUFA(t, stub, ended)
+
+	var active []UFA
+	json.Unmarshal(stub.mustInvoke("getAllNonExiredUFA"), &active)
+	if len(active) != 1 || active[0].UFANumber != "UFA1" {
+		t.Fatalf("Expected the ended UFA2 to be left out despite its budget, got %+v", active)
+	}
+	if err := responseError(t, stub.invoke("expireUFA", "UFA1")); err.Code != ERR_UFA_STILL_VALID {
+		t.Fatalf("Expected UFA1 to be still valid, got %+v", err)
+	}
+	stub.setCaller(outsider)
+	if err := responseError(t, stub.invoke("expireUFA", "UFA2")); err.Code != ERR_NOT_A_PARTY {
+		t.Fatalf("Expected an outsider to be refused, got %+v", err)
+	}
+	stub.setCaller(buyer)
+	stub.mustInvoke("expireUFA", "UFA2")
+	if ufa := readUFA(t, stub, "UFA2"); ufa.Status != STATUS_EXPIRED {
+		t.Fatalf("Expected UFA2 to be expired, got %s", ufa.Status)
+	}
+	stub.mustInvoke("closeUFA", "UFA2")
+}
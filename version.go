@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//Build of the chaincode, stamped at build time with
+//go build -ldflags "-X main.buildVersion=1.5.0 -X main.buildCommit=$(git rev-parse --short HEAD)"
+var (
+	buildVersion = "1.5.0"
+	buildCommit  = "unknown"
+)
+
+//LEDGER_SCHEMA_VERSION Layout of the ledger records this build reads and writes.
+//Raised with a migration whenever the layout changes, see migrations.
+const LEDGER_SCHEMA_VERSION = 5
+
+//SCHEMA_VERSION Ledger key of the schema version the ledger records are in
+const SCHEMA_VERSION = "SCHEMA_VERSION"
+
+//Features of the chaincode enabled in this build, listed by probe
+var enabledFeatures = []string{
+	"fieldPolicy", "amendments", "creditNotes", "supplementaryBatches", "invoicePairing", "fxRates",
+	"lineItems", "taxRules", "validityDates", "billingCalendar", "history", "events", "migrations",
+}
+
+//Deployment Build of the chaincode the ledger was last initialised with, kept under CHAIN_CODE_VERSION
+type Deployment struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit"`
+	InitializedAt string `json:"initializedAt"`
+}
+
+//ProbeResult Answer of probe, used by operations to verify a deployment
+type ProbeResult struct {
+	Status        string      `json:"status"`
+	Timestamp     string      `json:"ts"`
+	Version       string      `json:"version"`
+	Commit        string      `json:"commit"`
+	SchemaVersion int         `json:"schemaVersion"`
+	LedgerSchema  int         `json:"ledgerSchemaVersion"`
+	Deployment    *Deployment `json:"deployment,omitempty"`
+	Counts        ProbeCounts `json:"counts"`
+	Features      []string    `json:"features"`
+}
+
+//ProbeCounts Records on the ledger
+type ProbeCounts struct {
+	UFAs        int `json:"ufas"`
+	Invoices    int `json:"invoices"`
+	CreditNotes int `json:"creditNotes"`
+}
+
+//Returns the build the chaincode runs
+func currentDeployment(initializedAt string) Deployment {
+	return Deployment{Version: buildVersion, Commit: buildCommit, InitializedAt: initializedAt}
+}
+
+//Reads the deployment recorded by Init, nil if none is. Ledgers initialised
+//before deployments were recorded hold the time of Init instead.
+func getDeployment(stub shim.ChaincodeStubInterface) (*Deployment, error) {
+	recBytes, err := stub.GetState(CHAIN_CODE_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var deployment Deployment
+	if err := json.Unmarshal(recBytes, &deployment); err != nil {
+		return &Deployment{InitializedAt: string(recBytes)}, nil
+	}
+	return &deployment, nil
+}
+
+//Records the build the ledger is initialised with
+func putDeployment(stub shim.ChaincodeStubInterface, deployment Deployment) error {
+	deploymentBytes, err := json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(CHAIN_CODE_VERSION, deploymentBytes)
+}
+
+//Reads the schema version of the ledger records, 0 for ledgers written
+//before schema versions were recorded
+func getSchemaVersion(stub shim.ChaincodeStubInterface) (int, error) {
+	recBytes, err := stub.GetState(SCHEMA_VERSION)
+	if err != nil {
+		return 0, err
+	}
+	if recBytes == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(recBytes))
+	if err != nil {
+		return 0, errors.New("Corrupt schema version " + strconv.Quote(string(recBytes)))
+	}
+	return version, nil
+}
+
+//Records the schema version of the ledger records
+func putSchemaVersion(stub shim.ChaincodeStubInterface, version int) error {
+	return stub.PutState(SCHEMA_VERSION, []byte(strconv.Itoa(version)))
+}
+
+//Counts the records of the ledger
+func countRecords(stub shim.ChaincodeStubInterface) (ProbeCounts, error) {
+	var counts ProbeCounts
+	ufas, err := getStateByPartialKey(stub, UFA_KEY_TYPE, []string{})
+	if err != nil {
+		return counts, err
+	}
+	counts.UFAs = len(ufas)
+	invoices, err := getInvoiceRecords(stub)
+	if err != nil {
+		return counts, err
+	}
+	//Each invoice is counted once, not once per copy
+	for i := range invoices {
+		if invoices[i].isBuyerCopy() {
+			continue
+		}
+		if invoices[i].isCreditNote() {
+			counts.CreditNotes++
+		} else {
+			counts.Invoices++
+		}
+	}
+	return counts, nil
+}
+
+//Probe method to check the installation of the chain code in HLF
+func probe(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	logger.Info("probe called")
+	ts, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	deployment, err := getDeployment(stub)
+	if err != nil {
+		return nil, err
+	}
+	schemaVersion, err := getSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := countRecords(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ProbeResult{
+		Status:        "Success",
+		Timestamp:     ts,
+		Version:       buildVersion,
+		Commit:        buildCommit,
+		SchemaVersion: LEDGER_SCHEMA_VERSION,
+		LedgerSchema:  schemaVersion,
+		Deployment:    deployment,
+		Counts:        counts,
+		Features:      enabledFeatures,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//Reads the probe result of the ledger
+func readProbe(t *testing.T, stub *ledgerStub) ProbeResult {
+	t.Helper()
+	var result ProbeResult
+	if err := json.Unmarshal(stub.mustInvoke("probe"), &result); err != nil {
+		t.Fatalf("Unable to parse the probe result: %v", err)
+	}
+	return result
+}
+
+func TestProbe(t *testing.T) {
+	stub := newLedgerStub(t)
+	mustCreateUFA(t, stub, newTestUFA("UFA1"))
+	stub.mustInvoke("createInvoices", toJSON(t, invoicePair("UFA1", "2017-10", 1100)))
+	stub.setCaller(buyer)
+	stub.mustInvoke("approveInvoice", "S-2017-10")
+	stub.setCaller(seller)
+	stub.mustInvoke("createCreditNote", creditNote("C-2017-10", "S-2017-10", "200"))
+
+	result := readProbe(t, stub)
+	if result.Status != "Success" || result.Version != buildVersion || result.Commit != buildCommit {
+		t.Fatalf("Expected the build of the chaincode, got %+v", result)
+	}
+	if result.SchemaVersion != LEDGER_SCHEMA_VERSION || result.LedgerSchema != LEDGER_SCHEMA_VERSION {
+		t.Fatalf("Expected Init to record schema %d, got %d", LEDGER_SCHEMA_VERSION, result.LedgerSchema)
+	}
+	if result.Deployment == nil || result.Deployment.Version != buildVersion || result.Deployment.InitializedAt == "" {
+		t.Fatalf("Expected the deployment recorded by Init, got %+v", result.Deployment)
+	}
+	if result.Counts != (ProbeCounts{UFAs: 1, Invoices: 1, CreditNotes: 1}) {
+		t.Fatalf("Expected one UFA, invoice and credit note, got %+v", result.Counts)
+	}
+	if len(result.Features) == 0 {
+		t.Fatalf("Expected the enabled features to be listed")
+	}
+}
+
+func TestProbeOfLegacyLedger(t *testing.T) {
+	stub := newLedgerStub(t)
+	stub.MockTransactionStart("legacy")
+	stub.MockStub.PutState(CHAIN_CODE_VERSION, []byte("2017-11-30T09:00:00Z"))
+	stub.MockStub.DelState(SCHEMA_VERSION)
+	stub.MockTransactionEnd("legacy")
+
+	result := readProbe(t, stub)
+	if result.LedgerSchema != 0 || result.Deployment == nil || result.Deployment.InitializedAt != "2017-11-30T09:00:00Z" || result.Deployment.Version != "" {
+		t.Fatalf("Expected the Init time of the legacy ledger and no schema, got %+v", result)
+	}
+}